@@ -0,0 +1,233 @@
+// Kkjs runs JavaScript files in a duktape context with console, timers
+// (setTimeout and friends, Promise) and require() enabled.
+//
+//	kkjs [-root dir] [-transpile] file.js...
+//	kkjs test [-root dir] [-transpile] [-format tap|junit] [-timeout 5s] [path...]
+//	kkjs repl [-root dir] [-transpile] [-r module]...
+//
+// Files are loaded as CommonJS modules, require() resolving names from the
+// root directory (the current directory by default) and relative names from
+// the requiring file. The process waits for the timers to complete and exits
+// with status 1 when a script throws.
+//
+// The test subcommand runs the *.test.js files found in the paths, see
+// testCommand, and the repl subcommand starts an interactive session, see
+// replCommand.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hailongz/kk-lib/duktape"
+)
+
+const usage = `usage: kkjs [-root dir] [-transpile] file.js...
+       kkjs test [-root dir] [-transpile] [-format tap|junit] [-timeout 5s] [path...]
+       kkjs repl [-root dir] [-transpile] [-r module]...
+`
+
+// options are the flags shared by the subcommands.
+type options struct {
+	root      string
+	transpile bool
+}
+
+func (o *options) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.root, "root", ".", "directory require() resolves names from")
+	flags.BoolVar(&o.transpile, "transpile", false, "transpile ES2015+ scripts to ES5")
+}
+
+func main() {
+
+	args := os.Args[1:]
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "test":
+			os.Exit(testCommand(args[1:]))
+		case "repl":
+			os.Exit(replCommand(args[1:]))
+		}
+	}
+
+	os.Exit(runCommand(args))
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func runCommand(args []string) int {
+
+	var o options
+
+	flags := newFlagSet("kkjs")
+	o.register(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	rt, err := newRuntime(o, consoleLogger)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kkjs:", err)
+		return 1
+	}
+
+	defer rt.close()
+
+	for _, file := range flags.Args() {
+
+		err := rt.loop.Run(func(ctx *duktape.Context) {
+			if err := rt.require(file); err != nil {
+				rt.loop.OnError(err)
+			}
+		})
+
+		if err == nil {
+			err = rt.firstErr()
+		}
+
+		if err != nil {
+			printError(err)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// runtime is a context with its event loop.
+type runtime struct {
+	root string
+	ctx  *duktape.Context
+	loop *duktape.Loop
+	// err is the first uncaught error, set on the loop.
+	err  error
+	lock sync.Mutex
+}
+
+// consoleLogger prints the console output without the date and level of
+// StdLogger, warnings and errors on stderr.
+var consoleLogger = duktape.LoggerFunc(func(level int, message string, fileName string, lineNumber int) {
+	if level >= duktape.LogWarn {
+		fmt.Fprintln(os.Stderr, message)
+	} else {
+		fmt.Println(message)
+	}
+})
+
+func newRuntime(o options, logger duktape.Logger) (*runtime, error) {
+
+	root, err := filepath.Abs(o.root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := duktape.NewWithOptions(duktape.Options{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.EnableConsole(logger)
+	ctx.EnableModules(duktape.NewDirResolver(root))
+
+	if err = ctx.EnableBinary(); err == nil && o.transpile {
+		err = ctx.EnableTranspiler()
+	}
+
+	if err != nil {
+		ctx.DestroyHeap()
+		return nil, err
+	}
+
+	rt := &runtime{root: root, ctx: ctx}
+	rt.loop = duktape.NewLoop(ctx, nil)
+	rt.loop.OnError = rt.fail
+
+	return rt, nil
+}
+
+// fail records err unless an error was already recorded.
+func (rt *runtime) fail(err error) {
+	rt.lock.Lock()
+	if rt.err == nil {
+		rt.err = err
+	}
+	rt.lock.Unlock()
+}
+
+func (rt *runtime) firstErr() error {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return rt.err
+}
+
+// require loads file as the main module. Called on the loop.
+func (rt *runtime) require(file string) error {
+
+	id, err := rt.moduleId(file)
+
+	if err != nil {
+		return err
+	}
+
+	name, _ := json.Marshal("./" + id)
+
+	defer rt.ctx.Pop()
+
+	return rt.ctx.PevalString("require(" + string(name) + ")")
+}
+
+// moduleId returns the path of file relative to the root.
+func (rt *runtime) moduleId(file string) (string, error) {
+
+	p, err := filepath.Abs(file)
+
+	if err != nil {
+		return "", err
+	}
+
+	id, err := filepath.Rel(rt.root, p)
+
+	if err != nil || id == ".." || strings.HasPrefix(id, ".."+string(filepath.Separator)) {
+		return "", errors.New(file + " is outside of the root directory " + rt.root + ", see -root")
+	}
+
+	return filepath.ToSlash(id), nil
+}
+
+// close stops the timers and destroys the heap.
+func (rt *runtime) close() {
+	rt.loop.Close()
+}
+
+// printError prints err with its script stack when available.
+func printError(err error) {
+	var e *duktape.Error
+	if errors.As(err, &e) && e.Stack != "" {
+		fmt.Fprintln(os.Stderr, e.Stack)
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
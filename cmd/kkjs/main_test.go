@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hailongz/kk-lib/duktape"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// captureConsole collects the console output of the scripts until the test
+// ends.
+func captureConsole(t *testing.T) func() string {
+
+	var lines []string
+	var lock sync.Mutex
+
+	saved := consoleLogger
+
+	consoleLogger = duktape.LoggerFunc(func(level int, message string, fileName string, lineNumber int) {
+		lock.Lock()
+		lines = append(lines, message)
+		lock.Unlock()
+	})
+
+	t.Cleanup(func() {
+		consoleLogger = saved
+	})
+
+	return func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		return strings.Join(lines, ",")
+	}
+}
+
+func TestRun(t *testing.T) {
+
+	output := captureConsole(t)
+
+	dir := writeFiles(t, map[string]string{
+		"main.js":     `var lib = require("./lib/util"); setTimeout(function () { console.log(lib.name); }, 5); console.log("start");`,
+		"lib/util.js": `exports.name = "util";`,
+	})
+
+	if code := runCommand([]string{"-root", dir, filepath.Join(dir, "main.js")}); code != 0 {
+		t.Errorf("got status %d", code)
+	}
+
+	if got := output(); got != "start,util" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRunTimerError(t *testing.T) {
+
+	output := captureConsole(t)
+
+	// The loop keeps running the timers after one throws, the error sets
+	// the exit status.
+
+	dir := writeFiles(t, map[string]string{
+		"main.js": `setTimeout(function () { throw new Error("boom"); }, 1);
+			setTimeout(function () { console.log("later"); }, 20);`,
+	})
+
+	if code := runCommand([]string{"-root", dir, filepath.Join(dir, "main.js")}); code != 1 {
+		t.Errorf("got status %d", code)
+	}
+
+	if got := output(); got != "later" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+
+	captureConsole(t)
+
+	dir := writeFiles(t, map[string]string{
+		"bad.js": `null.x;`,
+	})
+
+	for _, args := range [][]string{
+		{"-root", dir, filepath.Join(dir, "bad.js")},
+		{"-root", dir, filepath.Join(dir, "missing.js")},
+		{"-root", filepath.Join(dir, "sub"), filepath.Join(dir, "bad.js")},
+	} {
+		if code := runCommand(args); code != 1 {
+			t.Errorf("%v: got status %d", args, code)
+		}
+	}
+
+	if code := runCommand(nil); code != 2 {
+		t.Errorf("got status %d", code)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hailongz/kk-lib/duktape"
+)
+
+// moduleList collects the modules of repeated -r flags.
+type moduleList []string
+
+func (l *moduleList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *moduleList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// replCommand runs an interactive session on a single context, after
+// loading the modules given with -r (see Context.REPL). Go applications
+// preload their own bindings by calling Context.REPL themselves.
+func replCommand(args []string) int {
+
+	var o options
+	var modules moduleList
+
+	flags := newFlagSet("kkjs repl")
+	o.register(flags)
+	flags.Var(&modules, "r", "module to load before the session, may be repeated")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	rt, err := newRuntime(o, consoleLogger)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kkjs:", err)
+		return 1
+	}
+
+	defer rt.close()
+
+	for _, file := range modules {
+
+		rt.loop.Run(func(ctx *duktape.Context) {
+			if err := rt.require(file); err != nil {
+				rt.loop.OnError(err)
+			}
+		})
+
+		if err := rt.firstErr(); err != nil {
+			printError(err)
+			return 1
+		}
+	}
+
+	// Errors of the timers are printed as they happen from now on. Timers
+	// of the modules may be running, OnError is replaced on the loop.
+
+	rt.loop.Dispatch().Sync(func() {
+		rt.loop.OnError = printError
+	})
+
+	if err := rt.ctx.REPL(os.Stdin, os.Stdout, duktape.REPLOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, "kkjs:", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplCommand(t *testing.T) {
+
+	captureConsole(t)
+
+	dir := writeFiles(t, map[string]string{
+		"ticker.js": `exports.start = function () { setInterval(function () {}, 1); };`,
+		"input":     "require('./ticker').start()\n.exit\n",
+	})
+
+	stdin, err := os.Open(filepath.Join(dir, "input"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stdin.Close()
+
+	saved := os.Stdin
+	os.Stdin = stdin
+
+	defer func() {
+		os.Stdin = saved
+	}()
+
+	// The interval still runs when .exit closes the runtime.
+
+	if code := replCommand([]string{"-root", dir, "-r", filepath.Join(dir, "ticker.js")}); code != 0 {
+		t.Errorf("got status %d", code)
+	}
+}
@@ -0,0 +1,869 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hailongz/kk-lib/duktape"
+)
+
+const harnessKey = "kkjs.run"
+const abortKey = "kkjs.abort"
+
+const (
+	statusPass  = "pass"
+	statusFail  = "fail"
+	statusSkip  = "skip"
+	statusError = "error"
+)
+
+type testResult struct {
+	Suite    string
+	Name     string
+	Status   string
+	Message  string
+	Stack    string
+	Duration time.Duration
+}
+
+type fileResult struct {
+	File     string
+	Tests    []testResult
+	Duration time.Duration
+}
+
+// testCommand runs the *.test.js files found in the paths (the current
+// directory by default, node_modules and hidden directories excluded), each
+// in its own context, and prints the results as TAP or JUnit XML on stdout.
+// The console output goes to stderr. Test files declare their tests with
+// describe(), it() (or test()), beforeEach() and afterEach(), and check
+// values with expect(). A test passes unless it throws, calls its done
+// callback with an error or returns a Promise that rejects. A test still
+// running after the timeout fails, a script that never returns is
+// interrupted.
+func testCommand(args []string) int {
+
+	var o options
+	var format string
+	var timeout time.Duration
+
+	flags := newFlagSet("kkjs test")
+	o.register(flags)
+	flags.StringVar(&format, "format", "tap", "output format, tap or junit")
+	flags.DurationVar(&timeout, "timeout", 5*time.Second, "timeout of each test")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if format != "tap" && format != "junit" {
+		flags.Usage()
+		return 2
+	}
+
+	paths := flags.Args()
+
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := findTestFiles(paths)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kkjs:", err)
+		return 1
+	}
+
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "kkjs: no test files found")
+		return 1
+	}
+
+	results := make([]*fileResult, 0, len(files))
+
+	for _, file := range files {
+		results = append(results, runTestFile(o, file, timeout))
+	}
+
+	if format == "junit" {
+		err = writeJUnit(os.Stdout, results)
+	} else {
+		err = writeTAP(os.Stdout, results)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kkjs:", err)
+		return 1
+	}
+
+	for _, r := range results {
+		for _, t := range r.Tests {
+			if t.Status == statusFail || t.Status == statusError {
+				return 1
+			}
+		}
+	}
+
+	return 0
+}
+
+func findTestFiles(paths []string) ([]string, error) {
+
+	var files []string
+	seen := map[string]bool{}
+
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+
+	for _, p := range paths {
+
+		st, err := os.Stat(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !st.IsDir() {
+			add(filepath.Clean(p))
+			continue
+		}
+
+		var found []string
+
+		err = filepath.WalkDir(p, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			name := entry.Name()
+			if entry.IsDir() {
+				if file != p && (name == "node_modules" || strings.HasPrefix(name, ".")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(name, ".test.js") {
+				found = append(found, file)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Strings(found)
+
+		for _, file := range found {
+			add(file)
+		}
+	}
+
+	return files, nil
+}
+
+// stderrLogger keeps stdout for the results.
+var stderrLogger = duktape.LoggerFunc(func(level int, message string, fileName string, lineNumber int) {
+	fmt.Fprintln(os.Stderr, message)
+})
+
+func runTestFile(o options, file string, timeout time.Duration) *fileResult {
+
+	r := &fileResult{File: filepath.ToSlash(file)}
+	start := time.Now()
+
+	defer func() {
+		r.Duration = time.Since(start)
+	}()
+
+	rt, err := newRuntime(o, stderrLogger)
+
+	if err != nil {
+		r.Tests = append(r.Tests, testResult{Name: "load", Status: statusError, Message: err.Error()})
+		return r
+	}
+
+	finished := make(chan struct{})
+
+	// Results are added on the loop, read once the heap is destroyed.
+
+	// A test interrupted by its deadline fails, then the next one runs.
+
+	rt.loop.OnError = func(err error) {
+		if errors.Is(err, duktape.ErrTimeout) {
+			rt.loop.Post(abortTest)
+			return
+		}
+		r.Tests = append(r.Tests, errorResult("uncaught error", statusFail, err))
+	}
+
+	rt.loop.Post(func(ctx *duktape.Context) {
+
+		if err := installHarness(ctx, r, finished, timeout); err != nil {
+			r.Tests = append(r.Tests, errorResult("load", statusError, err))
+			close(finished)
+			return
+		}
+
+		ctx.SetDeadline(time.Now().Add(timeout))
+		err := rt.require(file)
+		ctx.SetDeadline(time.Time{})
+
+		if err != nil {
+			r.Tests = append(r.Tests, errorResult("load", statusError, err))
+			close(finished)
+			return
+		}
+
+		ctx.PushGlobalStash()
+		ctx.GetPropString(-1, harnessKey)
+		ctx.Pcall(0)
+		ctx.Pop2()
+	})
+
+	<-finished
+
+	// Timers left running after the tests get the timeout to complete, then
+	// they are stopped with the heap. A script still running after another
+	// timeout is interrupted.
+
+	idle := make(chan struct{})
+
+	go func() {
+		rt.loop.Wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+		rt.close()
+		return r
+	case <-time.After(timeout):
+		fmt.Fprintf(os.Stderr, "kkjs: %s: timers still running after the tests\n", file)
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		rt.close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(timeout):
+		rt.ctx.Interrupt()
+		<-closed
+	}
+
+	return r
+}
+
+// abortTest fails the test running, interrupted by its deadline, and runs the
+// next one. Called on the loop.
+func abortTest(ctx *duktape.Context) {
+	ctx.PushGlobalStash()
+	ctx.GetPropString(-1, abortKey)
+	ctx.Pcall(0)
+	ctx.Pop2()
+}
+
+func errorResult(name string, status string, err error) testResult {
+	t := testResult{Name: name, Status: status, Message: err.Error()}
+	if e, ok := err.(*duktape.Error); ok {
+		t.Stack = trimStack(e.Stack)
+	}
+	return t
+}
+
+// trimStack removes the frames of the harness and of the evaluation loading
+// the test file, which have no file name.
+func trimStack(stack string) string {
+	lines := strings.Split(stack, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.Contains(line, "(eval:") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// installHarness defines the test globals and keeps the functions running
+// and aborting the tests in the stash. Called on the loop.
+func installHarness(ctx *duktape.Context, r *fileResult, finished chan struct{}, timeout time.Duration) error {
+
+	ctx.PushGlobalStash()
+
+	if err := ctx.PevalString(harnessSource); err != nil {
+		ctx.Pop2()
+		return err
+	}
+
+	ctx.PushGoFunc(func(suite string, name string, status string, message string, stack string, ms float64) {
+		r.Tests = append(r.Tests, testResult{
+			Suite:    suite,
+			Name:     name,
+			Status:   status,
+			Message:  message,
+			Stack:    trimStack(stack),
+			Duration: time.Duration(ms * float64(time.Millisecond)),
+		})
+	})
+
+	ctx.PushGoFunc(func() {
+		close(finished)
+	})
+
+	// Each test runs with a deadline, so that a script that never returns
+	// is interrupted.
+
+	ctx.PushGoFunc(func(set bool) {
+		if set {
+			ctx.SetDeadline(time.Now().Add(timeout))
+		} else {
+			ctx.SetDeadline(time.Time{})
+		}
+	})
+
+	ctx.PushNumber(float64(timeout / time.Millisecond))
+
+	if ctx.Pcall(4) != duktape.ExecSuccess {
+		err := fmt.Errorf("%s", ctx.SafeToString(-1))
+		ctx.Pop2()
+		return err
+	}
+
+	ctx.GetPropString(-1, "run")
+	ctx.PutPropString(-3, harnessKey)
+	ctx.GetPropString(-1, "abort")
+	ctx.PutPropString(-3, abortKey)
+	ctx.Pop2()
+
+	return nil
+}
+
+func (t *testResult) fullName(file string) string {
+	if t.Suite == "" {
+		return file + " > " + t.Name
+	}
+	return file + " > " + t.Suite + " > " + t.Name
+}
+
+// writeTAP writes the results in the Test Anything Protocol, version 13.
+func writeTAP(w io.Writer, results []*fileResult) error {
+
+	n := 0
+	counts := map[string]int{}
+
+	fmt.Fprintln(w, "TAP version 13")
+
+	for _, r := range results {
+
+		for _, t := range r.Tests {
+
+			n = n + 1
+			counts[t.Status] = counts[t.Status] + 1
+
+			switch t.Status {
+			case statusPass:
+				fmt.Fprintf(w, "ok %d - %s\n", n, t.fullName(r.File))
+			case statusSkip:
+				fmt.Fprintf(w, "ok %d - %s # SKIP\n", n, t.fullName(r.File))
+			default:
+				message, _ := json.Marshal(t.Message)
+				fmt.Fprintf(w, "not ok %d - %s\n", n, t.fullName(r.File))
+				fmt.Fprintln(w, "  ---")
+				fmt.Fprintf(w, "  message: %s\n", message)
+				if t.Stack != "" {
+					fmt.Fprintln(w, "  stack: |-")
+					for _, line := range strings.Split(t.Stack, "\n") {
+						fmt.Fprintf(w, "    %s\n", line)
+					}
+				}
+				fmt.Fprintf(w, "  duration_ms: %d\n", t.Duration/time.Millisecond)
+				fmt.Fprintln(w, "  ...")
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "1..%d\n", n)
+
+	_, err := fmt.Fprintf(w, "# tests %d, pass %d, fail %d, skip %d\n",
+		n, counts[statusPass], counts[statusFail]+counts[statusError], counts[statusSkip])
+
+	return err
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnit writes the results as JUnit XML, one testsuite per file.
+func writeJUnit(w io.Writer, results []*fileResult) error {
+
+	var all junitTestSuites
+	var total time.Duration
+
+	for _, r := range results {
+
+		s := junitTestSuite{Name: r.File, Time: seconds(r.Duration)}
+
+		for _, t := range r.Tests {
+
+			c := junitTestCase{Name: t.Name, Classname: r.File, Time: seconds(t.Duration)}
+
+			if t.Suite != "" {
+				c.Classname = r.File + " > " + t.Suite
+			}
+
+			text := t.Stack
+
+			if text == "" {
+				text = t.Message
+			}
+
+			switch t.Status {
+			case statusFail:
+				c.Failure = &junitFailure{Message: t.Message, Text: text}
+				s.Failures = s.Failures + 1
+			case statusError:
+				c.Error = &junitFailure{Message: t.Message, Text: text}
+				s.Errors = s.Errors + 1
+			case statusSkip:
+				c.Skipped = &struct{}{}
+				s.Skipped = s.Skipped + 1
+			}
+
+			s.Cases = append(s.Cases, c)
+		}
+
+		s.Tests = len(s.Cases)
+
+		all.Tests = all.Tests + s.Tests
+		all.Failures = all.Failures + s.Failures
+		all.Errors = all.Errors + s.Errors
+		all.Skipped = all.Skipped + s.Skipped
+		all.Suites = append(all.Suites, s)
+
+		total = total + r.Duration
+	}
+
+	all.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+
+	if err := e.Encode(&all); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+
+	return err
+}
+
+const harnessSource = `(function (global) {
+
+	return function (report, finish, deadline, timeout) {
+
+		var root = { names: [], skip: false, parent: null, beforeEach: [], afterEach: [] };
+		var current = root;
+		var tests = [];
+
+		var show = function (v) {
+			if (typeof v === 'string') {
+				return JSON.stringify(v);
+			}
+			if (typeof v === 'number' || v === undefined) {
+				return String(v);
+			}
+			if (typeof v === 'function') {
+				return '[Function' + (v.name ? ': ' + v.name : '') + ']';
+			}
+			if (v instanceof Error) {
+				return v.name + ': ' + v.message;
+			}
+			try {
+				var s = JSON.stringify(v);
+				return s === undefined ? String(v) : s;
+			} catch (e) {
+				return String(v);
+			}
+		};
+
+		var equals = function (a, b, seen) {
+			if (a === b || (a !== a && b !== b)) {
+				return true;
+			}
+			if (a === null || b === null || typeof a !== 'object' || typeof b !== 'object') {
+				return false;
+			}
+			if (Object.getPrototypeOf(a) !== Object.getPrototypeOf(b)) {
+				return false;
+			}
+			if (a instanceof Date) {
+				return a.getTime() === b.getTime();
+			}
+			if (a instanceof RegExp) {
+				return String(a) === String(b);
+			}
+			for (var i = 0; i < seen.length; i++) {
+				if (seen[i][0] === a && seen[i][1] === b) {
+					return true;
+				}
+			}
+			seen.push([a, b]);
+			if (ArrayBuffer.isView(a)) {
+				if (a.length !== b.length) {
+					return false;
+				}
+				for (i = 0; i < a.length; i++) {
+					if (a[i] !== b[i]) {
+						return false;
+					}
+				}
+				return true;
+			}
+			var ka = Object.keys(a), kb = Object.keys(b);
+			if (ka.length !== kb.length) {
+				return false;
+			}
+			for (i = 0; i < ka.length; i++) {
+				if (!Object.prototype.hasOwnProperty.call(b, ka[i]) || !equals(a[ka[i]], b[ka[i]], seen)) {
+					return false;
+				}
+			}
+			return true;
+		};
+
+		var Expectation = function (actual, negate) {
+			this.actual = actual;
+			this.negate = negate;
+			if (!negate) {
+				this.not = new Expectation(actual, true);
+			}
+		};
+
+		Expectation.prototype.check = function (pass, verb, expected) {
+			if (pass === this.negate) {
+				var message = 'expected ' + show(this.actual) + (this.negate ? ' not ' : ' ') + verb;
+				if (arguments.length > 2) {
+					message = message + ' ' + show(expected);
+				}
+				var e = new Error(message);
+				e.name = 'AssertionError';
+				throw e;
+			}
+		};
+
+		var matchers = {
+			toBe: function (v) {
+				this.check(this.actual === v || (this.actual !== this.actual && v !== v), 'to be', v);
+			},
+			toEqual: function (v) {
+				this.check(equals(this.actual, v, []), 'to equal', v);
+			},
+			toBeTruthy: function () {
+				this.check(!!this.actual, 'to be truthy');
+			},
+			toBeFalsy: function () {
+				this.check(!this.actual, 'to be falsy');
+			},
+			toBeNull: function () {
+				this.check(this.actual === null, 'to be null');
+			},
+			toBeUndefined: function () {
+				this.check(this.actual === undefined, 'to be undefined');
+			},
+			toBeDefined: function () {
+				this.check(this.actual !== undefined, 'to be defined');
+			},
+			toBeNaN: function () {
+				this.check(this.actual !== this.actual, 'to be NaN');
+			},
+			toBeGreaterThan: function (v) {
+				this.check(this.actual > v, 'to be greater than', v);
+			},
+			toBeGreaterThanOrEqual: function (v) {
+				this.check(this.actual >= v, 'to be greater than or equal to', v);
+			},
+			toBeLessThan: function (v) {
+				this.check(this.actual < v, 'to be less than', v);
+			},
+			toBeLessThanOrEqual: function (v) {
+				this.check(this.actual <= v, 'to be less than or equal to', v);
+			},
+			toBeCloseTo: function (v, digits) {
+				digits = digits === undefined ? 2 : digits;
+				this.check(Math.abs(this.actual - v) < Math.pow(10, -digits) / 2, 'to be close to', v);
+			},
+			toBeInstanceOf: function (C) {
+				this.check(this.actual instanceof C, 'to be an instance of', C);
+			},
+			toContain: function (v) {
+				var a = this.actual;
+				this.check(a !== null && a !== undefined && typeof a.indexOf === 'function' && a.indexOf(v) >= 0, 'to contain', v);
+			},
+			toHaveLength: function (n) {
+				var a = this.actual;
+				this.check(a !== null && a !== undefined && a.length === n, 'to have length', n);
+			},
+			toHaveProperty: function (key, v) {
+				var a = this.actual;
+				var has = a !== null && a !== undefined && Object(a)[key] !== undefined;
+				if (arguments.length > 1) {
+					this.check(has && equals(a[key], v, []), 'to have property ' + show(key) + ' equal to', v);
+				} else {
+					this.check(has, 'to have property', key);
+				}
+			},
+			toMatch: function (v) {
+				var a = String(this.actual);
+				this.check(v instanceof RegExp ? v.test(a) : a.indexOf(v) >= 0, 'to match', v);
+			},
+			toThrow: function (expected) {
+				if (typeof this.actual !== 'function') {
+					throw new TypeError('expect(fn).toThrow() expects a function');
+				}
+				var thrown = false, error;
+				try {
+					this.actual();
+				} catch (e) {
+					thrown = true;
+					error = e;
+				}
+				if (expected === undefined || !thrown) {
+					this.check(thrown, 'to throw');
+					return;
+				}
+				var message = error instanceof Error ? error.message : String(error);
+				var pass;
+				if (expected instanceof RegExp) {
+					pass = expected.test(message);
+				} else if (typeof expected === 'function') {
+					pass = error instanceof expected;
+				} else {
+					pass = message.indexOf(String(expected)) >= 0;
+				}
+				this.check(pass, 'to throw', expected);
+			}
+		};
+
+		for (var name in matchers) {
+			Expectation.prototype[name] = matchers[name];
+		}
+
+		var describe = function (name, fn, skip) {
+			var parent = current;
+			current = {
+				names: parent.names.concat([String(name)]),
+				skip: parent.skip || !!skip,
+				parent: parent,
+				beforeEach: [],
+				afterEach: []
+			};
+			try {
+				fn();
+			} finally {
+				current = parent;
+			}
+		};
+
+		var it = function (name, fn, skip) {
+			if (typeof fn !== 'function') {
+				throw new TypeError('it() expects a function');
+			}
+			tests.push({ suite: current, name: String(name), fn: fn, skip: current.skip || !!skip });
+		};
+
+		describe.skip = function (name, fn) {
+			describe(name, fn, true);
+		};
+
+		it.skip = function (name, fn) {
+			it(name, fn || function () {}, true);
+		};
+
+		global.describe = describe;
+		global.it = it;
+		global.test = it;
+		global.beforeEach = function (fn) {
+			current.beforeEach.push(fn);
+		};
+		global.afterEach = function (fn) {
+			current.afterEach.push(fn);
+		};
+		global.expect = function (actual) {
+			return new Expectation(actual, false);
+		};
+
+		// invoke calls fn, which may take a done callback or return a Promise,
+		// then callback(failed, error) once.
+		var invoke = function (fn, callback) {
+			var settled = false, timer;
+			var end = function (failed, e) {
+				if (settled) {
+					return;
+				}
+				settled = true;
+				if (timer !== undefined) {
+					clearTimeout(timer);
+				}
+				callback(failed, e);
+			};
+			try {
+				if (fn.length > 0) {
+					fn(function (e) {
+						end(e !== undefined && e !== null, e);
+					});
+				} else {
+					var r = fn();
+					if (r !== null && (typeof r === 'object' || typeof r === 'function') && typeof r.then === 'function') {
+						r.then(function () { end(false); }, function (e) { end(true, e); });
+					} else {
+						end(false);
+					}
+				}
+			} catch (e) {
+				end(true, e);
+			}
+			if (!settled) {
+				timer = setTimeout(function () {
+					end(true, new Error('Timeout of ' + timeout + 'ms exceeded'));
+				}, timeout);
+			}
+		};
+
+		var series = function (fns, callback) {
+			var i = 0;
+			var step = function (failed, e) {
+				if (failed || i >= fns.length) {
+					callback(failed, e);
+					return;
+				}
+				invoke(fns[i++], step);
+			};
+			step(false);
+		};
+
+		var messageOf = function (e) {
+			return e instanceof Error ? e.name + ': ' + e.message : 'thrown: ' + show(e);
+		};
+
+		// running is the test in progress, its end is called once.
+		var running = null;
+
+		var run = function () {
+			var i = 0;
+			var next = function () {
+				if (i >= tests.length) {
+					finish();
+					return;
+				}
+				var t = tests[i++];
+				var suite = t.suite.names.join(' > ');
+				if (t.skip) {
+					report(suite, t.name, 'skip', '', '', 0);
+					setImmediate(next);
+					return;
+				}
+				var before = [], after = [];
+				for (var s = t.suite; s !== null; s = s.parent) {
+					before = s.beforeEach.concat(before);
+					after = after.concat(s.afterEach);
+				}
+				var start = Date.now();
+				var test = {};
+				test.end = function (failed, e) {
+					if (running !== test) {
+						return;
+					}
+					running = null;
+					deadline(false);
+					report(suite, t.name, failed ? 'fail' : 'pass', failed ? messageOf(e) : '',
+						failed && e instanceof Error && e.stack ? String(e.stack) : '', Date.now() - start);
+					setImmediate(next);
+				};
+				var done = function (failed, e) {
+					series(after, function (afterFailed, ae) {
+						if (!failed && afterFailed) {
+							failed = true;
+							e = ae;
+						}
+						test.end(failed, e);
+					});
+				};
+				running = test;
+				deadline(true);
+				series(before, function (failed, e) {
+					if (failed) {
+						done(true, e);
+					} else {
+						invoke(t.fn, done);
+					}
+				});
+			};
+			// The tests run on the loop, which reports their interruption.
+			setImmediate(next);
+		};
+
+		var abort = function () {
+			if (running !== null) {
+				running.end(true, new Error('Timeout of ' + timeout + 'ms exceeded'));
+			}
+		};
+
+		return { run: run, abort: abort };
+	};
+})(this)`
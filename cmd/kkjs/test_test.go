@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunTestFile(t *testing.T) {
+
+	dir := writeFiles(t, map[string]string{
+		"math.test.js": `describe("math", function () {
+			var n;
+			beforeEach(function () { n = 2; });
+			it("adds", function () { expect(n + 1).toBe(3); });
+			it("fails", function () { expect({a: [n]}).toEqual({a: [3]}); });
+			it("waits", function (done) { setTimeout(done, 1); });
+			it("rejects", function () { return Promise.reject(new Error("no")); });
+			it.skip("later", function () {});
+		});
+		test("times out", function (done) {});`,
+	})
+
+	r := runTestFile(options{root: dir}, filepath.Join(dir, "math.test.js"), 50*time.Millisecond)
+
+	var got []string
+
+	for _, test := range r.Tests {
+		got = append(got, test.Name+":"+test.Status)
+	}
+
+	if strings.Join(got, ",") != "adds:pass,fails:fail,waits:pass,rejects:fail,later:skip,times out:fail" {
+		t.Fatalf("got %v", got)
+	}
+
+	if m := r.Tests[1].Message; m != `AssertionError: expected {"a":[2]} to equal {"a":[3]}` {
+		t.Errorf("got %q", m)
+	}
+
+	if m := r.Tests[5].Message; m != "Error: Timeout of 50ms exceeded" {
+		t.Errorf("got %q", m)
+	}
+}
+
+func TestRunTestFileTimers(t *testing.T) {
+
+	// An interval left running and an error thrown after the tests: the
+	// heap is destroyed once the timeout expires and the error is kept.
+
+	dir := writeFiles(t, map[string]string{
+		"timers.test.js": `it("starts", function () {
+			setInterval(function () {}, 1);
+			setTimeout(function () { throw new Error("late"); }, 5);
+		});`,
+		"bad.test.js": `null.x;`,
+	})
+
+	r := runTestFile(options{root: dir}, filepath.Join(dir, "timers.test.js"), 50*time.Millisecond)
+
+	if len(r.Tests) != 2 || r.Tests[0].Status != statusPass || r.Tests[1].Status != statusFail || r.Tests[1].Message != "Error: late" {
+		t.Errorf("got %+v", r.Tests)
+	}
+
+	r = runTestFile(options{root: dir}, filepath.Join(dir, "bad.test.js"), 50*time.Millisecond)
+
+	if len(r.Tests) != 1 || r.Tests[0].Status != statusError || !strings.Contains(r.Tests[0].Message, "TypeError") {
+		t.Errorf("got %+v", r.Tests)
+	}
+}
+
+func TestRunTestFileSpin(t *testing.T) {
+
+	// Scripts that never return are interrupted, the next tests still run.
+
+	dir := writeFiles(t, map[string]string{
+		"spin.test.js": `it("spins", function () { while (true) {} });
+			it("spins later", function (done) { setTimeout(function () { for (;;) {} }, 1); });
+			it("spins in a hook", function () {});
+			describe("hooks", function () {
+				afterEach(function () { while (true) {} });
+				it("passes first", function () {});
+			});
+			it("passes", function () { expect(1).toBe(1); });`,
+		"load.test.js": `while (true) {}`,
+	})
+
+	r := runTestFile(options{root: dir}, filepath.Join(dir, "spin.test.js"), 50*time.Millisecond)
+
+	var got []string
+
+	for _, test := range r.Tests {
+		got = append(got, test.Name+":"+test.Status)
+	}
+
+	if strings.Join(got, ",") != "spins:fail,spins later:fail,spins in a hook:pass,passes first:fail,passes:pass" {
+		t.Fatalf("got %v", got)
+	}
+
+	if m := r.Tests[0].Message; m != "Error: Timeout of 50ms exceeded" {
+		t.Errorf("got %q", m)
+	}
+
+	r = runTestFile(options{root: dir}, filepath.Join(dir, "load.test.js"), 50*time.Millisecond)
+
+	if len(r.Tests) != 1 || r.Tests[0].Status != statusError || !strings.Contains(r.Tests[0].Message, "timeout") {
+		t.Errorf("got %+v", r.Tests)
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+
+	results := []*fileResult{{
+		File: "a.test.js",
+		Tests: []testResult{
+			{Suite: "s", Name: "ok", Status: statusPass},
+			{Name: "bad", Status: statusFail, Message: "Error: x", Stack: "Error: x\n    at a.test.js:2"},
+			{Name: "later", Status: statusSkip},
+		},
+	}}
+
+	var b bytes.Buffer
+
+	if err := writeTAP(&b, results); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `TAP version 13
+ok 1 - a.test.js > s > ok
+not ok 2 - a.test.js > bad
+  ---
+  message: "Error: x"
+  stack: |-
+    Error: x
+        at a.test.js:2
+  duration_ms: 0
+  ...
+ok 3 - a.test.js > later # SKIP
+1..3
+# tests 3, pass 1, fail 1, skip 1
+`
+
+	if b.String() != want {
+		t.Errorf("got %s", b.String())
+	}
+
+	b.Reset()
+
+	if err := writeJUnit(&b, results); err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitTestSuites
+
+	if err := xml.Unmarshal(b.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+
+	if suites.Tests != 3 || suites.Failures != 1 || suites.Skipped != 1 || suites.Suites[0].Cases[0].Classname != "a.test.js > s" {
+		t.Errorf("got %+v", suites)
+	}
+}
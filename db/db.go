@@ -57,6 +57,10 @@ func Transaction(db *sql.DB, fn func(conn Database) error) error {
 
 	tx, err := db.Begin()
 
+	if err != nil {
+		return err
+	}
+
 	err = fn(tx)
 
 	if err == nil {
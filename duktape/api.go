@@ -6,6 +6,7 @@ package duktape
 
 #include "duk_config.h"
 #include "duktape.h"
+#include "kk.h"
 
 static void _duk_eval_string(duk_context *ctx, const char *str) {
   duk_eval_string(ctx, str);
@@ -131,7 +132,8 @@ static void _duk_error(duk_context *ctx, duk_errcode_t err_code, const char *str
 	duk_error(ctx, err_code, "%s", str);
 }
 static void _duk_push_error_object(duk_context *ctx, duk_errcode_t err_code, const char *str) {
-	duk_push_error_object(ctx, err_code, "%s", str);
+	// No C file and line so that the error blames the calling script.
+	duk_push_error_object_raw(ctx, err_code, NULL, 0, "%s", str);
 }
 static void _duk_error_raw(duk_context *ctx, duk_errcode_t err_code, const char *filename, duk_int_t line, const char *text) {
 	duk_error_raw(ctx, err_code, filename, line, text);
@@ -281,6 +283,7 @@ func (d *Context) DestroyHeap() {
 	d.Gc(0)
 	C.duk_destroy_heap(d.duk_context)
 	d.duk_context = nil
+	d.freeHeap()
 }
 
 // See: http://duktape.org/api.html#duk_dup
@@ -753,8 +756,7 @@ func (d *Context) PcompileString(flags uint, src string) error {
 	__src__ := C.CString(src)
 	result := int(C._duk_pcompile_string(d.duk_context, C.duk_uint_t(flags), __src__))
 	C.free(unsafe.Pointer(__src__))
-	fmt.Println("result herhehreh", result)
-	return nil //d.castStringToError(result)
+	return d.castStringToError(result)
 }
 
 // See: http://duktape.org/api.html#duk_pcompile_string_filename
@@ -815,27 +817,53 @@ func (d *Context) castStringToError(result int) error {
 	}
 
 	err := &Error{}
-	for _, key := range []string{"name", "message", "fileName", "lineNumber", "stack"} {
-		d.GetPropString(-1, key)
-
-		switch key {
-		case "name":
-			err.Type = d.SafeToString(-1)
-		case "message":
-			err.Message = d.SafeToString(-1)
-		case "fileName":
-			err.FileName = d.SafeToString(-1)
-		case "lineNumber":
-			if d.IsNumber(-1) {
-				err.LineNumber = d.GetInt(-1)
+
+	err.GoFileName, err.GoLineNumber = callerLocation()
+
+	if d.IsError(-1) {
+		for _, key := range []string{"name", "message", "fileName", "lineNumber", "stack"} {
+			d.GetPropString(-1, key)
+
+			switch key {
+			case "name":
+				err.Type = d.SafeToString(-1)
+			case "message":
+				err.Message = d.SafeToString(-1)
+			case "fileName":
+				if d.IsString(-1) {
+					err.FileName = d.SafeToString(-1)
+				}
+			case "lineNumber":
+				if d.IsNumber(-1) {
+					err.LineNumber = d.GetInt(-1)
+				}
+			case "stack":
+				if d.IsString(-1) {
+					err.Stack = d.SafeToString(-1)
+				}
 			}
-		case "stack":
-			err.Stack = d.SafeToString(-1)
-		}
 
+			d.Pop()
+		}
+		err.Err = d.getGoError(-1)
+	} else {
+		err.Value = d.ToValue(-1)
+		d.Dup(-1)
+		err.Message = d.SafeToString(-1)
 		d.Pop()
 	}
 
+	switch d.takeInterrupt() {
+	case C.KK_INTERRUPT_REQUESTED:
+		err.Type = ErrorTypeInterrupted
+		err.Message = ErrInterrupted.Error()
+		err.Err = ErrInterrupted
+	case C.KK_INTERRUPT_TIMEOUT:
+		err.Type = ErrorTypeTimeout
+		err.Message = ErrTimeout.Error()
+		err.Err = ErrTimeout
+	}
+
 	return err
 }
 
@@ -1471,6 +1499,27 @@ func (d *Context) PushExternalBuffer() {
 	C._duk_push_external_buffer(d.duk_context)
 }
 
+//---[ Duktape 2.x API ]--- //
+// See: http://duktape.org/api.html#duk_freeze
+func (d *Context) Freeze(objIndex int) {
+	C.duk_freeze(d.duk_context, C.duk_idx_t(objIndex))
+}
+
+// See: http://duktape.org/api.html#duk_inspect_callstack_entry
+func (d *Context) InspectCallstackEntry(level int) {
+	C.duk_inspect_callstack_entry(d.duk_context, C.duk_int_t(level))
+}
+
+// See: http://duktape.org/api.html#duk_push_proxy
+func (d *Context) PushProxy(proxyFlags uint) int {
+	return int(C.duk_push_proxy(d.duk_context, C.duk_uint_t(proxyFlags)))
+}
+
+// See: http://duktape.org/api.html#duk_seal
+func (d *Context) Seal(objIndex int) {
+	C.duk_seal(d.duk_context, C.duk_idx_t(objIndex))
+}
+
 /**
  * Unimplemented.
  *
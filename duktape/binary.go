@@ -0,0 +1,345 @@
+package duktape
+
+/*
+#include "duk_config.h"
+#include "duktape.h"
+#include "kk.h"
+*/
+import "C"
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"unsafe"
+)
+
+const binaryGlobalsKey = "kk.binaryGlobals"
+const binaryKey = "kk.binary"
+
+// binaryGlobals are the built-ins restored by EnableBinary.
+var binaryGlobals = []string{"Buffer", "TextEncoder", "TextDecoder"}
+
+// PushUint8Array pushes a new Uint8Array holding a copy of b.
+func (d *Context) PushUint8Array(b []byte) {
+	d.pushBufferObject(b, BufobjUint8array)
+}
+
+// PushArrayBuffer pushes a new ArrayBuffer holding a copy of b.
+func (d *Context) PushArrayBuffer(b []byte) {
+	d.pushBufferObject(b, BufobjArraybuffer)
+}
+
+// PushNodeBuffer pushes a new Node.js Buffer holding a copy of b.
+func (d *Context) PushNodeBuffer(b []byte) {
+	d.pushBufferObject(b, BufobjNodejsAuffer)
+}
+
+func (d *Context) pushBufferObject(b []byte, kind int) {
+	d.pushBytes(b)
+	d.PushBufferObject(-1, 0, len(b), uint(kind))
+	d.Remove(-2)
+}
+
+// PushNewUint8Array pushes a new Uint8Array of size bytes and returns its
+// memory, so that Go fills it in place rather than copying a slice. Go memory
+// cannot be lent to the heap, this is the zero-copy way to hand data over.
+// The slice must not be used once the array may have been garbage collected
+// or the heap destroyed.
+func (d *Context) PushNewUint8Array(size int) []byte {
+	p := C.duk_push_buffer_raw(d.duk_context, C.duk_size_t(size), 0)
+	d.PushBufferObject(-1, 0, size, BufobjUint8array)
+	d.Remove(-2)
+	if size == 0 {
+		return []byte{}
+	}
+	return unsafe.Slice((*byte)(p), size)
+}
+
+// GetBytes returns a copy of the bytes of a plain buffer, an ArrayBuffer, a
+// typed array, a DataView or a Node.js Buffer at idx, only the bytes seen by
+// the view for the latter. It returns nil for other values.
+func (d *Context) GetBytes(idx int) []byte {
+	if C.duk_is_buffer_data(d.duk_context, C.duk_idx_t(idx)) == 0 {
+		return nil
+	}
+	return d.getBytes(idx)
+}
+
+// GetBytesView is GetBytes without the copy: the slice is the memory of the
+// buffer. It is valid as long as the buffer is referenced by the heap and,
+// for a dynamic buffer, not resized. Modifications are seen by the scripts.
+func (d *Context) GetBytesView(idx int) []byte {
+	var n C.duk_size_t
+	p := C.duk_get_buffer_data(d.duk_context, C.duk_idx_t(idx), &n)
+	if p == nil {
+		return nil
+	}
+	if n == 0 {
+		return []byte{}
+	}
+	return unsafe.Slice((*byte)(p), int(n))
+}
+
+// stashBinaryGlobals keeps the built-ins of binaryGlobals so that
+// EnableBinary can grant them in sandboxes, which remove them. Called with
+// the global stash on the stack.
+func (d *Context) stashBinaryGlobals() {
+	d.PushObject()
+	for _, name := range binaryGlobals {
+		d.GetGlobalString(name)
+		d.PutPropString(-2, name)
+	}
+	d.PutPropString(-2, binaryGlobalsKey)
+}
+
+// EnableBinary makes sure the globals TextEncoder, TextDecoder (UTF-8) and
+// Buffer are defined, and completes the Node.js Buffer of Duktape with:
+//
+//	Buffer.from(string, encoding)     // "utf8" by default, "hex" or "base64"
+//	Buffer.from(array | buffer)       // a copy
+//	Buffer.from(arrayBuffer, offset, length) // shares the memory
+//	Buffer.alloc(size, fill)
+//	buf.toString(encoding, start, end)
+//
+// Base64 decoding accepts the URL alphabet and missing padding like Node.js.
+func (d *Context) EnableBinary() error {
+
+	d.PushGlobalStash()
+	d.GetPropString(-1, binaryGlobalsKey)
+	d.PushGlobalObject()
+
+	for _, name := range binaryGlobals {
+		if !d.HasPropString(-1, name) {
+			d.GetPropString(-2, name)
+			d.PutPropString(-2, name)
+		}
+	}
+
+	d.Pop2()
+
+	// Buffer is completed once per heap.
+
+	if d.GetPropString(-1, binaryKey) {
+		d.Pop2()
+		return nil
+	}
+
+	d.Pop()
+
+	if err := d.PevalString(binarySource); err != nil {
+		d.Pop2()
+		return err
+	}
+
+	d.GetPropString(-2, binaryGlobalsKey)
+
+	for _, name := range binaryGlobals {
+		d.GetPropString(-1, name)
+		d.Insert(-2)
+	}
+
+	d.Pop()
+
+	d.PushGoFunction(d.bufferCopy)
+	d.PushGoFunction(d.bufferEncode)
+	d.PushGoFunction(d.bufferDecode)
+	d.PushGoFunction(d.bufferShare)
+
+	if err := d.castStringToError(d.Pcall(7)); err != nil {
+		d.Pop2()
+		return err
+	}
+
+	d.PutPropString(-2, binaryKey)
+	d.Pop()
+
+	return nil
+}
+
+// BinaryCapability grants TextEncoder, TextDecoder and Buffer, see
+// EnableBinary.
+func BinaryCapability() Capability {
+	return func(ctx *Context) error {
+		return ctx.EnableBinary()
+	}
+}
+
+// bufferCopy(data) returns a new Buffer with a copy of the bytes of data.
+func (d *Context) bufferCopy() int {
+	d.PushNodeBuffer(d.GetBytesView(0))
+	return 1
+}
+
+// bufferShare(arrayBuffer) returns a new Buffer on the memory of
+// arrayBuffer.
+func (d *Context) bufferShare() int {
+	d.PushBufferObject(0, 0, len(d.GetBytesView(0)), BufobjNodejsAuffer)
+	return 1
+}
+
+// bufferEncode(buf, encoding, start, end) returns the bytes of buf from
+// start to end encoded as "hex" or "base64".
+func (d *Context) bufferEncode() int {
+
+	b := d.GetBytesView(0)
+	start := clampIndex(d.GetInt(2), len(b))
+	end := len(b)
+
+	if !d.IsUndefined(3) {
+		end = clampIndex(d.GetInt(3), len(b))
+	}
+
+	if end < start {
+		end = start
+	}
+
+	encoding := d.getGoString(1)
+
+	d.pushBytes(b[start:end])
+
+	if encoding == "hex" {
+		d.HexEncode(-1)
+	} else {
+		d.Base64Encode(-1)
+	}
+
+	return 1
+}
+
+func clampIndex(i int, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > n {
+		return n
+	}
+	return i
+}
+
+// bufferDecode(string, encoding) returns a new Buffer with the bytes of the
+// "hex" or "base64" string. Like Node.js, decoding stops at the first
+// invalid hex digit and ignores the characters outside of base64.
+func (d *Context) bufferDecode() int {
+
+	s := d.getGoString(0)
+
+	var b []byte
+
+	if d.getGoString(1) == "hex" {
+		n := 0
+		for n+1 < len(s) && isHexDigit(s[n]) && isHexDigit(s[n+1]) {
+			n = n + 2
+		}
+		b, _ = hex.DecodeString(s[:n])
+	} else {
+		s = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '+', r == '/':
+				return r
+			case r == '-':
+				return '+'
+			case r == '_':
+				return '/'
+			}
+			return -1
+		}, s)
+		// A single trailing character cannot hold a byte.
+		if len(s)%4 == 1 {
+			s = s[:len(s)-1]
+		}
+		b, _ = base64.RawStdEncoding.DecodeString(s)
+	}
+
+	d.PushNodeBuffer(b)
+
+	return 1
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+const binarySource = `(function (Buffer, TextEncoder, TextDecoder, copy, encode, decode, share) {
+
+	var encoder = new TextEncoder();
+	var decoder = new TextDecoder();
+
+	var encodingOf = function (encoding) {
+		var e = encoding === undefined ? 'utf8' : String(encoding).toLowerCase();
+		if (e === 'utf-8') {
+			return 'utf8';
+		}
+		if (e === 'utf8' || e === 'hex' || e === 'base64') {
+			return e;
+		}
+		throw new TypeError('Unknown encoding: ' + encoding);
+	};
+
+	var isEncoding = Buffer.isEncoding;
+
+	Buffer.isEncoding = function (encoding) {
+		try {
+			return encodingOf(encoding) !== undefined;
+		} catch (e) {
+			return isEncoding.call(Buffer, encoding);
+		}
+	};
+
+	Buffer.from = function (value, a, b) {
+		if (typeof value === 'string') {
+			var encoding = encodingOf(a);
+			if (encoding === 'utf8') {
+				return copy(encoder.encode(value));
+			}
+			return decode(value, encoding);
+		}
+		if (value instanceof ArrayBuffer) {
+			var offset = a === undefined ? 0 : a >>> 0;
+			var length = b === undefined ? value.byteLength - offset : b >>> 0;
+			if (offset > value.byteLength || offset + length > value.byteLength) {
+				throw new RangeError('offset or length out of range');
+			}
+			return Buffer.prototype.slice.call(share(value), offset, offset + length);
+		}
+		if (ArrayBuffer.isView(value)) {
+			return copy(value);
+		}
+		if (value !== null && typeof value === 'object' && typeof value.length === 'number') {
+			return copy(new Uint8Array(value));
+		}
+		throw new TypeError('Buffer.from expects a string, an array or a buffer');
+	};
+
+	Buffer.alloc = function (size, fill, encoding) {
+		var buf = copy(new Uint8Array(size));
+		if (fill !== undefined && fill !== 0) {
+			if (typeof fill === 'string') {
+				fill = Buffer.from(fill, encoding);
+			}
+			if (typeof fill === 'number') {
+				buf.fill(fill);
+			} else {
+				for (var i = 0; i < size && fill.length > 0; i++) {
+					buf[i] = fill[i % fill.length];
+				}
+			}
+		}
+		return buf;
+	};
+
+	Buffer.allocUnsafe = function (size) {
+		return Buffer.alloc(size);
+	};
+
+	Buffer.prototype.toString = function (encoding, start, end) {
+		var e = encodingOf(encoding);
+		start = start === undefined ? 0 : start;
+		if (e === 'utf8') {
+			return decoder.decode(Buffer.prototype.slice.call(this, start, end));
+		}
+		return encode(this, e, start, end);
+	};
+
+	return true;
+})`
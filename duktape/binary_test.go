@@ -0,0 +1,134 @@
+package duktape
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBinaryPush(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.PushGlobalObject()
+	ctx.PushUint8Array([]byte{1, 2, 3})
+	ctx.PutPropString(-2, "u8")
+	ctx.PushArrayBuffer([]byte{4, 5})
+	ctx.PutPropString(-2, "ab")
+	ctx.PushNodeBuffer([]byte("hi"))
+	ctx.PutPropString(-2, "nb")
+	copy(ctx.PushNewUint8Array(2), []byte{7, 8})
+	ctx.PutPropString(-2, "filled")
+	ctx.Pop()
+
+	src := `[u8 instanceof Uint8Array, u8.length, u8[2], ab instanceof ArrayBuffer, ab.byteLength,
+		Buffer.isBuffer(nb), nb.toString(), filled[0] + filled[1]].join()`
+
+	if got := evalString(t, ctx, src); got != "true,3,3,true,2,true,hi,15" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestBinaryGet(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	for src, want := range map[string][]byte{
+		`new Uint8Array([1, 2, 3])`:                         {1, 2, 3},
+		`new Uint8Array([1, 2, 3, 4]).subarray(1, 3)`:       {2, 3},
+		`new Uint16Array([0x0201]).buffer`:                  {1, 2},
+		`new DataView(new Uint8Array([9, 8, 7]).buffer, 1)`: {8, 7},
+		`new Uint8Array(0)`:                                 {},
+	} {
+
+		if err := ctx.PevalString(src); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := ctx.GetBytes(-1); !bytes.Equal(got, want) || got == nil {
+			t.Errorf("%s: got %v", src, got)
+		}
+
+		ctx.Pop()
+	}
+
+	ctx.PushString("text")
+
+	if got := ctx.GetBytes(-1); got != nil {
+		t.Errorf("got %v", got)
+	}
+
+	ctx.Pop()
+
+	// The view shares the memory of the buffer.
+
+	evalString(t, ctx, `var shared = new Uint8Array(2)`)
+	ctx.GetGlobalString("shared")
+	ctx.GetBytesView(-1)[1] = 42
+	ctx.Pop()
+
+	if got := evalString(t, ctx, `shared[1]`); got != "42" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestBinaryBuffer(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	if err := ctx.EnableBinary(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enabling twice is harmless.
+
+	if err := ctx.EnableBinary(); err != nil {
+		t.Fatal(err)
+	}
+
+	for src, want := range map[string]string{
+		`Buffer.from("héllo").length`:                                                      "6",
+		`Buffer.from("68656c6c6f", "hex").toString()`:                                      "hello",
+		`Buffer.from("aGk", "base64").toString()`:                                          "hi",
+		`Buffer.from("-_8", "base64")[1]`:                                                  "255",
+		`Buffer.from("hello").toString("base64")`:                                          "aGVsbG8=",
+		`Buffer.from("hello").toString("hex", 1, 3)`:                                       "656c",
+		`var z = Buffer.alloc(3, 7); z.length + "/" + z[0] + z[2]`:                         "3/77",
+		`var a = [1, 2]; var b = Buffer.from(a); a[0] = 9; b[0]`:                           "1",
+		`var ab = new ArrayBuffer(4); Buffer.from(ab, 1, 2)[0] = 5; new Uint8Array(ab)[1]`: "5",
+		`new TextDecoder().decode(new TextEncoder().encode("ü€"))`:                         "ü€",
+	} {
+		if got := evalString(t, ctx, src); got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.PushGlobalGoFunction("sum", func() int {
+		n := 0
+		for _, b := range ctx.ToValue(0).([]byte) {
+			n = n + int(b)
+		}
+		ctx.PushInt(n)
+		return 1
+	})
+
+	if got := evalString(t, ctx, `sum(new Uint8Array([1, 2, 3]))`); got != "6" {
+		t.Errorf("got %q", got)
+	}
+
+	ctx.PushValue([]byte{1, 2})
+
+	if got := ctx.GetBytes(-1); !bytes.Equal(got, []byte{1, 2}) {
+		t.Errorf("got %v", got)
+	}
+
+	ctx.Pop()
+}
@@ -0,0 +1,270 @@
+package duktape
+
+/*
+#include "duk_config.h"
+#include "duktape.h"
+#include "kk.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// bytecodeVersion identifies the builds able to load each other's bytecode,
+// which Duktape only guarantees for the exact same version and platform.
+var bytecodeVersion = fmt.Sprintf("%d %s %s", int(C.DUK_VERSION), C.DUK_GIT_DESCRIBE, runtime.GOARCH)
+
+// ScriptCache compiles scripts once and keeps their bytecode, keyed by a
+// hash of the file name and source, so that other contexts load it instead
+// of parsing the source again. It is safe for concurrent use.
+//
+// Bytecode is kept in memory and, when the cache has a directory, in files
+// that survive restarts. Files written by another Duktape version or that
+// fail their checksum are ignored and replaced.
+type ScriptCache struct {
+	dir     string
+	entries map[string][]byte
+	lock    sync.RWMutex
+}
+
+// NewScriptCache returns a cache storing bytecode in dir, or only in memory
+// when dir is empty.
+func NewScriptCache(dir string) *ScriptCache {
+	return &ScriptCache{dir: dir, entries: map[string][]byte{}}
+}
+
+// Compile pushes the function for the global code of source, as
+// PcompileLstringFilename with no flags would, transpiling it first when the
+// context has the transpiler enabled. On failure the error is returned and
+// left on the stack.
+func (c *ScriptCache) Compile(ctx *Context, filename string, source string) error {
+
+	key := scriptKey(filename, source)
+
+	if ctx.transpile {
+		key = scriptKey(filename+"\x00es5", source)
+	}
+
+	if b := c.get(key); b != nil {
+		if ctx.loadBytecode(b) == nil {
+			return nil
+		}
+		ctx.Pop()
+		c.remove(key)
+	}
+
+	if ctx.transpile {
+		code, err := ctx.transpileSource(filename, source)
+		if err != nil {
+			return err
+		}
+		source = code
+	}
+
+	ctx.PushString(filename)
+
+	if err := ctx.PcompileLstringFilename(0, source, len(source)); err != nil {
+		return err
+	}
+
+	ctx.Dup(-1)
+
+	b, err := ctx.dumpBytecode()
+
+	if err != nil {
+		// Not every function can be dumped, it is still usable.
+		return nil
+	}
+
+	c.put(key, b)
+
+	return nil
+}
+
+// CompileFile is Compile for the contents of a file.
+func (c *ScriptCache) CompileFile(ctx *Context, path string) error {
+
+	b, err := os.ReadFile(path)
+
+	if err != nil {
+		ctx.PushErrorObject(ErrError, "%s", err.Error())
+		return err
+	}
+
+	return c.Compile(ctx, path, string(b))
+}
+
+// Eval compiles source through the cache and runs it, leaving the result
+// (or the error) on the stack.
+func (c *ScriptCache) Eval(ctx *Context, filename string, source string) error {
+	if err := c.Compile(ctx, filename, source); err != nil {
+		return err
+	}
+	return ctx.castStringToError(ctx.Pcall(0))
+}
+
+// Clear forgets the cached bytecode, including the files in the directory.
+func (c *ScriptCache) Clear() error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = map[string][]byte{}
+
+	if c.dir == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.bc"))
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		os.Remove(file)
+	}
+
+	return nil
+}
+
+func scriptKey(filename string, source string) string {
+	h := sha256.New()
+	h.Write([]byte(filename))
+	h.Write([]byte{0})
+	h.Write([]byte(source))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *ScriptCache) get(key string) []byte {
+
+	c.lock.RLock()
+	b, ok := c.entries[key]
+	c.lock.RUnlock()
+
+	if ok || c.dir == "" {
+		return b
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, key+".bc"))
+
+	if err != nil {
+		return nil
+	}
+
+	b = decodeBytecodeFile(data)
+
+	if b != nil {
+		c.lock.Lock()
+		c.entries[key] = b
+		c.lock.Unlock()
+	}
+
+	return b
+}
+
+func (c *ScriptCache) put(key string, b []byte) {
+
+	c.lock.Lock()
+	c.entries[key] = b
+	c.lock.Unlock()
+
+	if c.dir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return
+	}
+
+	// Written aside and renamed so that readers never see partial files.
+
+	f, err := os.CreateTemp(c.dir, key+".*.tmp")
+
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(encodeBytecodeFile(b))
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, key+".bc"))
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+func (c *ScriptCache) remove(key string) {
+
+	c.lock.Lock()
+	delete(c.entries, key)
+	c.lock.Unlock()
+
+	if c.dir != "" {
+		os.Remove(filepath.Join(c.dir, key+".bc"))
+	}
+}
+
+// A bytecode file is a "kkbc <version> <sha256>" header line followed by
+// the bytecode. Duktape does not validate bytecode, so anything else must
+// never reach LoadFunction.
+func encodeBytecodeFile(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	header := "kkbc " + bytecodeVersion + " " + hex.EncodeToString(sum[:]) + "\n"
+	return append([]byte(header), b...)
+}
+
+func decodeBytecodeFile(data []byte) []byte {
+
+	i := bytes.IndexByte(data, '\n')
+
+	if i < 0 {
+		return nil
+	}
+
+	header := string(data[:i])
+	b := data[i+1:]
+	sum := sha256.Sum256(b)
+
+	if header != "kkbc "+bytecodeVersion+" "+hex.EncodeToString(sum[:]) {
+		return nil
+	}
+
+	return b
+}
+
+// dumpBytecode pops the function at the top of the stack and returns its
+// bytecode.
+func (d *Context) dumpBytecode() ([]byte, error) {
+
+	if err := d.castStringToError(int(C.kk_pdump_function(d.duk_context))); err != nil {
+		d.Pop()
+		return nil, err
+	}
+
+	b := d.getBytes(-1)
+	d.Pop()
+
+	return b, nil
+}
+
+// loadBytecode pushes the function for bytecode produced by dumpBytecode.
+// On failure the error is pushed instead.
+func (d *Context) loadBytecode(b []byte) error {
+	d.pushBytes(b)
+	return d.castStringToError(int(C.kk_pload_function(d.duk_context)))
+}
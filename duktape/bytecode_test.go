@@ -0,0 +1,128 @@
+package duktape
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScriptCache(t *testing.T) {
+
+	c := NewScriptCache("")
+
+	for i := 0; i < 2; i++ {
+
+		ctx := New()
+
+		if err := c.Eval(ctx, "a.js", `var n = (typeof n == "number" ? n : 0) + 1; "v" + n`); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := ctx.SafeToString(-1); got != "v1" {
+			t.Errorf("got %q", got)
+		}
+
+		ctx.DestroyHeap()
+	}
+
+	if len(c.entries) != 1 {
+		t.Errorf("got %d entries", len(c.entries))
+	}
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	if err := c.Eval(ctx, "bad.js", `var = ;`); err == nil {
+		t.Error("no error")
+	}
+
+	if len(c.entries) != 1 {
+		t.Errorf("got %d entries", len(c.entries))
+	}
+}
+
+func TestScriptCacheDir(t *testing.T) {
+
+	dir := t.TempDir()
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	if err := NewScriptCache(dir).Eval(ctx, "a.js", `"a"`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.Pop()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.bc"))
+
+	if len(files) != 1 {
+		t.Fatalf("got %v", files)
+	}
+
+	// Another cache loads the file, and ignores it once corrupted.
+
+	c := NewScriptCache(dir)
+
+	if b := c.get(scriptKey("a.js", `"a"`)); b == nil {
+		t.Error("file not loaded")
+	}
+
+	data, _ := os.ReadFile(files[0])
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(files[0], data, 0644)
+
+	c = NewScriptCache(dir)
+
+	if b := c.get(scriptKey("a.js", `"a"`)); b != nil {
+		t.Error("corrupted file loaded")
+	}
+
+	if got := func() string {
+		if err := c.Eval(ctx, "a.js", `"a"`); err != nil {
+			t.Fatal(err)
+		}
+		defer ctx.Pop()
+		return ctx.SafeToString(-1)
+	}(); got != "a" {
+		t.Errorf("got %q", got)
+	}
+
+	if err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.bc")); len(files) != 0 {
+		t.Errorf("got %v", files)
+	}
+}
+
+func TestScriptCacheFile(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.js")
+
+	os.WriteFile(path, []byte(`throw new Error("in file")`), 0644)
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	c := NewScriptCache("")
+
+	if err := c.CompileFile(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ctx.castStringToError(ctx.Pcall(0))
+	ctx.Pop()
+
+	if e, ok := err.(*Error); !ok || e.Message != "in file" || e.FileName != path {
+		t.Errorf("got %#v", err)
+	}
+
+	if err := c.CompileFile(ctx, filepath.Join(dir, "missing.js")); err == nil {
+		t.Error("no error")
+	}
+
+	ctx.Pop()
+}
@@ -0,0 +1,462 @@
+package duktape
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const consoleKey = "kk.console"
+
+// Logger receives the output of console. fileName and lineNumber locate the
+// script line that logged, they are empty when unknown.
+type Logger interface {
+	Log(level int, message string, fileName string, lineNumber int)
+}
+
+// LoggerFunc adapts a function to Logger.
+type LoggerFunc func(level int, message string, fileName string, lineNumber int)
+
+func (fn LoggerFunc) Log(level int, message string, fileName string, lineNumber int) {
+	fn(level, message, fileName, lineNumber)
+}
+
+var logLevelNames = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// LogLevelName returns the name of a LogTrace...LogFatal level.
+func LogLevelName(level int) string {
+	if level >= 0 && level < len(logLevelNames) {
+		return logLevelNames[level]
+	}
+	return fmt.Sprintf("LEVEL%d", level)
+}
+
+// StdLogger writes to the standard log package.
+var StdLogger Logger = LoggerFunc(func(level int, message string, fileName string, lineNumber int) {
+	if fileName == "" {
+		log.Printf("[%s] %s", LogLevelName(level), message)
+	} else {
+		log.Printf("[%s] %s:%d: %s", LogLevelName(level), fileName, lineNumber, message)
+	}
+})
+
+type console struct {
+	ctx    *Context
+	logger Logger
+	timers map[string]time.Time
+}
+
+// EnableConsole installs a global console object sending its output to
+// logger (StdLogger when nil). console.log and console.info log at
+// LogInfo, console.debug at LogDebug, console.warn at LogWarn,
+// console.error and failed console.assert at LogError and console.trace,
+// which appends the call stack, at LogTrace. Arguments are formatted like
+// Node.js does, including the %s, %d, %i, %f, %j, %o and %O directives.
+func (d *Context) EnableConsole(logger Logger) {
+
+	if logger == nil {
+		logger = StdLogger
+	}
+
+	c := &console{ctx: d, logger: logger, timers: map[string]time.Time{}}
+
+	d.PushGlobalObject()
+	d.PushObject()
+
+	for _, fn := range []struct {
+		name string
+		fn   func() int
+	}{
+		{"log", func() int { return c.log(LogInfo) }},
+		{"info", func() int { return c.log(LogInfo) }},
+		{"debug", func() int { return c.log(LogDebug) }},
+		{"warn", func() int { return c.log(LogWarn) }},
+		{"error", func() int { return c.log(LogError) }},
+		{"trace", c.trace},
+		{"assert", c.assert},
+		{"time", c.time},
+		{"timeLog", func() int { return c.timeEnd(false) }},
+		{"timeEnd", func() int { return c.timeEnd(true) }},
+	} {
+		d.PushGoFunction(fn.fn)
+		d.setFunctionName(-1, fn.name)
+		d.PutPropString(-2, fn.name)
+	}
+
+	d.PutPropString(-2, "console")
+	d.Pop()
+
+	d.markHostGlobals("console")
+}
+
+// ConsoleCapability grants a sandbox the console, see EnableConsole.
+func ConsoleCapability(logger Logger) Capability {
+	return func(ctx *Context) error {
+		ctx.EnableConsole(logger)
+		return nil
+	}
+}
+
+func (c *console) emit(level int, message string) {
+	fileName, lineNumber := c.ctx.scriptLocation(-2)
+	c.logger.Log(level, message, fileName, lineNumber)
+}
+
+func (c *console) log(level int) int {
+	c.emit(level, c.ctx.formatArgs(0))
+	return 0
+}
+
+func (c *console) trace() int {
+
+	d := c.ctx
+	message := "Trace"
+
+	if d.GetTop() > 0 {
+		message = message + ": " + d.formatArgs(0)
+	}
+
+	lines := []string{message}
+
+	for level := -2; ; level-- {
+		d.InspectCallstackEntry(level)
+		if d.IsUndefined(-1) {
+			d.Pop()
+			break
+		}
+		d.GetPropString(-1, "function")
+		d.GetPropString(-1, "name")
+		name := d.SafeToString(-1)
+		d.GetPropString(-2, "fileName")
+		fileName := ""
+		if d.IsString(-1) {
+			fileName = d.SafeToString(-1)
+		}
+		d.GetPropString(-4, "lineNumber")
+		lineNumber := d.GetInt(-1)
+		d.PopN(5)
+		if name == "" {
+			name = "[anon]"
+		}
+		if fileName == "" {
+			lines = append(lines, fmt.Sprintf("    at %s (native)", name))
+		} else {
+			lines = append(lines, fmt.Sprintf("    at %s (%s:%d)", name, fileName, lineNumber))
+		}
+	}
+
+	c.emit(LogTrace, strings.Join(lines, "\n"))
+
+	return 0
+}
+
+func (c *console) assert() int {
+
+	d := c.ctx
+
+	if d.GetTop() > 0 && d.ToBoolean(0) {
+		return 0
+	}
+
+	message := "Assertion failed"
+
+	if d.GetTop() > 1 {
+		message = message + ": " + d.formatArgs(1)
+	}
+
+	c.emit(LogError, message)
+
+	return 0
+}
+
+func (c *console) label() string {
+	if c.ctx.GetTop() == 0 || c.ctx.IsUndefined(0) {
+		return "default"
+	}
+	return c.ctx.SafeToString(0)
+}
+
+func (c *console) time() int {
+
+	label := c.label()
+
+	if _, ok := c.timers[label]; ok {
+		c.emit(LogWarn, fmt.Sprintf("Warning: Label '%s' already exists for console.time()", label))
+		return 0
+	}
+
+	c.timers[label] = time.Now()
+
+	return 0
+}
+
+func (c *console) timeEnd(end bool) int {
+
+	label := c.label()
+	start, ok := c.timers[label]
+
+	if !ok {
+		c.emit(LogWarn, fmt.Sprintf("Warning: No such label '%s' for console.%s()", label, map[bool]string{true: "timeEnd", false: "timeLog"}[end]))
+		return 0
+	}
+
+	if end {
+		delete(c.timers, label)
+	}
+
+	message := fmt.Sprintf("%s: %.3fms", label, float64(time.Since(start))/float64(time.Millisecond))
+
+	if !end && c.ctx.GetTop() > 1 {
+		message = message + " " + c.ctx.formatArgs(1)
+	}
+
+	c.emit(LogInfo, message)
+
+	return 0
+}
+
+// scriptLocation returns the file and line of the callstack entry at level,
+// -1 being the running function.
+func (d *Context) scriptLocation(level int) (string, int) {
+
+	d.InspectCallstackEntry(level)
+
+	if !d.IsObject(-1) {
+		d.Pop()
+		return "", 0
+	}
+
+	d.GetPropString(-1, "lineNumber")
+	lineNumber := d.GetInt(-1)
+	d.GetPropString(-2, "function")
+	d.GetPropString(-1, "fileName")
+	fileName := ""
+
+	if d.IsString(-1) {
+		fileName = d.SafeToString(-1)
+	}
+
+	d.PopN(4)
+
+	return fileName, lineNumber
+}
+
+// formatArgs formats the values from first to the top of the stack as
+// console.log does.
+func (d *Context) formatArgs(first int) string {
+
+	n := d.GetTop()
+
+	d.pushConsoleHelper("format")
+
+	for i := first; i < n; i++ {
+		d.Dup(i)
+	}
+
+	defer d.SetTop(n)
+
+	if err := d.castStringToError(d.Pcall(n - first)); err != nil {
+		return err.Error()
+	}
+
+	return d.getGoString(-1)
+}
+
+// Inspect returns a readable representation of the value at idx, formatted
+// like Node.js util.inspect does.
+func (d *Context) Inspect(idx int) string {
+
+	idx = d.NormalizeIndex(idx)
+
+	d.pushConsoleHelper("inspect")
+	d.Dup(idx)
+
+	defer d.Pop()
+
+	if err := d.castStringToError(d.Pcall(1)); err != nil {
+		return err.Error()
+	}
+
+	return d.getGoString(-1)
+}
+
+func (d *Context) pushConsoleHelper(name string) {
+
+	d.PushGlobalStash()
+
+	if !d.GetPropString(-1, consoleKey) {
+		d.Pop()
+		d.PevalString(consoleSource)
+		d.Dup(-1)
+		d.PutPropString(-3, consoleKey)
+	}
+
+	d.GetPropString(-1, name)
+	d.Remove(-2)
+	d.Remove(-2)
+}
+
+const consoleSource = `(function () {
+
+	var identifier = /^[A-Za-z_$][A-Za-z0-9_$]*$/;
+	var toString = Object.prototype.toString;
+
+	var quote = function (s) {
+		return "'" + s.replace(/\\/g, '\\\\').replace(/'/g, "\\'").replace(/\n/g, '\\n') + "'";
+	};
+
+	var indent = function (s) {
+		return '  ' + s.split('\n').join('\n  ');
+	};
+
+	var inspect = function (value, depth, seen) {
+
+		switch (typeof value) {
+		case 'undefined':
+			return 'undefined';
+		case 'string':
+			return quote(value);
+		case 'number':
+			return value === 0 && 1 / value < 0 ? '-0' : String(value);
+		case 'boolean':
+		case 'symbol':
+			return String(value);
+		case 'function':
+			return value.name ? '[Function: ' + value.name + ']' : '[Function (anonymous)]';
+		}
+
+		if (value === null) {
+			return 'null';
+		}
+
+		if (seen.indexOf(value) >= 0) {
+			return '[Circular]';
+		}
+
+		var tag = toString.call(value);
+
+		if (value instanceof Error) {
+			return value.stack || String(value);
+		}
+
+		if (tag === '[object Date]') {
+			return isNaN(value.getTime()) ? 'Invalid Date' : value.toISOString();
+		}
+
+		if (tag === '[object RegExp]') {
+			return String(value);
+		}
+
+		if (tag === '[object ArrayBuffer]') {
+			return 'ArrayBuffer { byteLength: ' + value.byteLength + ' }';
+		}
+
+		var isArray = Array.isArray(value);
+		var isTyped = ArrayBuffer.isView(value) && !(value instanceof DataView);
+		var prefix = '';
+		var proto = Object.getPrototypeOf(value);
+
+		if (isTyped) {
+			prefix = (proto && proto.constructor ? proto.constructor.name : 'Buffer') + '(' + value.length + ') ';
+		} else if (proto === null) {
+			prefix = '[Object: null prototype] ';
+		} else if (!isArray && proto.constructor && proto.constructor !== Object && proto.constructor.name) {
+			prefix = proto.constructor.name + ' ';
+		}
+
+		if (depth > 2) {
+			return isArray || isTyped ? '[Array]' : '[' + (prefix ? prefix.slice(0, -1) : 'Object') + ']';
+		}
+
+		var parts = [];
+		var i;
+
+		seen.push(value);
+
+		if (isArray || isTyped) {
+			for (i = 0; i < value.length; i++) {
+				parts.push(i in value ? inspect(value[i], depth + 1, seen) : '<empty>');
+			}
+		}
+
+		if (!isTyped) {
+			Object.keys(value).forEach(function (k) {
+				if (isArray && /^(0|[1-9][0-9]*)$/.test(k)) {
+					return;
+				}
+				parts.push((identifier.test(k) ? k : quote(k)) + ': ' + inspect(value[k], depth + 1, seen));
+			});
+		}
+
+		seen.pop();
+
+		var open = isArray || isTyped ? '[' : '{';
+		var close = isArray || isTyped ? ']' : '}';
+
+		if (parts.length === 0) {
+			return prefix + open + close;
+		}
+
+		var line = prefix + open + ' ' + parts.join(', ') + ' ' + close;
+
+		if (line.length <= 72 && line.indexOf('\n') < 0) {
+			return line;
+		}
+
+		return prefix + open + '\n' + indent(parts.join(',\n')) + '\n' + close;
+	};
+
+	var format = function () {
+
+		var args = arguments;
+		var parts = [];
+		var i = 0;
+
+		if (typeof args[0] === 'string') {
+			i = 1;
+			parts.push(args[0].replace(/%[sdifjoOc%]/g, function (m) {
+				if (m === '%%') {
+					return '%';
+				}
+				if (i >= args.length) {
+					return m;
+				}
+				var a = args[i++];
+				switch (m) {
+				case '%s':
+					return typeof a === 'string' ? a : typeof a === 'object' && a !== null ? inspect(a, 1, []) : String(a);
+				case '%d':
+					return typeof a === 'object' && a !== null ? 'NaN' : String(Number(a));
+				case '%i':
+					return String(parseInt(a, 10));
+				case '%f':
+					return String(parseFloat(a));
+				case '%j':
+					try {
+						return JSON.stringify(a);
+					} catch (e) {
+						return '[Circular]';
+					}
+				case '%c':
+					return '';
+				}
+				return inspect(a, 0, []);
+			}));
+		}
+
+		for (; i < args.length; i++) {
+			parts.push(typeof args[i] === 'string' ? args[i] : inspect(args[i], 0, []));
+		}
+
+		return parts.join(' ');
+	};
+
+	return {
+		format: format,
+		inspect: function (value) {
+			return inspect(value, 0, []);
+		}
+	};
+
+})()`
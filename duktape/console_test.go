@@ -0,0 +1,106 @@
+package duktape
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type consoleEntry struct {
+	level   int
+	message string
+	at      string
+}
+
+func newTestConsole() (*Context, *[]consoleEntry) {
+
+	entries := &[]consoleEntry{}
+
+	ctx := New()
+	ctx.EnableConsole(LoggerFunc(func(level int, message string, fileName string, lineNumber int) {
+		*entries = append(*entries, consoleEntry{level, message, fmt.Sprintf("%s:%d", fileName, lineNumber)})
+	}))
+
+	return ctx, entries
+}
+
+func TestConsoleFormat(t *testing.T) {
+
+	ctx, entries := newTestConsole()
+	defer ctx.DestroyHeap()
+
+	for src, want := range map[string]string{
+		`console.log("a", 1, true, null, undefined)`:  "a 1 true null undefined",
+		`console.log("%s=%d", "n", 4.5, "rest")`:      "n=4.5 rest",
+		`console.log("%i|%f|%j", 4.5, "1.5", {a: 1})`: `4|1.5|{"a":1}`,
+		`console.log("100%", "done")`:                 "100% done",
+		`console.log([1, "b"])`:                       "[ 1, 'b' ]",
+		`console.log({a: {b: 1}})`:                    "{ a: { b: 1 } }",
+	} {
+
+		*entries = nil
+
+		evalString(t, ctx, src)
+
+		if len(*entries) != 1 || (*entries)[0].message != want {
+			t.Errorf("%s: got %v, want %q", src, *entries, want)
+		}
+	}
+}
+
+func TestConsoleLevels(t *testing.T) {
+
+	ctx, entries := newTestConsole()
+	defer ctx.DestroyHeap()
+
+	ctx.PushString("main.js")
+
+	src := "console.info('i');\nconsole.debug('d');\nconsole.warn('w');\nconsole.error('e');\nconsole.assert(1 > 2, 'math');\nconsole.assert(true, 'no');"
+
+	if err := ctx.PcompileLstringFilename(0, src, len(src)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.castStringToError(ctx.Pcall(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.Pop()
+
+	want := []consoleEntry{
+		{LogInfo, "i", "main.js:1"},
+		{LogDebug, "d", "main.js:2"},
+		{LogWarn, "w", "main.js:3"},
+		{LogError, "e", "main.js:4"},
+		{LogError, "Assertion failed: math", "main.js:5"},
+	}
+
+	if fmt.Sprint(*entries) != fmt.Sprint(want) {
+		t.Errorf("got %v", *entries)
+	}
+}
+
+func TestConsoleTraceTime(t *testing.T) {
+
+	ctx, entries := newTestConsole()
+	defer ctx.DestroyHeap()
+
+	evalString(t, ctx, `function outer() { console.trace("here"); } outer();
+		console.time(); console.timeLog(undefined, "x"); console.timeEnd(); console.timeEnd();`)
+
+	if len(*entries) != 4 {
+		t.Fatalf("got %v", *entries)
+	}
+
+	if e := (*entries)[0]; e.level != LogTrace || !strings.HasPrefix(e.message, "Trace: here\n    at outer (") {
+		t.Errorf("got %v", e)
+	}
+
+	if e := (*entries)[1]; !strings.HasPrefix(e.message, "default: ") || !strings.HasSuffix(e.message, "ms x") {
+		t.Errorf("got %v", e)
+	}
+
+	if e := (*entries)[3]; e.level != LogWarn || e.message != "Warning: No such label 'default' for console.timeEnd()" {
+		t.Errorf("got %v", e)
+	}
+}
@@ -2,28 +2,49 @@ package duktape
 
 import "fmt"
 
+// Error is a JavaScript error returned by a failing protected call. Type is
+// the error name and is empty when the thrown value was not an Error, which
+// is then kept in Value.
 type Error struct {
 	Type       string
 	Message    string
 	FileName   string
 	LineNumber int
 	Stack      string
+	// GoFileName and GoLineNumber locate the Go code that made the call.
+	GoFileName   string
+	GoLineNumber int
+	// Err is the Go error that was thrown, see PushGoError.
+	Err   error
+	Value interface{}
 }
 
 func (e *Error) Error() string {
+	if e.Type == "" {
+		return e.Message
+	}
 	return fmt.Sprintf("%s: %s", e.Type, e.Message)
 }
 
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 type Type int
 
+// Compile flags, as numbered by Duktape 2: the three low bits are left to
+// the number of arguments of duk_compile_raw.
 const (
-	CompileEval uint = 1 << iota
+	CompileEval uint = 1 << (iota + 3)
 	CompileFunction
 	CompileStrict
+	CompileShebang
 	CompileSafe
 	CompileNoResult
 	CompileNoSource
 	CompileStrlen
+	CompileNoFilename
+	CompileFuncExpr
 )
 
 const (
@@ -135,18 +156,21 @@ const (
 	LogFatal
 )
 
+// Kinds of buffer objects for PushBufferObject, as numbered by Duktape 2.
 const (
-	BufobjDuktapeAuffer     = 0
+	BufobjArraybuffer       = 0
 	BufobjNodejsAuffer      = 1
-	BufobjArraybuffer       = 2
-	BufobjDataview          = 3
-	BufobjInt8array         = 4
-	BufobjUint8array        = 5
-	BufobjUint8clampedarray = 6
-	BufobjInt16array        = 7
-	BufobjUint16array       = 8
-	BufobjInt32array        = 9
-	BufobjUint32array       = 10
-	BufobjFloat32array      = 11
-	BufobjFloat64array      = 12
+	BufobjDataview          = 2
+	BufobjInt8array         = 3
+	BufobjUint8array        = 4
+	BufobjUint8clampedarray = 5
+	BufobjInt16array        = 6
+	BufobjUint16array       = 7
+	BufobjInt32array        = 8
+	BufobjUint32array       = 9
+	BufobjFloat32array      = 10
+	BufobjFloat64array      = 11
+
+	// Duktape 2 has no Duktape.Buffer, plain buffers act as Uint8Array.
+	BufobjDuktapeAuffer = BufobjUint8array
 )
@@ -0,0 +1,235 @@
+package duktape
+
+import (
+	"errors"
+	"strconv"
+)
+
+const coroutinesKey = "kk.coroutines"
+const coroutineHelperKey = "kk.coroutine"
+
+var ErrCoroutineDone = errors.New("duktape: coroutine is done")
+
+// Coroutine is a script function running on its own Duktape thread, which
+// can pause by calling Coroutine.yield(value) and be resumed later from Go
+// with a value, e.g. once some I/O it waits for completes:
+//
+//	ctx.PevalString(`(function (order) {
+//		var stock = Coroutine.yield({ query: order.item });
+//		return stock > 0;
+//	})`)
+//	co, _ := ctx.NewCoroutine(-1)
+//	req, _ := co.Resume(order)   // {query: item}
+//	ok, _ := co.Resume(stock)    // true, co.Done() is now true
+//
+// The function receives the value of the first Resume. Coroutine.yield must
+// be called from script functions only: a Go function called by the
+// coroutine cannot yield on its behalf. A coroutine must be resumed from
+// the goroutine using the context, and outside of any Go function call.
+type Coroutine struct {
+	ctx  *Context
+	id   string
+	done bool
+}
+
+// NewCoroutine creates a coroutine running the function at idx, which is
+// not started until Resume is called.
+func (d *Context) NewCoroutine(idx int) (*Coroutine, error) {
+
+	idx = d.NormalizeIndex(idx)
+
+	if !d.IsFunction(idx) {
+		return nil, errors.New("duktape: coroutine needs a function")
+	}
+
+	if err := d.pushCoroutineHelper("create"); err != nil {
+		return nil, err
+	}
+
+	d.Dup(idx)
+
+	if err := d.castStringToError(d.Pcall(1)); err != nil {
+		d.Pop()
+		return nil, err
+	}
+
+	d.PushGlobalStash()
+	d.GetPropString(-1, coroutinesKey)
+
+	id := ""
+
+	// Ids are reused once their coroutine is gone, keeping the table small.
+	for i := 0; ; i++ {
+		id = strconv.Itoa(i)
+		if !d.HasPropString(-1, id) {
+			break
+		}
+	}
+
+	d.Dup(-3)
+	d.PutPropString(-2, id)
+	d.PopN(3)
+
+	return &Coroutine{ctx: d, id: id}, nil
+}
+
+// Resume runs the coroutine until it yields or returns, sending it value as
+// the result of Coroutine.yield (or as the argument of the function on the
+// first call), and returns the value yielded or returned, converted by
+// ToValue. A coroutine that throws is done and the error is returned.
+func (c *Coroutine) Resume(value interface{}) (interface{}, error) {
+	return c.resume(func() { c.ctx.PushValue(value) }, false)
+}
+
+// Throw resumes the coroutine by throwing err from Coroutine.yield, see
+// PushGoError.
+func (c *Coroutine) Throw(err error) (interface{}, error) {
+	return c.resume(func() { c.ctx.PushGoError(err) }, true)
+}
+
+func (c *Coroutine) resume(push func(), throw bool) (interface{}, error) {
+
+	if c.done {
+		return nil, ErrCoroutineDone
+	}
+
+	d := c.ctx
+
+	if err := d.pushCoroutineHelper("resume"); err != nil {
+		return nil, err
+	}
+
+	d.PushGlobalStash()
+	d.GetPropString(-1, coroutinesKey)
+	d.GetPropString(-1, c.id)
+	d.Remove(-2)
+	d.Remove(-2)
+
+	push()
+
+	if throw {
+		d.PushTrue()
+	} else {
+		d.PushFalse()
+	}
+
+	defer d.Pop()
+
+	if err := d.castStringToError(d.Pcall(3)); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	d.GetPropString(-1, "done")
+	done := d.ToBoolean(-1)
+	d.Pop()
+
+	d.GetPropString(-1, "value")
+	v := d.ToValue(-1)
+	d.Pop()
+
+	if done {
+		c.Close()
+	}
+
+	return v, nil
+}
+
+// Done reports whether the coroutine returned, threw or was closed.
+func (c *Coroutine) Done() bool {
+	return c.done
+}
+
+// Close abandons the coroutine, letting its thread be garbage collected.
+func (c *Coroutine) Close() {
+
+	if c.done {
+		return
+	}
+
+	c.done = true
+
+	d := c.ctx
+
+	d.PushGlobalStash()
+	d.GetPropString(-1, coroutinesKey)
+	d.DelPropString(-1, c.id)
+	d.Pop2()
+}
+
+// pushCoroutineHelper pushes a function of coroutineSource, installing it on
+// first use, and defines the global Coroutine object.
+func (d *Context) pushCoroutineHelper(name string) error {
+
+	d.PushGlobalStash()
+
+	if !d.GetPropString(-1, coroutineHelperKey) {
+
+		d.Pop()
+
+		if err := d.PevalString(coroutineSource); err != nil {
+			d.Pop2()
+			return err
+		}
+
+		d.GetPropString(-2, duktapeKey)
+
+		if err := d.castStringToError(d.Pcall(1)); err != nil {
+			d.Pop2()
+			return err
+		}
+
+		d.Dup(-1)
+		d.PutPropString(-3, coroutineHelperKey)
+
+		d.PushObject()
+		d.PutPropString(-3, coroutinesKey)
+	}
+
+	// Defined again after a Pool reset removed it.
+
+	d.PushGlobalObject()
+
+	if !d.HasPropString(-1, "Coroutine") {
+		d.GetPropString(-2, "Coroutine")
+		d.PutPropString(-2, "Coroutine")
+		d.markHostGlobals("Coroutine")
+	}
+
+	d.Pop()
+
+	d.GetPropString(-1, name)
+	d.Remove(-2)
+	d.Remove(-2)
+
+	return nil
+}
+
+const coroutineSource = `(function (Duktape) {
+
+	var Thread = Duktape.Thread;
+
+	var Done = function (value) {
+		this.value = value;
+	};
+
+	return {
+		create: function (fn) {
+			return new Thread(function (value) {
+				return new Done(fn(value));
+			});
+		},
+		resume: function (thread, value, error) {
+			var r = Thread.resume(thread, value, error);
+			if (r instanceof Done) {
+				return { done: true, value: r.value };
+			}
+			return { done: false, value: r };
+		},
+		Coroutine: Object.freeze({
+			yield: function (value) {
+				return Thread.yield(value);
+			}
+		})
+	};
+})`
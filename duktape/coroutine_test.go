@@ -0,0 +1,128 @@
+package duktape
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newCoroutine(t *testing.T, ctx *Context, src string) *Coroutine {
+	t.Helper()
+	if err := ctx.PevalString(src); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Pop()
+	co, err := ctx.NewCoroutine(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return co
+}
+
+func TestCoroutine(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	co := newCoroutine(t, ctx, `(function (order) {
+		var stock = Coroutine.yield({query: order.item});
+		var more = Coroutine.yield(stock * 2);
+		return order.item + ":" + (stock + more);
+	})`)
+
+	v, err := co.Resume(map[string]interface{}{"item": "pen"})
+
+	if err != nil || v.(map[string]interface{})["query"] != "pen" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+
+	if v, err = co.Resume(3); err != nil || v != 6.0 || co.Done() {
+		t.Fatalf("got %v, %v", v, err)
+	}
+
+	if v, err = co.Resume(4); err != nil || v != "pen:7" || !co.Done() {
+		t.Fatalf("got %v, %v", v, err)
+	}
+
+	if _, err = co.Resume(nil); err != ErrCoroutineDone {
+		t.Errorf("got %v", err)
+	}
+
+	if top := ctx.GetTop(); top != 0 {
+		t.Errorf("got stack top %d", top)
+	}
+}
+
+func TestCoroutineGoFunctions(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	// Go functions called from the coroutine work on its thread.
+
+	ctx.PushGlobalGoFunction("twice", func() int {
+		ctx.PushNumber(ctx.GetNumber(0) * 2)
+		return 1
+	})
+
+	co := newCoroutine(t, ctx, `(function (n) {
+		while (true) {
+			n = Coroutine.yield(twice(n));
+		}
+	})`)
+
+	for i, want := range []float64{2, 10, 14} {
+		if v, err := co.Resume([]int{1, 5, 7}[i]); err != nil || v != want {
+			t.Errorf("got %v, %v", v, err)
+		}
+	}
+
+	co.Close()
+
+	if !co.Done() {
+		t.Error("not done after Close")
+	}
+}
+
+func TestCoroutineErrors(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	// Throw raises the error from Coroutine.yield.
+
+	co := newCoroutine(t, ctx, `(function () {
+		try {
+			Coroutine.yield(1);
+		} catch (e) {
+			return "caught " + e.message;
+		}
+	})`)
+
+	co.Resume(nil)
+
+	if v, err := co.Throw(errors.New("stop")); err != nil || v != "caught stop" {
+		t.Errorf("got %v, %v", v, err)
+	}
+
+	// An uncaught error ends the coroutine.
+
+	co = newCoroutine(t, ctx, `(function () {
+		Coroutine.yield(1);
+	})`)
+
+	co.Resume(nil)
+
+	if _, err := co.Throw(io.ErrUnexpectedEOF); !errors.Is(err, io.ErrUnexpectedEOF) || !co.Done() {
+		t.Errorf("got %v", err)
+	}
+
+	co = newCoroutine(t, ctx, `(function () {
+		null.x;
+	})`)
+
+	if _, err := co.Resume(nil); err == nil || !strings.Contains(err.Error(), "TypeError") || !co.Done() {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package duktape
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/hailongz/kk-lib/db"
+)
+
+var ErrReadOnly = errors.New("database is read-only")
+
+// DatabaseOptions configures the object installed by EnableDatabase.
+type DatabaseOptions struct {
+	// Name is the name of the global, "db" when empty.
+	Name string
+	// ReadOnly rejects exec() and the queries not starting with SELECT,
+	// WITH, SHOW, EXPLAIN or DESCRIBE, holding several statements or a
+	// keyword modifying data such as DELETE in a WITH clause. It is a
+	// safeguard only: a database user without write privileges should back
+	// read-only scripts.
+	ReadOnly bool
+}
+
+type database struct {
+	ctx     *Context
+	conn    db.Database
+	tx      db.Database
+	options DatabaseOptions
+}
+
+// EnableDatabase exposes conn to scripts as a global object (named db by
+// default) with:
+//
+//	query(sql, ...args)  returns the rows as objects keyed by column name
+//	exec(sql, ...args)   returns {rowsAffected, lastInsertId}
+//	transaction(fn)      calls fn inside db.Transaction and returns its result
+//
+// Arguments are bound as query parameters. A transaction commits when fn
+// returns and rolls back when it throws, and the statements run by fn
+// meanwhile belong to it; it requires conn to be a *sql.DB. Byte columns are
+// returned as strings and times as RFC 3339 strings.
+func (d *Context) EnableDatabase(conn db.Database, options DatabaseOptions) {
+
+	if options.Name == "" {
+		options.Name = "db"
+	}
+
+	v := &database{ctx: d, conn: conn, options: options}
+
+	d.PushGlobalObject()
+	d.PushObject()
+
+	d.PushGoFunc(v.query)
+	d.PutPropString(-2, "query")
+
+	d.PushGoFunc(v.exec)
+	d.PutPropString(-2, "exec")
+
+	d.PushGoFunction(v.transaction)
+	d.PutPropString(-2, "transaction")
+
+	d.Freeze(-1)
+	d.PutPropString(-2, options.Name)
+	d.Pop()
+
+	d.markHostGlobals(options.Name)
+}
+
+// DatabaseCapability grants a sandbox a database, see EnableDatabase.
+func DatabaseCapability(conn db.Database, options DatabaseOptions) Capability {
+	return func(ctx *Context) error {
+		ctx.EnableDatabase(conn, options)
+		return nil
+	}
+}
+
+func (v *database) current() db.Database {
+	if v.tx != nil {
+		return v.tx
+	}
+	return v.conn
+}
+
+var readOnlyStatements = []string{"SELECT", "WITH", "SHOW", "EXPLAIN", "DESCRIBE"}
+
+// writeKeywords are the keywords of statements modifying data or schemas,
+// rejected anywhere in a read-only query.
+var writeKeywords = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true, "REPLACE": true, "UPSERT": true,
+	"CREATE": true, "DROP": true, "ALTER": true, "TRUNCATE": true, "RENAME": true,
+	"GRANT": true, "REVOKE": true, "CALL": true, "EXEC": true, "EXECUTE": true,
+	"COPY": true, "LOAD": true, "LOCK": true, "INTO": true,
+}
+
+func isReadStatement(query string) bool {
+
+	words := sqlWords(query)
+
+	if words == nil {
+		return false
+	}
+
+	read := false
+
+	for _, s := range readOnlyStatements {
+		if strings.EqualFold(words[0], s) {
+			read = true
+		}
+	}
+
+	for _, w := range words {
+		if writeKeywords[strings.ToUpper(w)] {
+			return false
+		}
+	}
+
+	return read
+}
+
+// sqlWords returns the words of query, string literals, quoted identifiers
+// and comments excluded, or nil when it is empty or holds several
+// statements.
+func sqlWords(query string) []string {
+
+	var words []string
+
+	isWord := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+	}
+
+	for i := 0; i < len(query); {
+
+		c := query[i]
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			for i++; i < len(query); i++ {
+				if query[i] == '\\' && c == '\'' {
+					i++
+				} else if query[i] == c {
+					// A doubled quote is part of the literal.
+					if i+1 < len(query) && query[i+1] == c {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+			i++
+		case c == '-' && strings.HasPrefix(query[i:], "--"), c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			if j := strings.Index(query[i+2:], "*/"); j >= 0 {
+				i = i + j + 4
+			} else {
+				i = len(query)
+			}
+		case c == ';':
+			if strings.TrimSpace(query[i+1:]) != "" {
+				return nil
+			}
+			i = len(query)
+		case isWord(c):
+			j := i
+			for j < len(query) && isWord(query[j]) {
+				j++
+			}
+			words = append(words, query[i:j])
+			i = j
+		default:
+			i++
+		}
+	}
+
+	return words
+}
+
+func queryArgs(args []interface{}) ([]interface{}, error) {
+
+	vs := make([]interface{}, len(args))
+
+	for i, arg := range args {
+		switch a := arg.(type) {
+		case nil, bool, string, []byte:
+			vs[i] = a
+		case float64:
+			if a == math.Trunc(a) && math.Abs(a) < 1<<53 {
+				vs[i] = int64(a)
+			} else {
+				vs[i] = a
+			}
+		default:
+			return nil, fmt.Errorf("argument %d: cannot bind %s", i+2, jsTypeName(arg))
+		}
+	}
+
+	return vs, nil
+}
+
+func (v *database) query(query string, args ...interface{}) ([]map[string]interface{}, error) {
+
+	if v.options.ReadOnly && !isReadStatement(query) {
+		return nil, ErrReadOnly
+	}
+
+	vs, err := queryArgs(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := v.current().Query(query, vs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := []map[string]interface{}{}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	for rows.Next() {
+
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		item := map[string]interface{}{}
+
+		for i, name := range columns {
+			switch value := values[i].(type) {
+			case []byte:
+				item[name] = string(value)
+			case time.Time:
+				item[name] = value.Format(time.RFC3339Nano)
+			default:
+				item[name] = value
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (v *database) exec(query string, args ...interface{}) (map[string]interface{}, error) {
+
+	if v.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	vs, err := queryArgs(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := v.current().Exec(query, vs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := map[string]interface{}{}
+
+	if n, err := rs.RowsAffected(); err == nil {
+		r["rowsAffected"] = n
+	}
+
+	if id, err := rs.LastInsertId(); err == nil {
+		r["lastInsertId"] = id
+	}
+
+	return r, nil
+}
+
+func (v *database) transaction() int {
+
+	d := v.ctx
+
+	if !d.IsFunction(0) {
+		d.PushErrorObject(ErrType, "%s", "transaction expects a function")
+		return retThrow
+	}
+
+	d.SetTop(1)
+
+	// Statements of a nested transaction join the outer one.
+
+	if v.tx != nil {
+		d.Dup(0)
+		if d.Pcall(0) != 0 {
+			return retThrow
+		}
+		return 1
+	}
+
+	conn, ok := v.conn.(*sql.DB)
+
+	if !ok {
+		d.PushErrorObject(ErrType, "%s", "transactions require a *sql.DB")
+		return retThrow
+	}
+
+	thrown := false
+
+	err := db.Transaction(conn, func(tx db.Database) error {
+		v.tx = tx
+		defer func() { v.tx = nil }()
+		d.Dup(0)
+		if d.Pcall(0) != 0 {
+			thrown = true
+			return errors.New("transaction aborted")
+		}
+		return nil
+	})
+
+	if thrown {
+		return retThrow
+	}
+
+	if err != nil {
+		d.SetTop(0)
+		d.PushGoError(err)
+		return retThrow
+	}
+
+	return 1
+}
@@ -0,0 +1,229 @@
+package duktape
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver records the statements it is given. Queries return the rows
+// of fakeRows, whatever the statement.
+type fakeDriver struct {
+	log  []string
+	lock sync.Mutex
+}
+
+var fakeRows = [][]driver.Value{
+	{int64(1), []byte("a"), time.Date(2020, 5, 17, 0, 0, 0, 0, time.UTC)},
+	{int64(2), nil, time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)},
+}
+
+func (v *fakeDriver) record(s string) {
+	v.lock.Lock()
+	v.log = append(v.log, s)
+	v.lock.Unlock()
+}
+
+func (v *fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{v}, nil
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c.driver, query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.driver.record("BEGIN")
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.driver.record("COMMIT")
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.driver.record("ROLLBACK")
+	return nil
+}
+
+type fakeStmt struct {
+	driver *fakeDriver
+	query  string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.driver.record(fmt.Sprint(s.query, args))
+	return fakeResult{}, nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.driver.record(fmt.Sprint(s.query, args))
+	return &fakeRowsCursor{}, nil
+}
+
+type fakeResult struct{}
+
+func (fakeResult) LastInsertId() (int64, error) {
+	return 7, nil
+}
+
+func (fakeResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type fakeRowsCursor struct {
+	i int
+}
+
+func (r *fakeRowsCursor) Columns() []string {
+	return []string{"id", "name", "at"}
+}
+
+func (r *fakeRowsCursor) Close() error {
+	return nil
+}
+
+func (r *fakeRowsCursor) Next(dest []driver.Value) error {
+	if r.i == len(fakeRows) {
+		return io.EOF
+	}
+	copy(dest, fakeRows[r.i])
+	r.i = r.i + 1
+	return nil
+}
+
+var fakeDriverId = 0
+
+func openFakeDatabase(t *testing.T) (*sql.DB, *fakeDriver) {
+	v := &fakeDriver{}
+	fakeDriverId = fakeDriverId + 1
+	name := fmt.Sprintf("kkfake%d", fakeDriverId)
+	sql.Register(name, v)
+	conn, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, v
+}
+
+func TestDatabase(t *testing.T) {
+
+	conn, fake := openFakeDatabase(t)
+	defer conn.Close()
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.EnableDatabase(conn, DatabaseOptions{})
+
+	src := `var r = db.exec("UPDATE t SET name = ?", "b");
+		JSON.stringify(db.query("SELECT * FROM t WHERE id > ? AND x = ?", 0, 1.5).map(function (row) {
+			return [row.id, row.name, row.at];
+		})) + " " + r.rowsAffected + " " + r.lastInsertId`
+
+	want := `[[1,"a","2020-05-17T00:00:00Z"],[2,null,"2021-01-02T03:04:05Z"]] 1 7`
+
+	if got := evalString(t, ctx, src); got != want {
+		t.Errorf("got %s", got)
+	}
+
+	if got := strings.Join(fake.log, "\n"); got != "UPDATE t SET name = ?[b]\nSELECT * FROM t WHERE id > ? AND x = ?[0 1.5]" {
+		t.Errorf("got %q", got)
+	}
+
+	err := ctx.PevalString(`db.query("SELECT ?", {})`)
+	ctx.Pop()
+
+	if err == nil || !strings.Contains(err.Error(), "argument 2: cannot bind object") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDatabaseTransaction(t *testing.T) {
+
+	conn, fake := openFakeDatabase(t)
+	defer conn.Close()
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.EnableDatabase(conn, DatabaseOptions{Name: "store"})
+
+	got := evalString(t, ctx, `store.transaction(function () {
+		store.exec("INSERT 1");
+		store.transaction(function () { store.exec("INSERT 2"); });
+		return "done";
+	}) + "," + (function () {
+		try {
+			store.transaction(function () { store.exec("INSERT 3"); throw new Error("abort"); });
+		} catch (e) {
+			return e.message;
+		}
+	})()`)
+
+	if got != "done,abort" {
+		t.Errorf("got %q", got)
+	}
+
+	if got := strings.Join(fake.log, ","); got != "BEGIN,INSERT 1[],INSERT 2[],COMMIT,BEGIN,INSERT 3[],ROLLBACK" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestDatabaseReadOnly(t *testing.T) {
+
+	conn, fake := openFakeDatabase(t)
+	defer conn.Close()
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.EnableDatabase(conn, DatabaseOptions{ReadOnly: true})
+
+	evalString(t, ctx, `db.query("  with x as (select 1) select * from x")`)
+
+	evalString(t, ctx, `db.query("SELECT 'delete; drop' AS \"update\" FROM t -- insert\n;")`)
+
+	for _, src := range []string{
+		`db.exec("SELECT 1")`,
+		`db.query("DELETE FROM t")`,
+		`db.query("WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x")`,
+		`db.query("SELECT 1; DROP TABLE t")`,
+		`db.query("SELECT * INTO copy FROM t")`,
+		`db.query("  ")`,
+	} {
+
+		err := ctx.PevalString(src)
+		ctx.Pop()
+
+		if err == nil || !strings.Contains(err.Error(), ErrReadOnly.Error()) {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+
+	if len(fake.log) != 2 {
+		t.Errorf("got %v", fake.log)
+	}
+}
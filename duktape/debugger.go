@@ -0,0 +1,173 @@
+package duktape
+
+/*
+#include "duk_config.h"
+#include "duktape.h"
+#include "kk.h"
+*/
+import "C"
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"unsafe"
+)
+
+// debugSession is the transport of an attached debugger. Incoming data is
+// read ahead by a goroutine so that Duktape can peek without blocking.
+type debugSession struct {
+	conn     net.Conn
+	w        *bufio.Writer
+	buf      []byte
+	err      error
+	lock     sync.Mutex
+	readable *sync.Cond
+	detached chan struct{}
+}
+
+var debugSessions = map[int]*debugSession{}
+var debugSessionsLock sync.Mutex
+var debugSessionsAutoId = 0
+
+// AttachDebugger attaches a Duktape debug client (such as duk_debug.js)
+// talking the Duktape debug protocol over conn. The debugger stays attached
+// until the connection fails, the client detaches, DebuggerDetach is called
+// or the heap is destroyed; conn is closed then and the returned channel is
+// closed.
+//
+// Duktape pauses once the debugger is attached. Debug messages are only
+// handled while scripts run, so an idle context should call
+// DebuggerCooperate from time to time, and a paused script blocks the
+// goroutine running it until the client resumes it.
+func (d *Context) AttachDebugger(conn net.Conn) <-chan struct{} {
+
+	v := &debugSession{conn: conn, w: bufio.NewWriter(conn), detached: make(chan struct{})}
+	v.readable = sync.NewCond(&v.lock)
+
+	debugSessionsLock.Lock()
+	debugSessionsAutoId = debugSessionsAutoId + 1
+	id := debugSessionsAutoId
+	debugSessions[id] = v
+	debugSessionsLock.Unlock()
+
+	go v.readLoop()
+
+	C.kk_debugger_attach(d.duk_context, C.int(id))
+
+	return v.detached
+}
+
+func (v *debugSession) readLoop() {
+	b := make([]byte, 4096)
+	for {
+		n, err := v.conn.Read(b)
+		v.lock.Lock()
+		v.buf = append(v.buf, b[:n]...)
+		if err != nil {
+			v.err = err
+		}
+		v.readable.Broadcast()
+		v.lock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func getDebugSession(id C.int) *debugSession {
+	debugSessionsLock.Lock()
+	defer debugSessionsLock.Unlock()
+	return debugSessions[int(id)]
+}
+
+func cBytes(p *C.char, n C.duk_size_t) []byte {
+	return (*[1 << 30]byte)(unsafe.Pointer(p))[:int(n):int(n)]
+}
+
+// Returning 0 from the read and write callbacks makes Duktape detach.
+
+//export goDebugRead
+func goDebugRead(id C.int, buffer *C.char, length C.duk_size_t) C.duk_size_t {
+
+	v := getDebugSession(id)
+
+	if v == nil || length == 0 {
+		return 0
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for len(v.buf) == 0 && v.err == nil {
+		v.readable.Wait()
+	}
+
+	n := copy(cBytes(buffer, length), v.buf)
+	v.buf = v.buf[n:]
+
+	return C.duk_size_t(n)
+}
+
+//export goDebugWrite
+func goDebugWrite(id C.int, buffer *C.char, length C.duk_size_t) C.duk_size_t {
+
+	v := getDebugSession(id)
+
+	if v == nil || length == 0 {
+		return 0
+	}
+
+	n, err := v.w.Write(cBytes(buffer, length))
+
+	if err != nil {
+		return 0
+	}
+
+	return C.duk_size_t(n)
+}
+
+//export goDebugPeek
+func goDebugPeek(id C.int) C.duk_size_t {
+
+	v := getDebugSession(id)
+
+	if v == nil {
+		return 0
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(v.buf) == 0 && v.err != nil {
+		// Lets the following read report the failure.
+		return 1
+	}
+
+	return C.duk_size_t(len(v.buf))
+}
+
+//export goDebugWriteFlush
+func goDebugWriteFlush(id C.int) {
+	if v := getDebugSession(id); v != nil {
+		v.w.Flush()
+	}
+}
+
+//export goDebugDetached
+func goDebugDetached(id C.int) {
+
+	debugSessionsLock.Lock()
+	v := debugSessions[int(id)]
+	delete(debugSessions, int(id))
+	debugSessionsLock.Unlock()
+
+	if v == nil {
+		return
+	}
+
+	v.w.Flush()
+	v.conn.Close()
+
+	close(v.detached)
+}
@@ -0,0 +1,249 @@
+package duktape
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachDebugger(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	client, conn := net.Pipe()
+
+	version := make(chan string, 1)
+
+	go func() {
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		version <- line
+		client.Close()
+	}()
+
+	detached := ctx.AttachDebugger(conn)
+
+	if line := <-version; !strings.HasPrefix(line, "2 ") {
+		t.Errorf("got version line %q", line)
+	}
+
+	// The script pauses for the client, which is gone: the debugger detaches
+	// and the script goes on.
+
+	if got := evalString(t, ctx, `1 + 1`); got != "2" {
+		t.Errorf("got %q", got)
+	}
+
+	select {
+	case <-detached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("debugger not detached")
+	}
+}
+
+// readDvalue reads a value of the Duktape debug protocol. Markers are
+// returned as debugMarker, and the values the test does not need as nil.
+func readDvalue(r *bufio.Reader) (interface{}, error) {
+
+	b, err := r.ReadByte()
+
+	if err != nil {
+		return nil, err
+	}
+
+	n := func(size int) (uint64, error) {
+		var v uint64
+		for i := 0; i < size; i++ {
+			c, err := r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			v = v<<8 | uint64(c)
+		}
+		return v, nil
+	}
+
+	data := func(size int) ([]byte, error) {
+		l, err := n(size)
+		if err != nil {
+			return nil, err
+		}
+		p := make([]byte, l)
+		_, err = io.ReadFull(r, p)
+		return p, err
+	}
+
+	switch {
+	case b <= 0x04:
+		return debugMarker(b), nil
+	case b == 0x10:
+		v, err := n(4)
+		return int(int32(v)), err
+	case b == 0x11 || b == 0x13:
+		p, err := data(4)
+		return string(p), err
+	case b == 0x12 || b == 0x14:
+		p, err := data(2)
+		return string(p), err
+	case b >= 0x15 && b <= 0x19:
+		return nil, nil
+	case b == 0x1a:
+		v, err := n(8)
+		return math.Float64frombits(v), err
+	case b == 0x1b:
+		_, err := n(1)
+		if err == nil {
+			_, err = data(1)
+		}
+		return nil, err
+	case b == 0x1c || b == 0x1e:
+		_, err := data(1)
+		return nil, err
+	case b == 0x1d:
+		_, err := n(2)
+		if err == nil {
+			_, err = data(1)
+		}
+		return nil, err
+	case b >= 0x60 && b < 0x80:
+		p := make([]byte, b-0x60)
+		_, err := io.ReadFull(r, p)
+		return string(p), err
+	case b >= 0x80 && b < 0xc0:
+		return int(b - 0x80), nil
+	case b >= 0xc0:
+		v, err := n(1)
+		return int(b-0xc0)<<8 | int(v), err
+	}
+
+	return nil, fmt.Errorf("unexpected dvalue 0x%02x", b)
+}
+
+type debugMarker byte
+
+const (
+	debugEOM debugMarker = iota
+	debugREQ
+	debugREP
+	debugERR
+	debugNFY
+)
+
+// readDebugMessage reads a message up to its EOM.
+func readDebugMessage(r *bufio.Reader) ([]interface{}, error) {
+	var m []interface{}
+	for {
+		v, err := readDvalue(r)
+		if err != nil {
+			return nil, err
+		}
+		if v == debugEOM {
+			return m, nil
+		}
+		m = append(m, v)
+	}
+}
+
+func TestDebuggerProtocol(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	client, conn := net.Pipe()
+
+	type result struct {
+		info   []interface{}
+		paused bool
+		err    error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+
+		var res result
+
+		r := bufio.NewReader(client)
+
+		// Once done, the notifications are read until the debugger detaches.
+
+		defer func() {
+			done <- res
+			io.Copy(io.Discard, r)
+		}()
+
+		if _, res.err = r.ReadString('\n'); res.err != nil {
+			return
+		}
+
+		// request sends a command and returns its reply, noting the status
+		// notifications received meanwhile.
+		request := func(command byte) []interface{} {
+			if _, res.err = client.Write([]byte{byte(debugREQ), 0x80 + command, byte(debugEOM)}); res.err != nil {
+				return nil
+			}
+			for {
+				m, err := readDebugMessage(r)
+				if err != nil {
+					res.err = err
+					return nil
+				}
+				switch m[0] {
+				case debugNFY:
+					if m[1] == 1 && m[2] == 1 {
+						res.paused = true
+					}
+				case debugREP:
+					return m[1:]
+				default:
+					res.err = fmt.Errorf("got %v", m)
+					return nil
+				}
+			}
+		}
+
+		// BasicInfo, then Resume.
+
+		if res.info = request(0x10); res.err == nil {
+			request(0x13)
+		}
+	}()
+
+	detached := ctx.AttachDebugger(conn)
+
+	if got := evalString(t, ctx, `1 + 1`); got != "2" {
+		t.Errorf("got %q", got)
+	}
+
+	res := <-done
+
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	// The reply holds the version, the git describe of the build, the
+	// target, the endianness and the size of pointers.
+
+	version := strings.Fields(bytecodeVersion)
+
+	if len(res.info) != 5 || fmt.Sprint(res.info[0]) != version[0] || res.info[1] != version[1] {
+		t.Errorf("got BasicInfo %v", res.info)
+	}
+
+	if !res.paused {
+		t.Error("no paused status before Resume")
+	}
+
+	ctx.DebuggerDetach()
+
+	select {
+	case <-detached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("debugger not detached")
+	}
+}
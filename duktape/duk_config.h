@@ -2986,6 +2986,16 @@ typedef struct duk_hthread duk_context;
 
 /* __OVERRIDE_DEFINES__ */
 
+/* Allow running scripts to be interrupted and profiled, see kk.c */
+#define DUK_USE_INTERRUPT_COUNTER
+#define DUK_USE_EXEC_TIMEOUT_CHECK kk_exec_timeout_check
+duk_bool_t kk_exec_timeout_check(void *udata);
+
+/* Remote debugging, see Context.AttachDebugger */
+#define DUK_USE_DEBUGGER_SUPPORT
+#define DUK_USE_DEBUGGER_INSPECT
+#define DUK_USE_DEBUGGER_PAUSE_UNCAUGHT
+
 /*
  *  Conditional includes
  */
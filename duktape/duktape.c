@@ -96799,3 +96799,116 @@ DUK_INTERNAL duk_double_t duk_util_tinyrandom_get_double(duk_hthread *thr) {
 #undef DUK__RANDOM_XOROSHIRO128PLUS
 #undef DUK__RND_BIT
 #undef DUK__UPDATE_RND
+
+/*
+ *  kk: tells whether the ECMAScript function at idx was created in the global
+ *  environment of thr, i.e. it does not capture the variables of an enclosing
+ *  function, see Context.Snapshot in snapshot.go.
+ */
+
+DUK_EXTERNAL duk_bool_t kk_is_global_function(duk_hthread *thr, duk_idx_t idx) {
+	duk_hobject *h;
+
+	h = duk_get_hobject(thr, idx);
+	if (h == NULL || !DUK_HOBJECT_IS_COMPFUNC(h)) {
+		return 0;
+	}
+	return DUK_HCOMPFUNC_GET_LEXENV(thr->heap, (duk_hcompfunc *) h) == thr->builtins[DUK_BIDX_GLOBAL_ENV];
+}
+
+/*
+ *  kk: writes the call stack of the running thread to buf, innermost frame
+ *  first, for the profiler (see profiler.go): "name (file:line);name [Go];
+ *  name [native]". It only reads the heap, without allocating or calling the
+ *  API, so that the executor interrupt can use it. Returns the length of the
+ *  stack, which is truncated when larger than size.
+ */
+
+extern duk_ret_t kk_function_call(duk_hthread *ctx);
+
+DUK_LOCAL duk_size_t kk__append(char *buf, duk_size_t size, duk_size_t len, const char *s, duk_size_t n) {
+	duk_size_t i;
+
+	for (i = 0; i < n && len + i < size; i++) {
+		/* ';' only separates the frames */
+		buf[len + i] = s[i] == ';' ? ',' : s[i];
+	}
+	return len + n;
+}
+
+DUK_LOCAL duk_size_t kk__append_string(char *buf, duk_size_t size, duk_size_t len, duk_hstring *h) {
+	return kk__append(buf, size, len, (const char *) DUK_HSTRING_GET_DATA(h), DUK_HSTRING_GET_BYTELEN(h));
+}
+
+DUK_LOCAL duk_hstring *kk__own_string(duk_hthread *thr, duk_hobject *h, duk_hstring *key) {
+	duk_tval *tv;
+
+	tv = duk_hobject_find_existing_entry_tval_ptr(thr->heap, h, key);
+	if (tv != NULL && DUK_TVAL_IS_STRING(tv)) {
+		return DUK_TVAL_GET_STRING(tv);
+	}
+	return NULL;
+}
+
+DUK_EXTERNAL duk_size_t kk_callstack(duk_hthread *ctx, char *buf, duk_size_t size, duk_bool_t lines) {
+	duk_hthread *thr;
+	duk_activation *act;
+	duk_hobject *func;
+	duk_hstring *name;
+	duk_hstring *file;
+	duk_tval *tv;
+	duk_uint_fast32_t line;
+	duk_size_t len = 0;
+	char num[32];
+
+	thr = ctx->heap->curr_thread;
+	if (thr == NULL) {
+		return 0;
+	}
+
+	for (act = thr->callstack_curr; act != NULL; act = act->parent) {
+		func = act->func;
+
+		if (len > 0) {
+			if (len < size) {
+				buf[len] = ';';
+			}
+			len++;
+		}
+
+		name = func != NULL ? kk__own_string(thr, func, DUK_HTHREAD_STRING_NAME(thr)) : NULL;
+		if (name != NULL && DUK_HSTRING_GET_BYTELEN(name) > 0) {
+			len = kk__append_string(buf, size, len, name);
+		} else {
+			len = kk__append(buf, size, len, "(anonymous)", 11);
+		}
+
+		if (func != NULL && DUK_HOBJECT_IS_NATFUNC(func) && ((duk_hnatfunc *) func)->func == kk_function_call) {
+			len = kk__append(buf, size, len, " [Go]", 5);
+			continue;
+		}
+
+		file = func != NULL ? kk__own_string(thr, func, DUK_HTHREAD_STRING_FILE_NAME(thr)) : NULL;
+		if (file == NULL) {
+			len = kk__append(buf, size, len, " [native]", 9);
+			continue;
+		}
+
+		len = kk__append(buf, size, len, " (", 2);
+		len = kk__append_string(buf, size, len, file);
+
+		if (lines && DUK_HOBJECT_IS_COMPFUNC(func)) {
+			line = 0;
+			tv = duk_hobject_find_existing_entry_tval_ptr(thr->heap, func, DUK_HTHREAD_STRING_INT_PC2LINE(thr));
+			if (tv != NULL && DUK_TVAL_IS_BUFFER(tv)) {
+				line = duk__hobject_pc2line_query_raw(thr, (duk_hbuffer_fixed *) DUK_TVAL_GET_BUFFER(tv), duk_hthread_get_act_prev_pc(thr, act));
+			}
+			DUK_SNPRINTF(num, sizeof(num), ":%lu", (unsigned long) line);
+			len = kk__append(buf, size, len, num, DUK_STRLEN(num));
+		}
+
+		len = kk__append(buf, size, len, ")", 1);
+	}
+
+	return len;
+}
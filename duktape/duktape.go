@@ -17,12 +17,29 @@ extern duk_ret_t goFinalizeCall(struct duk_hthread *ctx);
 import "C"
 
 import (
+	"errors"
+	"sync"
+	"time"
 	"unsafe"
 )
 
+// retThrow is returned by Go callbacks that left an error on the stack which
+// kk_function_call should throw once control is back in C.
+const retThrow = int(C.KK_RET_THROW)
+
+const duktapeKey = "kk.Duktape"
+
+// scope holds the Go values referenced by the heap. Finalizers may run on
+// another goroutine than the calls, so the registry is locked.
 type scope struct {
 	autoId  int
 	objects map[int]interface{}
+	depth   int
+	owner   *Context
+	// profiler, when running, records the calls of Go functions. Read and
+	// written with the lock held.
+	profiler *Profiler
+	lock     sync.Mutex
 }
 
 func newScope() *scope {
@@ -32,7 +49,21 @@ func newScope() *scope {
 	return &v
 }
 
+func (s *scope) getProfiler() *Profiler {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.profiler
+}
+
+func (s *scope) setProfiler(p *Profiler) {
+	s.lock.Lock()
+	s.profiler = p
+	s.lock.Unlock()
+}
+
 func (s *scope) Add(object interface{}) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	id := s.autoId + 1
 	s.autoId = id
 	s.objects[id] = object
@@ -40,11 +71,16 @@ func (s *scope) Add(object interface{}) int {
 }
 
 func (s *scope) Remove(id int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	delete(s.objects, id)
 }
 
 func (s *scope) Call(id int) int {
+	// Not locked while calling, fn may register values itself.
+	s.lock.Lock()
 	v, ok := s.objects[id]
+	s.lock.Unlock()
 	if ok {
 		fn, ok := v.(func() int)
 		if ok {
@@ -55,6 +91,8 @@ func (s *scope) Call(id int) int {
 }
 
 func (s *scope) Get(id int) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	v, ok := s.objects[id]
 	if ok {
 		return v
@@ -65,32 +103,125 @@ func (s *scope) Get(id int) interface{} {
 type Context struct {
 	s           *scope
 	duk_context *C.struct_duk_hthread
+	heap        *C.struct_kk_heap
+	// deadline is guarded by the lock of the scope, see SetDeadline.
+	deadline  *time.Timer
+	loop      *Loop
+	transpile bool
 }
 
+// Options configures the heap created by NewWithOptions.
+type Options struct {
+	// MaxMemory caps the bytes allocated by the heap, 0 means no limit.
+	// Allocations beyond it fail: scripts then get an Error with the message
+	// "alloc failed", which a protected call returns as an *Error.
+	MaxMemory int
+}
+
+// MemoryStats reports the memory allocated by a heap.
+type MemoryStats struct {
+	Bytes       int
+	PeakBytes   int
+	Allocations int
+	MaxMemory   int
+}
+
+var ErrCreateHeap = errors.New("duktape: cannot create heap")
+
 func New() *Context {
+	v, _ := NewWithOptions(Options{})
+	return v
+}
+
+func NewWithOptions(options Options) (*Context, error) {
+
+	heap := (*C.struct_kk_heap)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_kk_heap{}))))
+	heap.max_memory = C.size_t(options.MaxMemory)
+
+	ctx := C.kk_create_heap(heap)
+
+	if ctx == nil {
+		C.free(unsafe.Pointer(heap))
+		return nil, ErrCreateHeap
+	}
+
 	v := Context{
 		s:           newScope(),
-		duk_context: C.duk_create_heap(nil, nil, nil, nil, nil),
+		duk_context: ctx,
+		heap:        heap,
+	}
+
+	v.s.owner = &v
+
+	// Kept for the transpiler helpers since sandboxes remove the global.
+	v.PushGlobalStash()
+	v.GetGlobalString("Duktape")
+	v.PutPropString(-2, duktapeKey)
+	v.stashBinaryGlobals()
+	v.Pop()
+
+	return &v, nil
+}
+
+// MemoryStats returns the current memory usage of the heap. It may be called
+// from any goroutine while the heap is running, but not concurrently with
+// DestroyHeap.
+func (d *Context) MemoryStats() MemoryStats {
+	if d.heap == nil {
+		return MemoryStats{}
+	}
+	var memory, peak, allocs C.size_t
+	C.kk_memory_stats(d.heap, &memory, &peak, &allocs)
+	return MemoryStats{
+		Bytes:       int(memory),
+		PeakBytes:   int(peak),
+		Allocations: int(allocs),
+		MaxMemory:   int(d.heap.max_memory),
 	}
-	return &v
 }
 
 func (d *Context) Recycle() {
 	C.duk_destroy_heap(d.duk_context)
+	d.freeHeap()
+}
+
+func (d *Context) freeHeap() {
+	d.s.lock.Lock()
+	if d.deadline != nil {
+		d.deadline.Stop()
+		d.deadline = nil
+	}
+	d.s.lock.Unlock()
+	if d.loop != nil {
+		d.loop.stop()
+	}
+	if p := d.s.getProfiler(); p != nil {
+		p.Stop()
+	}
+	if d.heap != nil {
+		d.s.lock.Lock()
+		heap := d.heap
+		d.heap = nil
+		d.s.lock.Unlock()
+		C.free(unsafe.Pointer(heap.profile))
+		C.free(unsafe.Pointer(heap))
+	}
 }
 
 func (d *Context) PushGlobalGoFunction(key string, fn func() int) {
 	d.PushGlobalObject()
 	d.PushGoFunction(fn)
+	d.setFunctionName(-1, key)
 	d.PutPropString(-2, key)
 	d.Pop()
+	d.markHostGlobals(key)
 }
 
 func (d *Context) PushGoFunction(fn func() int) {
 	s := d.s
 	id := s.Add(fn)
 
-	C.duk_push_c_function(d.duk_context, (*[0]byte)(C.goFunctionCall), C.DUK_VARARGS)
+	C.duk_push_c_function(d.duk_context, (*[0]byte)(C.kk_function_call), C.DUK_VARARGS)
 
 	setScope(d.duk_context, -1, s)
 	setFunctionId(d.duk_context, -1, id)
@@ -100,6 +231,15 @@ func (d *Context) PushGoFunction(fn func() int) {
 
 }
 
+// setFunctionName defines the name of the function at idx, which names Go
+// functions in stacks and profiles.
+func (d *Context) setFunctionName(idx int, name string) {
+	idx = d.NormalizeIndex(idx)
+	d.PushString("name")
+	d.pushGoString(name)
+	d.DefProp(idx, DUK_DEFPROP_HAVE_VALUE|DUK_DEFPROP_FORCE)
+}
+
 func (d *Context) PushGoObject(object interface{}) {
 	s := d.s
 	id := s.Add(object)
@@ -204,7 +344,31 @@ func goFunctionCall(ctx *C.struct_duk_hthread) C.duk_ret_t {
 	s := getScope(ctx, -1)
 	id := getFunctionId(ctx, -1)
 
+	var p *Profiler
+
 	if id != 0 && s != nil {
+		p = s.getProfiler()
+	}
+
+	if p != nil {
+		p.goFunctionName(&Context{s: s, duk_context: ctx}, id)
+	}
+
+	C.duk_pop(ctx)
+
+	if id != 0 && s != nil {
+		// Functions called from another thread of the heap (a
+		// Duktape.Thread) must work on the value stack of that thread.
+		if d := s.owner; d != nil && d.duk_context != ctx {
+			saved := d.duk_context
+			d.duk_context = ctx
+			defer func() { d.duk_context = saved }()
+		}
+		s.depth++
+		defer func() { s.depth-- }()
+		if p != nil {
+			return C.duk_ret_t(p.callGo(s, id))
+		}
 		return C.duk_ret_t(s.Call(id))
 	}
 
@@ -0,0 +1,64 @@
+package duktape
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaxMemory(t *testing.T) {
+
+	ctx, err := NewWithOptions(Options{MaxMemory: 1 << 20})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ctx.DestroyHeap()
+
+	err = ctx.PevalString(`var a = []; for (;;) { a.push(new Array(1000).join("x") + a.length); }`)
+	ctx.Pop()
+
+	if err == nil || !strings.Contains(err.Error(), "alloc failed") {
+		t.Fatalf("got %v", err)
+	}
+
+	stats := ctx.MemoryStats()
+
+	if stats.MaxMemory != 1<<20 || stats.PeakBytes > stats.MaxMemory || stats.Bytes > stats.PeakBytes || stats.Allocations == 0 {
+		t.Errorf("got %+v", stats)
+	}
+
+	// The memory is back once the script is gone.
+
+	if got := evalString(t, ctx, `a = null; Duktape.gc(); "ok"`); got != "ok" {
+		t.Errorf("got %q", got)
+	}
+
+	if after := ctx.MemoryStats(); after.Bytes >= stats.Bytes {
+		t.Errorf("got %d bytes, was %d", after.Bytes, stats.Bytes)
+	}
+}
+
+func TestMemoryStatsConcurrent(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if l.Context().MemoryStats().Bytes <= 0 {
+				t.Error("no memory in use")
+				return
+			}
+		}
+	}()
+
+	if err := l.RunString(`for (var i = 0, a = []; i < 10000; i++) { a.push({i: i}); }`); err != nil {
+		t.Error(err)
+	}
+
+	<-done
+}
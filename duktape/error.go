@@ -0,0 +1,69 @@
+package duktape
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// goErrorKey names the hidden property (Duktape hides the names starting
+// with 0xFF from scripts) through which an Error carries its Go error.
+const goErrorKey = "\xffkkGoError"
+
+var errorCodes = map[string]int{
+	"Error":          ErrError,
+	"EvalError":      ErrEval,
+	"RangeError":     ErrRange,
+	"ReferenceError": ErrReference,
+	"SyntaxError":    ErrSyntax,
+	"TypeError":      ErrType,
+	"URIError":       ErrURI,
+}
+
+var packagePath = reflect.TypeOf(Error{}).PkgPath()
+
+// PushGoError pushes a JavaScript Error for err. When the Error is thrown
+// back to Go, through scripts catching and rethrowing it or not, the failing
+// call returns an *Error whose Err is err, so errors.Is and errors.As see
+// through it. An *Error keeps its type and message.
+func (d *Context) PushGoError(err error) {
+
+	code := ErrError
+	message := err.Error()
+
+	if e, ok := err.(*Error); ok && e.Type != "" {
+		if c, ok := errorCodes[e.Type]; ok {
+			code = c
+		}
+		message = e.Message
+	}
+
+	d.PushErrorObject(code, "%s", message)
+	d.PushGoObject(err)
+	d.PutPropString(-2, goErrorKey)
+}
+
+func (d *Context) getGoError(idx int) error {
+	idx = d.NormalizeIndex(idx)
+	d.GetPropString(idx, goErrorKey)
+	err, _ := d.ToGoObject(-1).(error)
+	d.Pop()
+	return err
+}
+
+// callerLocation returns the first caller outside of this package.
+func callerLocation() (string, int) {
+
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, packagePath+".") && !strings.HasPrefix(frame.Function, "runtime.") {
+			return frame.File, frame.Line
+		}
+		if !more {
+			return "", 0
+		}
+	}
+}
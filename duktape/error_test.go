@@ -0,0 +1,87 @@
+package duktape
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestErrorFields(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.PushString("script.js")
+
+	if err := ctx.PcompileLstringFilename(0, "var a = 1;\nnull.x;", 18); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ctx.castStringToError(ctx.Pcall(0))
+	ctx.Pop()
+
+	var e *Error
+
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v", err)
+	}
+
+	if e.Type != "TypeError" || e.FileName != "script.js" || e.LineNumber != 2 || !strings.Contains(e.Stack, "script.js:2") {
+		t.Errorf("got %#v", e)
+	}
+
+	// The tests are in the package, so the caller is the testing package.
+
+	if e.GoFileName == "" || e.GoLineNumber == 0 {
+		t.Errorf("got Go location %s:%d", e.GoFileName, e.GoLineNumber)
+	}
+
+	if e.Error() != "TypeError: "+e.Message {
+		t.Errorf("got %q", e.Error())
+	}
+}
+
+func TestErrorValue(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	err := ctx.PevalString(`throw {code: 3}`)
+	ctx.Pop()
+
+	e, ok := err.(*Error)
+
+	if !ok || e.Type != "" || e.Value.(map[string]interface{})["code"] != 3.0 {
+		t.Errorf("got %#v", err)
+	}
+}
+
+func TestPushGoError(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.PushGlobalGoFunction("fail", func() int {
+		ctx.PushGoError(io.ErrUnexpectedEOF)
+		return retThrow
+	})
+
+	ctx.PushGlobalGoFunction("failType", func() int {
+		ctx.PushGoError(&Error{Type: "RangeError", Message: "too far"})
+		return retThrow
+	})
+
+	// The Go error survives scripts catching and rethrowing it.
+
+	err := ctx.PevalString(`try { fail(); } catch (e) { e.extra = 1; throw e; }`)
+	ctx.Pop()
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v", err)
+	}
+
+	if got := evalString(t, ctx, `try { failType(); } catch (e) { (e instanceof RangeError) + " " + e.message }`); got != "true too far" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,312 @@
+package duktape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	xhttp "net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hailongz/kk-lib/http"
+)
+
+const fetchKey = "kk.fetch"
+
+var ErrNoLoop = errors.New("duktape: the context has no event loop")
+
+// DefaultFetchMaxBodySize is the size limit of response bodies when
+// FetchOptions.MaxBodySize is 0.
+const DefaultFetchMaxBodySize = 16 << 20
+
+// FetchOptions configures the fetch function installed by EnableFetch.
+type FetchOptions struct {
+	// Hosts lists the hosts scripts may fetch from, see HostAllowed. A nil
+	// list allows every host.
+	Hosts []string
+	// Timeout bounds every request, body included. 0 means no limit.
+	Timeout time.Duration
+	// Client sends the requests, a client of the http package when nil.
+	Client *xhttp.Client
+	// MaxBodySize bounds the size of response bodies, beyond which fetch is
+	// rejected. 0 means DefaultFetchMaxBodySize and a negative size no limit.
+	MaxBodySize int64
+}
+
+type fetcher struct {
+	loop    *Loop
+	options FetchOptions
+	client  *xhttp.Client
+	autoId  int
+}
+
+// EnableFetch installs fetch(url, {method, headers, body}) along with the
+// Headers and Response classes. fetch returns a Promise of a Response with
+// url, status, statusText, ok, headers, text(), json() and arrayBuffer();
+// it is rejected with a TypeError when the request fails, the host is not
+// allowed or the body is larger than MaxBodySize. Requests run on their own goroutine and complete on the event
+// loop of the context, which must have one (see NewLoop).
+func (d *Context) EnableFetch(options FetchOptions) error {
+
+	if d.loop == nil {
+		return ErrNoLoop
+	}
+
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = DefaultFetchMaxBodySize
+	}
+
+	f := &fetcher{loop: d.loop, options: options, client: options.Client}
+
+	if options.Hosts != nil {
+		f.client = restrictedClient(options.Client, options.Hosts)
+	}
+
+	d.PushGlobalStash()
+	d.PushObject()
+	d.PutPropString(-2, fetchKey)
+	d.Pop()
+
+	if err := d.PevalString(fetchSource); err != nil {
+		d.Pop()
+		return err
+	}
+
+	d.PushGoFunction(f.request)
+	d.PushGoFunc(func(b []byte) string {
+		return string(b)
+	})
+
+	if err := d.castStringToError(d.Pcall(2)); err != nil {
+		d.Pop()
+		return err
+	}
+
+	d.PushGlobalObject()
+
+	for _, name := range []string{"fetch", "Headers", "Response"} {
+		d.GetPropString(-2, name)
+		d.PutPropString(-2, name)
+	}
+
+	d.Pop2()
+
+	d.markHostGlobals("fetch", "Headers", "Response")
+
+	return nil
+}
+
+// FetchCapability grants a sandbox fetch, see EnableFetch. It must come
+// after TimersCapability, which provides the event loop.
+func FetchCapability(options FetchOptions) Capability {
+	return func(ctx *Context) error {
+		return ctx.EnableFetch(options)
+	}
+}
+
+func (f *fetcher) pushCallbacks() {
+	d := f.loop.ctx
+	d.PushGlobalStash()
+	d.GetPropString(-1, fetchKey)
+	d.Remove(-2)
+}
+
+// request(url, method, headers, body, callback) starts a request and calls
+// callback(error, response) once done.
+func (f *fetcher) request() int {
+
+	d := f.loop.ctx
+
+	options := http.Options{
+		Url:         d.SafeToString(0),
+		Method:      d.SafeToString(1),
+		Headers:     map[string]string{},
+		Client:      f.client,
+		MaxBodySize: f.options.MaxBodySize,
+	}
+
+	if m, ok := d.ToValue(2).(map[string]interface{}); ok {
+		for key, value := range m {
+			options.Headers[key] = fmt.Sprint(value)
+		}
+	}
+
+	switch body := d.ToValue(3).(type) {
+	case string:
+		options.Data = body
+		options.Type = "text/plain;charset=UTF-8"
+	case []byte:
+		options.Data = body
+	}
+
+	f.autoId = f.autoId + 1
+	id := strconv.Itoa(f.autoId)
+
+	f.pushCallbacks()
+	d.Dup(4)
+	d.PutPropString(-2, id)
+	d.Pop()
+
+	f.loop.add(1)
+
+	go func() {
+
+		defer f.loop.add(-1)
+
+		var res *http.Response
+		var err error
+
+		if f.options.Hosts != nil && !HostAllowed(options.Url, f.options.Hosts) {
+			err = fmt.Errorf("%s: %s", options.Url, ErrHostNotAllowed)
+		} else {
+			ctx := context.Background()
+			if f.options.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, f.options.Timeout)
+				defer cancel()
+			}
+			res, err = http.Do(ctx, &options)
+		}
+
+		f.loop.Post(func(ctx *Context) {
+			f.complete(id, res, err)
+		})
+	}()
+
+	return 0
+}
+
+func (f *fetcher) complete(id string, res *http.Response, err error) {
+
+	d := f.loop.ctx
+
+	f.pushCallbacks()
+	d.GetPropString(-1, id)
+	d.DelPropString(-2, id)
+	d.Remove(-2)
+
+	if err != nil {
+		d.PushString(err.Error())
+		d.PushNull()
+	} else {
+		headers := map[string]string{}
+		for key, values := range res.Headers {
+			headers[strings.ToLower(key)] = strings.Join(values, ", ")
+		}
+		d.PushNull()
+		d.PushValue(map[string]interface{}{
+			"url":        res.Url,
+			"status":     res.StatusCode,
+			"statusText": res.Status,
+			"headers":    headers,
+			"body":       res.Body,
+		})
+	}
+
+	if err := d.castStringToError(d.Pcall(2)); err != nil {
+		f.loop.report(err)
+	}
+
+	d.Pop()
+}
+
+const fetchSource = `(function (request, decode) {
+
+	var Headers = function (init) {
+		Object.defineProperty(this, '_map', { value: {} });
+		if (init instanceof Headers) {
+			init.forEach(function (v, k) { this.set(k, v); }, this);
+		} else if (init) {
+			Object.keys(init).forEach(function (k) { this.set(k, init[k]); }, this);
+		}
+	};
+
+	Headers.prototype.get = function (name) {
+		var k = String(name).toLowerCase();
+		return Object.prototype.hasOwnProperty.call(this._map, k) ? this._map[k] : null;
+	};
+
+	Headers.prototype.has = function (name) {
+		return Object.prototype.hasOwnProperty.call(this._map, String(name).toLowerCase());
+	};
+
+	Headers.prototype.set = function (name, value) {
+		this._map[String(name).toLowerCase()] = String(value);
+	};
+
+	Headers.prototype['delete'] = function (name) {
+		delete this._map[String(name).toLowerCase()];
+	};
+
+	Headers.prototype.keys = function () {
+		return Object.keys(this._map).sort();
+	};
+
+	Headers.prototype.forEach = function (fn, thisArg) {
+		this.keys().forEach(function (k) { fn.call(thisArg, this._map[k], k, this); }, this);
+	};
+
+	var Response = function (res) {
+		this.url = res.url;
+		this.status = res.status;
+		this.statusText = res.statusText;
+		this.ok = res.status >= 200 && res.status < 300;
+		this.headers = new Headers(res.headers);
+		this.bodyUsed = false;
+		Object.defineProperty(this, '_body', { value: res.body, writable: true });
+	};
+
+	var consume = function (r) {
+		if (r.bodyUsed) {
+			return Promise.reject(new TypeError('body used already'));
+		}
+		var b = r._body;
+		r.bodyUsed = true;
+		r._body = null;
+		return Promise.resolve(b);
+	};
+
+	Response.prototype.text = function () {
+		return consume(this).then(decode);
+	};
+
+	Response.prototype.json = function () {
+		return this.text().then(JSON.parse);
+	};
+
+	Response.prototype.arrayBuffer = function () {
+		return consume(this).then(function (b) { return new Uint8Array(b).buffer; });
+	};
+
+	var fetch = function (url, init) {
+
+		init = init || {};
+
+		var headers = new Headers(init.headers);
+		var body = init.body;
+		var h = {};
+
+		headers.forEach(function (v, k) { h[k] = v; });
+
+		if (body === undefined || body === null) {
+			body = null;
+		} else if (body instanceof ArrayBuffer) {
+			body = new Uint8Array(body);
+		} else if (!ArrayBuffer.isView(body)) {
+			body = String(body);
+		}
+
+		return new Promise(function (resolve, reject) {
+			request(String(url), String(init.method || 'GET').toUpperCase(), h, body, function (err, res) {
+				if (err) {
+					reject(new TypeError('fetch failed: ' + err));
+				} else {
+					resolve(new Response(res));
+				}
+			});
+		});
+	};
+
+	return { fetch: fetch, Headers: Headers, Response: Response };
+})`
@@ -0,0 +1,138 @@
+package duktape
+
+import (
+	"fmt"
+	"io"
+	xhttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFetchLoop(t *testing.T, options FetchOptions) *Loop {
+
+	l := NewLoop(New(), nil)
+
+	if err := l.Context().EnableFetch(options); err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+func TestFetch(t *testing.T) {
+
+	server := httptest.NewServer(xhttp.HandlerFunc(func(w xhttp.ResponseWriter, r *xhttp.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"a": [1, 2]}`)
+		case "/echo":
+			b, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("X-Name"), b)
+		default:
+			xhttp.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	l := newFetchLoop(t, FetchOptions{})
+	defer destroyLoop(l)
+
+	err := l.RunString(fmt.Sprintf(`var out = [];
+		fetch(%q).then(function (r) {
+			out.push(r.status, r.ok, r.headers.get("Content-Type"));
+			return r.json();
+		}).then(function (v) {
+			out.push(v.a.join("+"));
+			return fetch(%q, {method: "POST", headers: {"X-Name": "js"}, body: "data"});
+		}).then(function (r) {
+			return r.text();
+		}).then(function (s) {
+			out.push(s);
+			return fetch(%q);
+		}).then(function (r) {
+			out.push(r.status, r.ok);
+		});`, server.URL+"/json", server.URL+"/echo", server.URL+"/missing"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loopString(t, l, `out.join()`); got != "200,true,application/json,1+2,POST js data,404,false" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+
+	server := httptest.NewServer(xhttp.HandlerFunc(func(w xhttp.ResponseWriter, r *xhttp.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	l := newFetchLoop(t, FetchOptions{
+		Hosts:   []string{strings.TrimPrefix(server.URL, "http://")},
+		Timeout: 20 * time.Millisecond,
+	})
+	defer destroyLoop(l)
+
+	err := l.RunString(fmt.Sprintf(`var out = [];
+		fetch("http://example.com/").catch(function (e) {
+			out.push(e.name + " " + /not allowed/.test(e.message));
+		});
+		fetch(%q).catch(function (e) {
+			out.push(e.name);
+		});`, server.URL))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loopString(t, l, `out.sort().join()`); got != "TypeError,TypeError true" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestFetchMaxBodySize(t *testing.T) {
+
+	server := httptest.NewServer(xhttp.HandlerFunc(func(w xhttp.ResponseWriter, r *xhttp.Request) {
+		fmt.Fprint(w, strings.Repeat("x", 64))
+	}))
+	defer server.Close()
+
+	for size, want := range map[int64]string{64: "64", 63: "TypeError true", -1: "64"} {
+
+		l := newFetchLoop(t, FetchOptions{MaxBodySize: size})
+
+		err := l.RunString(fmt.Sprintf(`var out;
+			fetch(%q).then(function (r) {
+				return r.text();
+			}).then(function (s) {
+				out = s.length;
+			}, function (e) {
+				out = e.name + " " + /too large/.test(e.message);
+			});`, server.URL))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := loopString(t, l, `String(out)`); got != want {
+			t.Errorf("%d: got %q, want %q", size, got, want)
+		}
+
+		destroyLoop(l)
+	}
+}
+
+func TestFetchNoLoop(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	if err := ctx.EnableFetch(FetchOptions{}); err != ErrNoLoop {
+		t.Errorf("got %v", err)
+	}
+}
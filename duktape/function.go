@@ -0,0 +1,148 @@
+package duktape
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// PushGlobalGoFunc registers fn as a global function, see PushGoFunc.
+func (d *Context) PushGlobalGoFunc(key string, fn interface{}) {
+	d.PushGlobalObject()
+	d.PushGoFunc(fn)
+	d.setFunctionName(-1, key)
+	d.PutPropString(-2, key)
+	d.Pop()
+	d.markHostGlobals(key)
+}
+
+// PushGoFunc pushes a JavaScript function that calls fn, which may be any Go
+// function. Arguments are converted to the parameter types of fn, missing
+// trailing arguments are passed as zero values and variadic parameters
+// collect the remaining arguments. A non-nil error returned as the last
+// result is thrown with PushGoError, any other results are pushed with
+// PushValue (several results are returned as an array).
+func (d *Context) PushGoFunc(fn interface{}) {
+
+	v := reflect.ValueOf(fn)
+
+	if v.Kind() != reflect.Func {
+		panic(fmt.Sprintf("duktape: PushGoFunc expects a function, got %T", fn))
+	}
+
+	d.PushGoFunction(func() int {
+		return d.callGoFunc(v)
+	})
+}
+
+func (d *Context) callGoFunc(fn reflect.Value) (ret int) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			d.SetTop(0)
+			if err, ok := r.(error); ok {
+				d.PushGoError(err)
+			} else {
+				d.PushErrorObject(ErrError, "%s", fmt.Sprint(r))
+			}
+			ret = retThrow
+		}
+	}()
+
+	args, err := d.goFuncArgs(fn.Type(), 0)
+
+	if err != nil {
+		d.SetTop(0)
+		d.PushErrorObject(ErrType, "%s", err.Error())
+		return retThrow
+	}
+
+	rs, err := goFuncResults(fn.Type(), fn.Call(args))
+
+	if err != nil {
+		d.SetTop(0)
+		d.PushGoError(err)
+		return retThrow
+	}
+
+	return d.pushGoFuncResults(rs)
+}
+
+// goFuncArgs converts the arguments of the call to the parameter types of a
+// function of type t. The first skip parameters are not passed by the call,
+// they are left to the caller as zero values.
+func (d *Context) goFuncArgs(t reflect.Type, skip int) ([]reflect.Value, error) {
+
+	nargs := d.GetTop() + skip
+	nin := t.NumIn()
+
+	if t.IsVariadic() {
+		nin = nin - 1
+	}
+
+	args := make([]reflect.Value, 0, nargs)
+
+	for i := 0; i < skip; i++ {
+		args = append(args, reflect.Zero(t.In(i)))
+	}
+
+	for i := skip; i < nin || (t.IsVariadic() && i < nargs); i++ {
+
+		var at reflect.Type
+
+		if i < nin {
+			at = t.In(i)
+		} else {
+			at = t.In(nin).Elem()
+		}
+
+		var value interface{}
+
+		if i < nargs {
+			value = d.ToValue(i - skip)
+		}
+
+		av, err := convertValue(value, at)
+
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %s", i-skip+1, err.Error())
+		}
+
+		args = append(args, av)
+	}
+
+	return args, nil
+}
+
+// goFuncResults splits the results of a function of type t from its
+// trailing error, if any.
+func goFuncResults(t reflect.Type, rs []reflect.Value) ([]reflect.Value, error) {
+	if n := len(rs); n > 0 && t.Out(n-1) == errorType {
+		if err, _ := rs[n-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		rs = rs[0 : n-1]
+	}
+	return rs, nil
+}
+
+// pushGoFuncResults pushes the results of a function, nothing when there
+// are none, and returns the number of values pushed.
+func (d *Context) pushGoFuncResults(rs []reflect.Value) int {
+
+	switch len(rs) {
+	case 0:
+		return 0
+	case 1:
+		d.PushValue(rs[0].Interface())
+	default:
+		d.PushArray()
+		for i, r := range rs {
+			d.PushValue(r.Interface())
+			d.PutPropIndex(-2, uint(i))
+		}
+	}
+
+	return 1
+}
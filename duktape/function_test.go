@@ -0,0 +1,85 @@
+package duktape
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func evalString(t *testing.T, ctx *Context, src string) string {
+	t.Helper()
+	defer ctx.Pop()
+	if err := ctx.PevalString(src); err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return ctx.SafeToString(-1)
+}
+
+func TestPushGoFuncArguments(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.PushGlobalGoFunc("add", func(a, b int) int { return a + b })
+	ctx.PushGlobalGoFunc("count", func(prefix string, rest ...interface{}) string {
+		return prefix + strings.Repeat("*", len(rest))
+	})
+	ctx.PushGlobalGoFunc("pair", func() (string, int) { return "a", 1 })
+
+	for src, want := range map[string]string{
+		`add(3, 4)`:        "7",
+		`add("3", " 4 ")`:  "7",
+		`add(3)`:           "3",
+		`count("n")`:       "n",
+		`count("n", 1, 2)`: "n**",
+		`pair().join(",")`: "a,1",
+		`typeof add(1, 2)`: "number",
+	} {
+		if got := evalString(t, ctx, src); got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestPushGoFuncTypeError(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.PushGlobalGoFunc("add", func(a, b int) int { return a + b })
+
+	for _, src := range []string{`add("abc", 1)`, `add(1, [2])`} {
+
+		err := ctx.PevalString(src)
+		ctx.Pop()
+
+		var e *Error
+
+		if !errors.As(err, &e) || e.Type != "TypeError" {
+			t.Errorf("%s: got %v, want a TypeError", src, err)
+		}
+	}
+}
+
+func TestPushGoFuncError(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	failed := errors.New("failed")
+
+	ctx.PushGlobalGoFunc("fail", func() error { return failed })
+
+	err := ctx.PevalString(`fail()`)
+	ctx.Pop()
+
+	if !errors.Is(err, failed) {
+		t.Errorf("got %v, want %v", err, failed)
+	}
+
+	got := evalString(t, ctx, `try { fail(); } catch (e) { e.message }`)
+
+	if got != "failed" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,140 @@
+package duktape
+
+/*
+#include "duk_config.h"
+#include "duktape.h"
+#include "kk.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Error types reported for scripts stopped by Interrupt or a deadline.
+const (
+	ErrorTypeInterrupted = "InterruptedError"
+	ErrorTypeTimeout     = "TimeoutError"
+)
+
+// The Err of the errors reported for scripts stopped by Interrupt or a
+// deadline, for use with errors.Is.
+var (
+	ErrInterrupted = errors.New("execution interrupted")
+	ErrTimeout     = errors.New("execution timeout")
+)
+
+// Interrupt makes the running script (or the next one) throw. The failing
+// protected call returns an *Error of type ErrorTypeInterrupted. It may be
+// called from any goroutine.
+func (d *Context) Interrupt() {
+	d.setInterrupt(C.KK_INTERRUPT_REQUESTED)
+}
+
+// SetDeadline makes scripts still running at t throw. The failing protected
+// call returns an *Error of type ErrorTypeTimeout. A zero t removes the
+// deadline.
+func (d *Context) SetDeadline(t time.Time) {
+
+	d.s.lock.Lock()
+	defer d.s.lock.Unlock()
+
+	if d.deadline != nil {
+		d.deadline.Stop()
+		d.deadline = nil
+	}
+
+	if d.heap == nil {
+		return
+	}
+
+	if d.heap.interrupt == C.KK_INTERRUPT_TIMEOUT {
+		d.heap.interrupt = C.KK_INTERRUPT_NONE
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	if dt := time.Until(t); dt > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(dt, func() {
+			d.s.lock.Lock()
+			defer d.s.lock.Unlock()
+			// The deadline may have been replaced while the timer fired.
+			if d.deadline == timer {
+				d.setInterruptLocked(C.KK_INTERRUPT_TIMEOUT)
+			}
+		})
+		d.deadline = timer
+	} else {
+		d.setInterruptLocked(C.KK_INTERRUPT_TIMEOUT)
+	}
+}
+
+// PevalStringContext is PevalString bounded by ctx: the script is stopped
+// when ctx is done, with an ErrorTypeTimeout error if its deadline passed
+// and an ErrorTypeInterrupted error if it was canceled.
+func (d *Context) PevalStringContext(ctx context.Context, src string) error {
+
+	var wg sync.WaitGroup
+
+	done := make(chan bool)
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				d.setInterrupt(C.KK_INTERRUPT_TIMEOUT)
+			} else {
+				d.setInterrupt(C.KK_INTERRUPT_REQUESTED)
+			}
+		case <-done:
+		}
+	}()
+
+	err := d.PevalString(src)
+
+	close(done)
+	wg.Wait()
+
+	d.takeInterrupt()
+
+	return err
+}
+
+// setInterrupt may be called from any goroutine, the lock of the scope keeps
+// the heap from being freed meanwhile.
+func (d *Context) setInterrupt(kind C.int) {
+	d.s.lock.Lock()
+	defer d.s.lock.Unlock()
+	d.setInterruptLocked(kind)
+}
+
+// setInterruptLocked is setInterrupt with the lock of the scope held.
+func (d *Context) setInterruptLocked(kind C.int) {
+	if d.heap != nil {
+		d.heap.interrupt = kind
+	}
+}
+
+// takeInterrupt returns the pending interruption. It is cleared once control
+// is back at the outermost call, as Duktape keeps throwing until then.
+func (d *Context) takeInterrupt() C.int {
+	d.s.lock.Lock()
+	defer d.s.lock.Unlock()
+	if d.heap == nil {
+		return C.KK_INTERRUPT_NONE
+	}
+	kind := d.heap.interrupt
+	if d.s.depth == 0 {
+		d.heap.interrupt = C.KK_INTERRUPT_NONE
+	}
+	return kind
+}
@@ -0,0 +1,117 @@
+package duktape
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const spinSource = `for (;;) { try { while (true) {} } catch (e) {} }`
+
+func TestInterrupt(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	time.AfterFunc(10*time.Millisecond, ctx.Interrupt)
+
+	err := ctx.PevalString(spinSource)
+	ctx.Pop()
+
+	var e *Error
+
+	if !errors.As(err, &e) || e.Type != ErrorTypeInterrupted || !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("got %v", err)
+	}
+
+	// The context is usable again.
+
+	if got := evalString(t, ctx, `1 + 1`); got != "2" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.SetDeadline(time.Now().Add(10 * time.Millisecond))
+
+	err := ctx.PevalString(spinSource)
+	ctx.Pop()
+
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v", err)
+	}
+
+	ctx.SetDeadline(time.Time{})
+
+	if got := evalString(t, ctx, `"ok"`); got != "ok" {
+		t.Errorf("got %q", got)
+	}
+
+	// A deadline already passed stops the next script.
+
+	ctx.SetDeadline(time.Now().Add(-time.Second))
+
+	err = ctx.PevalString(spinSource)
+	ctx.Pop()
+
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v", err)
+	}
+
+	ctx.SetDeadline(time.Time{})
+}
+
+func TestSetDeadlineConcurrent(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	// Deadlines replaced while their timers fire never interrupt the
+	// scripts run afterwards.
+
+	for i := 0; i < 100; i++ {
+		ctx.SetDeadline(time.Now().Add(time.Microsecond))
+		time.Sleep(time.Duration(i%2) * time.Microsecond)
+		ctx.SetDeadline(time.Time{})
+		if got := evalString(t, ctx, `"ok"`); got != "ok" {
+			t.Fatalf("got %q", got)
+		}
+	}
+}
+
+func TestPevalStringContext(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := ctx.PevalStringContext(c, spinSource)
+	ctx.Pop()
+
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v", err)
+	}
+
+	c, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err = ctx.PevalStringContext(c, spinSource)
+	ctx.Pop()
+
+	if !errors.Is(err, ErrInterrupted) {
+		t.Errorf("got %v", err)
+	}
+
+	if err := ctx.PevalStringContext(context.Background(), `1`); err != nil {
+		t.Errorf("got %v", err)
+	}
+
+	ctx.Pop()
+}
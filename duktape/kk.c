@@ -11,3 +11,219 @@ struct kk_ptr * kk_to_ptr(struct duk_hthread *ctx,duk_idx_t idx) {
 	return (struct kk_ptr *) duk_to_buffer(ctx,idx,&n);
 }
 
+
+extern duk_ret_t goFunctionCall(struct duk_hthread *ctx);
+
+/*
+ * goFunctionCall cannot throw by itself (duk_throw longjmps over Go frames),
+ * so it leaves the error on the stack and returns KK_RET_THROW instead.
+ */
+duk_ret_t kk_function_call(struct duk_hthread *ctx) {
+	duk_ret_t r = goFunctionCall(ctx);
+	if(r == KK_RET_THROW) {
+		return duk_throw(ctx);
+	}
+	return r;
+}
+
+/*
+ * Called by the executor interrupt, which must not call the API: pending
+ * profiler samples are only recorded, the profiler reads them from Go.
+ */
+duk_bool_t kk_exec_timeout_check(void *udata) {
+	struct kk_heap * heap = (struct kk_heap *) udata;
+	if(heap == NULL) {
+		return 0;
+	}
+	if(heap->samples != 0) {
+		kk_profile_record(heap);
+	}
+	return heap->interrupt != KK_INTERRUPT_NONE;
+}
+
+/* Bounds the stacks recorded between two reads of the profiler. */
+#define KK_PROFILE_MAX (16 * 1024 * 1024)
+
+/* "count length\n" before each stack, fixed width. */
+#define KK_PROFILE_HEADER 22
+
+/*
+ * Takes the pending samples with the call stack of the running thread,
+ * appended to heap->profile as a header and the stack.
+ */
+void kk_profile_record(struct kk_heap *heap) {
+	char header[KK_PROFILE_HEADER + 1];
+	size_t avail, len, cap;
+	char *p;
+	int count = __atomic_exchange_n(&heap->samples, 0, __ATOMIC_SEQ_CST);
+	if(count <= 0 || heap->ctx == NULL) {
+		return;
+	}
+	for(;;) {
+		avail = heap->profile_cap - heap->profile_len;
+		len = 256;
+		if(avail > KK_PROFILE_HEADER) {
+			p = heap->profile + heap->profile_len;
+			len = kk_callstack(heap->ctx, p + KK_PROFILE_HEADER, avail - KK_PROFILE_HEADER, heap->profile_lines);
+			if(len <= avail - KK_PROFILE_HEADER) {
+				snprintf(header, sizeof(header), "%10d %10lu\n", count, (unsigned long) len);
+				memcpy(p, header, KK_PROFILE_HEADER);
+				heap->profile_len = heap->profile_len + KK_PROFILE_HEADER + len;
+				return;
+			}
+		}
+		cap = heap->profile_cap * 2;
+		if(cap < heap->profile_len + KK_PROFILE_HEADER + len) {
+			cap = heap->profile_len + KK_PROFILE_HEADER + len;
+		}
+		if(cap > KK_PROFILE_MAX) {
+			return;
+		}
+		p = (char *) realloc(heap->profile, cap);
+		if(p == NULL) {
+			return;
+		}
+		heap->profile = p;
+		heap->profile_cap = cap;
+	}
+}
+
+/*
+ * Every allocation is prefixed with its size so that the memory in use by a
+ * heap can be tracked and capped at max_memory (0 means no limit).
+ */
+#define KK_ALLOC_HEADER 16
+
+/*
+ * The counters are only written by the allocator, on the thread running the
+ * heap, but stored atomically as kk_memory_stats may read them from others.
+ */
+static void kk_count_memory(struct kk_heap *heap, size_t old, size_t size, int alloc) {
+	size_t memory = heap->memory - old + size;
+	__atomic_store_n(&heap->memory, memory, __ATOMIC_RELAXED);
+	if(alloc) {
+		__atomic_store_n(&heap->allocs, heap->allocs + 1, __ATOMIC_RELAXED);
+	}
+	if(memory > heap->peak_memory) {
+		__atomic_store_n(&heap->peak_memory, memory, __ATOMIC_RELAXED);
+	}
+}
+
+void kk_memory_stats(struct kk_heap *heap, size_t *memory, size_t *peak_memory, size_t *allocs) {
+	*memory = __atomic_load_n(&heap->memory, __ATOMIC_RELAXED);
+	*peak_memory = __atomic_load_n(&heap->peak_memory, __ATOMIC_RELAXED);
+	*allocs = __atomic_load_n(&heap->allocs, __ATOMIC_RELAXED);
+}
+
+static void * kk_alloc(void *udata, duk_size_t size) {
+	struct kk_heap * heap = (struct kk_heap *) udata;
+	char * p;
+	if(heap->max_memory != 0 && heap->memory + size > heap->max_memory) {
+		return NULL;
+	}
+	p = (char *) malloc(size + KK_ALLOC_HEADER);
+	if(p == NULL) {
+		return NULL;
+	}
+	*((size_t *) p) = size;
+	kk_count_memory(heap, 0, size, 1);
+	return p + KK_ALLOC_HEADER;
+}
+
+static void kk_free(void *udata, void *ptr) {
+	struct kk_heap * heap = (struct kk_heap *) udata;
+	char * p;
+	if(ptr == NULL) {
+		return;
+	}
+	p = ((char *) ptr) - KK_ALLOC_HEADER;
+	kk_count_memory(heap, *((size_t *) p), 0, 0);
+	free(p);
+}
+
+static void * kk_realloc(void *udata, void *ptr, duk_size_t size) {
+	struct kk_heap * heap = (struct kk_heap *) udata;
+	char * p;
+	size_t old;
+	if(ptr == NULL) {
+		return kk_alloc(udata, size);
+	}
+	if(size == 0) {
+		kk_free(udata, ptr);
+		return NULL;
+	}
+	p = ((char *) ptr) - KK_ALLOC_HEADER;
+	old = *((size_t *) p);
+	if(heap->max_memory != 0 && size > old && heap->memory + (size - old) > heap->max_memory) {
+		return NULL;
+	}
+	p = (char *) realloc(p, size + KK_ALLOC_HEADER);
+	if(p == NULL) {
+		return NULL;
+	}
+	*((size_t *) p) = size;
+	kk_count_memory(heap, old, size, 1);
+	return p + KK_ALLOC_HEADER;
+}
+
+struct duk_hthread * kk_create_heap(struct kk_heap * heap) {
+	heap->ctx = duk_create_heap(kk_alloc, kk_realloc, kk_free, heap, NULL);
+	return heap->ctx;
+}
+
+static duk_ret_t kk_dump_function_raw(struct duk_hthread *ctx, void *udata) {
+	duk_dump_function(ctx);
+	return 1;
+}
+
+static duk_ret_t kk_load_function_raw(struct duk_hthread *ctx, void *udata) {
+	duk_load_function(ctx);
+	return 1;
+}
+
+/*
+ * Protected duk_dump_function and duk_load_function: on failure the error
+ * replaces the argument instead of being thrown at the Go caller.
+ */
+duk_int_t kk_pdump_function(struct duk_hthread *ctx) {
+	return duk_safe_call(ctx, kk_dump_function_raw, NULL, 1, 1);
+}
+
+duk_int_t kk_pload_function(struct duk_hthread *ctx) {
+	return duk_safe_call(ctx, kk_load_function_raw, NULL, 1, 1);
+}
+
+extern duk_size_t goDebugRead(int id, char *buffer, duk_size_t length);
+extern duk_size_t goDebugWrite(int id, char *buffer, duk_size_t length);
+extern duk_size_t goDebugPeek(int id);
+extern void goDebugWriteFlush(int id);
+extern void goDebugDetached(int id);
+
+/*
+ * The debugger callbacks forward to the Go transport registered under the
+ * id carried by udata.
+ */
+static duk_size_t kk_debug_read(void *udata, char *buffer, duk_size_t length) {
+	return goDebugRead((int) (intptr_t) udata, buffer, length);
+}
+
+static duk_size_t kk_debug_write(void *udata, const char *buffer, duk_size_t length) {
+	return goDebugWrite((int) (intptr_t) udata, (char *) buffer, length);
+}
+
+static duk_size_t kk_debug_peek(void *udata) {
+	return goDebugPeek((int) (intptr_t) udata);
+}
+
+static void kk_debug_write_flush(void *udata) {
+	goDebugWriteFlush((int) (intptr_t) udata);
+}
+
+static void kk_debug_detached(struct duk_hthread *ctx, void *udata) {
+	goDebugDetached((int) (intptr_t) udata);
+}
+
+void kk_debugger_attach(struct duk_hthread *ctx, int id) {
+	duk_debugger_attach(ctx, kk_debug_read, kk_debug_write, kk_debug_peek,
+		NULL, kk_debug_write_flush, NULL, kk_debug_detached, (void *) (intptr_t) id);
+}
@@ -1,8 +1,52 @@
+#ifndef KK_H
+#define KK_H
+
+
+#define KK_RET_THROW (-0x7fff)
+
+#define KK_INTERRUPT_NONE 0
+#define KK_INTERRUPT_REQUESTED 1
+#define KK_INTERRUPT_TIMEOUT 2
 
 struct kk_ptr {
 	void * ptr;
 };
 
+struct kk_heap {
+	volatile int interrupt;
+	/* samples counts the profiler ticks not sampled yet, see profiler.go */
+	volatile int samples;
+	size_t max_memory;
+	size_t memory;
+	size_t peak_memory;
+	size_t allocs;
+	struct duk_hthread *ctx;
+	/* profile holds the stacks sampled by kk_profile_record until the
+	 * profiler reads them, profile_lines adds the lines to the frames. */
+	char *profile;
+	size_t profile_len;
+	size_t profile_cap;
+	int profile_lines;
+};
+
 struct kk_ptr * kk_push_ptr(struct duk_hthread *ctx);
 struct kk_ptr * kk_to_ptr(struct duk_hthread *ctx,duk_idx_t idx);
 
+duk_ret_t kk_function_call(struct duk_hthread *ctx);
+
+struct duk_hthread * kk_create_heap(struct kk_heap * heap);
+
+void kk_memory_stats(struct kk_heap *heap, size_t *memory, size_t *peak_memory, size_t *allocs);
+
+duk_int_t kk_pdump_function(struct duk_hthread *ctx);
+duk_int_t kk_pload_function(struct duk_hthread *ctx);
+
+void kk_debugger_attach(struct duk_hthread *ctx, int id);
+
+/* Defined at the end of duktape.c, which has the internal structures. */
+duk_bool_t kk_is_global_function(struct duk_hthread *ctx, duk_idx_t idx);
+duk_size_t kk_callstack(struct duk_hthread *ctx, char *buf, duk_size_t size, duk_bool_t lines);
+
+void kk_profile_record(struct kk_heap *heap);
+
+#endif
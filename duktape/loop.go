@@ -0,0 +1,674 @@
+package duktape
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hailongz/kk-lib/dynamic"
+	"github.com/hailongz/kk-lib/kk"
+)
+
+const timersKey = "kk.timers"
+const runJobsKey = "kk.runJobs"
+
+type loopTimer struct {
+	timer  *time.Timer
+	delay  time.Duration
+	repeat bool
+}
+
+// Loop is an event loop running the scripts of a Context on the goroutine of
+// a kk.Dispatch. It provides setTimeout, setInterval, setImmediate (and their
+// clear functions), queueMicrotask and, when the heap has none, a Promise
+// implementation whose jobs run after every timer or posted callback.
+type Loop struct {
+	ctx      *Context
+	dispatch *kk.Dispatch
+	autoId   int
+	timers   map[int]*loopTimer
+	count    int
+	err      error
+	lock     sync.Mutex
+	idle     *sync.Cond
+	// async is the context of the async functions, see PushAsyncFunc.
+	async       context.Context
+	cancelAsync context.CancelFunc
+	// stopped is set with the lock held once the heap is destroyed, from
+	// then on nothing is sent to the dispatch. posts counts the sends in
+	// progress, which Close waits for before stopping the dispatch.
+	stopped bool
+	closed  bool
+	posts   sync.WaitGroup
+	// queue holds the callbacks to run on the loop, draining is set while
+	// a drain is sent to the dispatch or running, see schedule.
+	queue    []func()
+	draining bool
+	// owned is set when NewLoop created the dispatch.
+	owned   bool
+	OnError func(err error)
+}
+
+// NewLoop binds ctx to dispatch (a new one when nil) and installs the timer
+// globals. From then on the context must only be used from the dispatch
+// goroutine, e.g. through Post.
+func NewLoop(ctx *Context, dispatch *kk.Dispatch) *Loop {
+
+	owned := dispatch == nil
+
+	if owned {
+		dispatch = kk.NewDispatch()
+	}
+
+	l := &Loop{ctx: ctx, dispatch: dispatch, timers: map[int]*loopTimer{}, owned: owned}
+	l.idle = sync.NewCond(&l.lock)
+	l.async, l.cancelAsync = context.WithCancel(context.Background())
+
+	ctx.loop = l
+
+	ctx.PushGlobalStash()
+	ctx.PushObject()
+	ctx.PutPropString(-2, timersKey)
+	ctx.Pop()
+
+	ctx.PushGlobalObject()
+
+	for _, fn := range []struct {
+		name string
+		fn   func() int
+	}{
+		{"setTimeout", func() int { return l.setTimer(false, false) }},
+		{"setInterval", func() int { return l.setTimer(true, false) }},
+		{"setImmediate", func() int { return l.setTimer(false, true) }},
+		{"clearTimeout", l.clearTimer},
+		{"clearInterval", l.clearTimer},
+		{"clearImmediate", l.clearTimer},
+	} {
+		ctx.PushGoFunction(fn.fn)
+		ctx.setFunctionName(-1, fn.name)
+		ctx.PutPropString(-2, fn.name)
+	}
+
+	ctx.Pop()
+
+	ctx.PushGlobalStash()
+	ctx.PevalString(jobsSource)
+	ctx.PutPropString(-2, runJobsKey)
+	ctx.Pop()
+
+	ctx.markHostGlobals("setTimeout", "setInterval", "setImmediate",
+		"clearTimeout", "clearInterval", "clearImmediate", "queueMicrotask")
+
+	return l
+}
+
+// Loop returns the event loop bound to the context, if any.
+func (d *Context) Loop() *Loop {
+	return d.loop
+}
+
+// Context returns the context run by the loop.
+func (l *Loop) Context() *Context {
+	return l.ctx
+}
+
+// Dispatch returns the dispatch the loop runs on.
+func (l *Loop) Dispatch() *kk.Dispatch {
+	return l.dispatch
+}
+
+// Post schedules fn to run on the loop. It may be called from any goroutine.
+// fn is dropped once the heap is destroyed.
+func (l *Loop) Post(fn func(ctx *Context)) {
+	l.add(1)
+	if !l.schedule(func() {
+		defer l.add(-1)
+		if l.async.Err() != nil {
+			return
+		}
+		fn(l.ctx)
+		l.runJobs()
+	}) {
+		l.add(-1)
+	}
+}
+
+// Wait blocks until no timers or posted callbacks remain and returns the
+// first uncaught script error when OnError is not set. It must not be called
+// from the dispatch goroutine.
+func (l *Loop) Wait() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for l.count > 0 {
+		l.idle.Wait()
+	}
+	err := l.err
+	l.err = nil
+	return err
+}
+
+// Close stops the timers, destroys the heap and, when NewLoop created it,
+// stops the dispatch. It waits for the callback running on the loop, if
+// any, so it must not be called from the dispatch goroutine; a script that
+// never returns should be interrupted first, see Interrupt.
+func (l *Loop) Close() {
+
+	l.lock.Lock()
+	closed := l.closed
+	l.closed = true
+	l.lock.Unlock()
+
+	if closed {
+		return
+	}
+
+	l.dispatch.Sync(func() {
+		l.stop()
+		if l.ctx.heap != nil {
+			l.ctx.DestroyHeap()
+		}
+	})
+
+	// No send starts once the loop is stopped, those in progress must
+	// complete before the dispatch closes its channel.
+
+	l.posts.Wait()
+
+	if l.owned {
+		l.dispatch.Break()
+	}
+}
+
+// Run posts fn and waits until the loop is idle.
+func (l *Loop) Run(fn func(ctx *Context)) error {
+	l.Post(fn)
+	return l.Wait()
+}
+
+// RunString evaluates src on the loop and waits until the loop is idle.
+func (l *Loop) RunString(src string) error {
+	return l.Run(func(ctx *Context) {
+		if err := ctx.PevalString(src); err != nil {
+			l.report(err)
+		}
+		ctx.Pop()
+	})
+}
+
+func (l *Loop) add(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.count = l.count + n
+	if l.count <= 0 {
+		l.idle.Broadcast()
+	}
+}
+
+func (l *Loop) report(err error) {
+	if l.OnError != nil {
+		l.OnError(err)
+		return
+	}
+	l.lock.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.lock.Unlock()
+}
+
+// runJobs runs the pending microtasks, reporting the ones that throw.
+func (l *Loop) runJobs() {
+	d := l.ctx
+	for {
+		d.PushGlobalStash()
+		d.GetPropString(-1, runJobsKey)
+		err := d.castStringToError(d.Pcall(0))
+		d.Pop2()
+		if err == nil {
+			break
+		}
+		l.report(err)
+	}
+}
+
+func (l *Loop) pushTimers() {
+	l.ctx.PushGlobalStash()
+	l.ctx.GetPropString(-1, timersKey)
+	l.ctx.Remove(-2)
+}
+
+func (l *Loop) setTimer(repeat bool, immediate bool) int {
+
+	d := l.ctx
+
+	if !d.IsFunction(0) {
+		d.PushErrorObject(ErrType, "%s", "callback must be a function")
+		return retThrow
+	}
+
+	nargs := d.GetTop()
+	first := 2
+
+	delay := dynamic.FloatValue(d.ToValue(1), 0)
+
+	if immediate {
+		first = 1
+	}
+
+	if math.IsNaN(delay) || delay < 0 || immediate {
+		delay = 0
+	}
+
+	if repeat && delay < 1 {
+		delay = 1
+	}
+
+	l.autoId = l.autoId + 1
+	id := l.autoId
+
+	// The callback and its arguments are kept in the stash until the timer
+	// is done so that they stay reachable.
+
+	l.pushTimers()
+	d.PushArray()
+	d.Dup(0)
+	d.PutPropIndex(-2, 0)
+
+	for i := first; i < nargs; i++ {
+		d.Dup(i)
+		d.PutPropIndex(-2, uint(i-first+1))
+	}
+
+	d.PutPropString(-2, strconv.Itoa(id))
+	d.Pop()
+
+	t := &loopTimer{delay: time.Duration(delay * float64(time.Millisecond)), repeat: repeat}
+
+	l.timers[id] = t
+	l.add(1)
+
+	if immediate {
+		l.post(func() {
+			l.fire(id)
+		})
+	} else {
+		t.timer = time.AfterFunc(t.delay, func() {
+			l.post(func() {
+				l.fire(id)
+			})
+		})
+	}
+
+	d.PushInt(id)
+
+	return 1
+}
+
+func (l *Loop) clearTimer() int {
+
+	id := int(dynamic.IntValue(l.ctx.ToValue(0), 0))
+
+	if t, ok := l.timers[id]; ok {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		l.removeTimer(id)
+	}
+
+	return 0
+}
+
+func (l *Loop) removeTimer(id int) {
+	l.dropTimer(id)
+	l.add(-1)
+}
+
+// dropTimer forgets the timer id, which the loop still counts.
+func (l *Loop) dropTimer(id int) {
+	delete(l.timers, id)
+	l.pushTimers()
+	l.ctx.DelPropString(-1, strconv.Itoa(id))
+	l.ctx.Pop()
+}
+
+// stop stops the timers and cancels the async functions when the heap is
+// destroyed. Called on the loop.
+func (l *Loop) stop() {
+	l.lock.Lock()
+	l.stopped = true
+	l.lock.Unlock()
+	l.cancelAsync()
+	l.stopTimers()
+}
+
+// reset clears the timers and the uncaught error, for a context put back in
+// a Pool. Called on the loop.
+func (l *Loop) reset() {
+
+	l.stopTimers()
+
+	l.ctx.PushGlobalStash()
+	l.ctx.PushObject()
+	l.ctx.PutPropString(-2, timersKey)
+	l.ctx.Pop()
+
+	l.lock.Lock()
+	l.err = nil
+	l.lock.Unlock()
+}
+
+func (l *Loop) stopTimers() {
+	for id, t := range l.timers {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		delete(l.timers, id)
+		l.add(-1)
+	}
+}
+
+// post runs fn on the loop unless the heap is destroyed by then. Called by
+// the timers.
+func (l *Loop) post(fn func()) {
+	l.schedule(func() {
+		if l.async.Err() == nil {
+			fn()
+		}
+	})
+}
+
+// schedule queues fn to run on the loop and returns false once the heap is
+// destroyed. The queue is drained by a single callback sent to the
+// dispatch, so that the callbacks queued on the loop itself, e.g. by
+// setImmediate, never wait for room in its channel.
+func (l *Loop) schedule(fn func()) bool {
+
+	l.lock.Lock()
+
+	if l.stopped {
+		l.lock.Unlock()
+		return false
+	}
+
+	l.queue = append(l.queue, fn)
+
+	if l.draining {
+		l.lock.Unlock()
+		return true
+	}
+
+	l.draining = true
+	l.posts.Add(1)
+	l.lock.Unlock()
+
+	defer l.posts.Done()
+
+	l.dispatch.Async(l.drain)
+
+	return true
+}
+
+// drain runs the callbacks queued so far. Those they queue run on the next
+// turn, after the other callbacks sent to the dispatch meanwhile.
+func (l *Loop) drain() {
+
+	l.lock.Lock()
+	queue := l.queue
+	l.queue = nil
+	l.lock.Unlock()
+
+	for _, fn := range queue {
+		fn()
+	}
+
+	l.lock.Lock()
+
+	if len(l.queue) == 0 {
+		l.draining = false
+		l.lock.Unlock()
+		return
+	}
+
+	// Once the heap is destroyed nothing is sent to the dispatch, the
+	// callbacks left only release the loop.
+
+	if l.stopped {
+		l.lock.Unlock()
+		l.drain()
+		return
+	}
+
+	l.posts.Add(1)
+	l.lock.Unlock()
+
+	defer l.posts.Done()
+
+	l.dispatch.Async(l.drain)
+}
+
+func (l *Loop) fire(id int) {
+
+	t, ok := l.timers[id]
+
+	if !ok {
+		return
+	}
+
+	d := l.ctx
+
+	l.pushTimers()
+	d.GetPropString(-1, strconv.Itoa(id))
+	d.Remove(-2)
+
+	// A one-shot timer is forgotten before its callback runs, which may
+	// schedule others, but the loop counts it until the callback and the
+	// jobs it queued are done.
+
+	if !t.repeat {
+		l.dropTimer(id)
+		defer l.add(-1)
+	}
+
+	n := d.GetLength(-1)
+
+	for i := 0; i < n; i++ {
+		d.GetPropIndex(-1-i, uint(i))
+	}
+
+	if err := d.castStringToError(d.Pcall(n - 1)); err != nil {
+		l.report(err)
+	}
+
+	d.Pop2()
+
+	if _, ok := l.timers[id]; ok && t.repeat {
+		t.timer = time.AfterFunc(t.delay, func() {
+			l.post(func() {
+				l.fire(id)
+			})
+		})
+	}
+
+	l.runJobs()
+}
+
+const jobsSource = `(function (global) {
+
+	var jobs = [];
+
+	global.queueMicrotask = function (fn) {
+		if (typeof fn !== 'function') {
+			throw new TypeError('callback must be a function');
+		}
+		jobs.push(fn);
+	};
+
+	if (typeof global.Promise !== 'function') {
+
+		var PENDING = 0, FULFILLED = 1, REJECTED = 2;
+
+		var Promise = function (executor) {
+			if (!(this instanceof Promise)) {
+				throw new TypeError('Promise must be called with new');
+			}
+			if (typeof executor !== 'function') {
+				throw new TypeError('Promise resolver is not a function');
+			}
+			Object.defineProperty(this, '_state', { value: PENDING, writable: true });
+			Object.defineProperty(this, '_value', { value: undefined, writable: true });
+			Object.defineProperty(this, '_handlers', { value: [], writable: true });
+			var self = this, done = false;
+			try {
+				executor(function (v) {
+					if (!done) { done = true; resolve(self, v); }
+				}, function (r) {
+					if (!done) { done = true; settle(self, REJECTED, r); }
+				});
+			} catch (e) {
+				if (!done) { done = true; settle(self, REJECTED, e); }
+			}
+		};
+
+		var settle = function (p, state, value) {
+			if (p._state !== PENDING) {
+				return;
+			}
+			p._state = state;
+			p._value = value;
+			var hs = p._handlers;
+			p._handlers = null;
+			for (var i = 0; i < hs.length; i++) {
+				schedule(p, hs[i]);
+			}
+		};
+
+		var resolve = function (p, v) {
+			if (v === p) {
+				return settle(p, REJECTED, new TypeError('Chaining cycle detected for promise'));
+			}
+			if (v !== null && (typeof v === 'object' || typeof v === 'function')) {
+				var then;
+				try {
+					then = v.then;
+				} catch (e) {
+					return settle(p, REJECTED, e);
+				}
+				if (typeof then === 'function') {
+					var called = false;
+					try {
+						then.call(v, function (y) {
+							if (!called) { called = true; resolve(p, y); }
+						}, function (r) {
+							if (!called) { called = true; settle(p, REJECTED, r); }
+						});
+					} catch (e) {
+						if (!called) { called = true; settle(p, REJECTED, e); }
+					}
+					return;
+				}
+			}
+			settle(p, FULFILLED, v);
+		};
+
+		var schedule = function (p, h) {
+			jobs.push(function () {
+				var cb = p._state === FULFILLED ? h.onFulfilled : h.onRejected;
+				if (typeof cb !== 'function') {
+					if (p._state === FULFILLED) {
+						resolve(h.promise, p._value);
+					} else {
+						settle(h.promise, REJECTED, p._value);
+					}
+					return;
+				}
+				var r;
+				try {
+					r = cb(p._value);
+				} catch (e) {
+					settle(h.promise, REJECTED, e);
+					return;
+				}
+				resolve(h.promise, r);
+			});
+		};
+
+		Promise.prototype.then = function (onFulfilled, onRejected) {
+			var h = { onFulfilled: onFulfilled, onRejected: onRejected, promise: new Promise(function () {}) };
+			if (this._state === PENDING) {
+				this._handlers.push(h);
+			} else {
+				schedule(this, h);
+			}
+			return h.promise;
+		};
+
+		Promise.prototype['catch'] = function (onRejected) {
+			return this.then(undefined, onRejected);
+		};
+
+		Promise.prototype['finally'] = function (fn) {
+			return this.then(function (v) {
+				return Promise.resolve(fn()).then(function () { return v; });
+			}, function (r) {
+				return Promise.resolve(fn()).then(function () { throw r; });
+			});
+		};
+
+		Promise.resolve = function (v) {
+			if (v instanceof Promise) {
+				return v;
+			}
+			return new Promise(function (res) { res(v); });
+		};
+
+		Promise.reject = function (r) {
+			return new Promise(function (res, rej) { rej(r); });
+		};
+
+		Promise.all = function (items) {
+			return new Promise(function (res, rej) {
+				var results = [], remaining = items.length;
+				if (remaining === 0) {
+					return res(results);
+				}
+				items.forEach(function (item, i) {
+					Promise.resolve(item).then(function (v) {
+						results[i] = v;
+						if (--remaining === 0) {
+							res(results);
+						}
+					}, rej);
+				});
+			});
+		};
+
+		Promise.allSettled = function (items) {
+			return Promise.all(items.map(function (item) {
+				return Promise.resolve(item).then(function (v) {
+					return { status: 'fulfilled', value: v };
+				}, function (r) {
+					return { status: 'rejected', reason: r };
+				});
+			}));
+		};
+
+		Promise.race = function (items) {
+			return new Promise(function (res, rej) {
+				items.forEach(function (item) {
+					Promise.resolve(item).then(res, rej);
+				});
+			});
+		};
+
+		Object.defineProperty(global, 'Promise', { value: Promise, writable: true, configurable: true });
+	}
+
+	return function () {
+		while (jobs.length > 0) {
+			jobs.shift()();
+		}
+	};
+
+})(this)`
@@ -0,0 +1,195 @@
+package duktape
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// loopString evaluates src on the loop, once idle, and returns its result.
+func loopString(t *testing.T, l *Loop, src string) string {
+	t.Helper()
+	var s string
+	var err error
+	l.Dispatch().Sync(func() {
+		if err = l.Context().PevalString(src); err == nil {
+			s = l.Context().SafeToString(-1)
+		}
+		l.Context().Pop()
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return s
+}
+
+func destroyLoop(l *Loop) {
+	l.Close()
+}
+
+func TestLoopOrder(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	err := l.RunString(`var log = [];
+		setTimeout(function () { log.push("timeout 20"); }, 20);
+		setTimeout(function () { log.push("timeout 0"); }, 0);
+		setImmediate(function () { log.push("immediate"); });
+		Promise.resolve().then(function () { log.push("then"); });
+		queueMicrotask(function () { log.push("microtask"); });
+		clearTimeout(setTimeout(function () { log.push("cleared"); }, 10));
+		log.push("sync");`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := loopString(t, l, `log.join(",")`)
+
+	if !strings.HasPrefix(got, "sync,then,microtask,") || !strings.HasSuffix(got, ",timeout 20") || strings.Contains(got, "cleared") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLoopWaitNested(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	// Wait must not return while the callback of the last timer runs, nor
+	// miss the timer it schedules.
+
+	err := l.RunString(`var done = false;
+		setTimeout(function () {
+			var t = Date.now();
+			while (Date.now() - t < 30) {}
+			setTimeout(function () { done = true; }, 10);
+		}, 1);`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loopString(t, l, `done`); got != "true" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLoopInterval(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	err := l.RunString(`var n = 0;
+		var id = setInterval(function () {
+			if (++n == 3) {
+				clearInterval(id);
+			}
+		}, 1);`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loopString(t, l, `n`); got != "3" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLoopManyImmediates(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	// More callbacks than the dispatch channel holds, queued from the loop.
+
+	err := l.RunString(`var n = 0;
+		for (var i = 0; i < 5000; i++) {
+			setImmediate(function () {
+				if (++n == 5000) {
+					setImmediate(function () { n++; });
+				}
+			});
+		}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loopString(t, l, `n`); got != "5001" {
+		t.Errorf("got %q", got)
+	}
+
+	done := make(chan bool)
+
+	l.Post(func(ctx *Context) {
+		for i := 0; i < 5000; i++ {
+			l.Post(func(ctx *Context) {})
+		}
+		done <- true
+	})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Post blocks on the loop")
+	}
+
+	if err := l.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoopError(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	err := l.RunString(`setTimeout(function () { throw new TypeError("late"); }, 1);`)
+
+	if e, ok := err.(*Error); !ok || e.Type != "TypeError" || e.Message != "late" {
+		t.Errorf("got %v", err)
+	}
+
+	if err := l.RunString(`Promise.reject(new Error("rejected"))`); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLoopDestroyHeap(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer l.Dispatch().Break()
+
+	started := make(chan bool)
+
+	l.Post(func(ctx *Context) {
+		ctx.PevalString(`setInterval(function () {}, 1); setTimeout(function () {}, 5);`)
+		ctx.Pop()
+		started <- true
+	})
+
+	<-started
+
+	time.Sleep(3 * time.Millisecond)
+
+	l.Dispatch().Sync(l.Context().DestroyHeap)
+
+	// The timers are stopped with the heap, and no longer keep the loop
+	// busy.
+
+	if err := l.Wait(); err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	l.Post(func(ctx *Context) {
+		t.Error("posted callback run after DestroyHeap")
+	})
+
+	if err := l.Wait(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,250 @@
+package duktape
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const modulesKey = "kk.modules"
+
+var ErrModuleNotFound = errors.New("module not found")
+
+// ModuleResolver locates the sources loaded by require().
+type ModuleResolver interface {
+	// Resolve returns the id of the module name required by the module
+	// parent (an empty parent means the top level).
+	Resolve(name string, parent string) (string, error)
+	// Load returns the source of a resolved module.
+	Load(id string) ([]byte, error)
+}
+
+// ModuleFunc pushes the exports of a native module onto the stack.
+type ModuleFunc func(ctx *Context)
+
+var nativeModules = map[string]ModuleFunc{}
+var nativeModulesLock sync.RWMutex
+
+// RegisterModule makes a native module available to require(name) in every
+// context with modules enabled.
+func RegisterModule(name string, fn ModuleFunc) {
+	nativeModulesLock.Lock()
+	defer nativeModulesLock.Unlock()
+	nativeModules[name] = fn
+}
+
+func nativeModule(name string) ModuleFunc {
+	nativeModulesLock.RLock()
+	defer nativeModulesLock.RUnlock()
+	return nativeModules[name]
+}
+
+// moduleId resolves name against parent the way Node.js does for relative
+// paths; other names are resolved from the root of the resolver.
+func moduleId(name string, parent string) string {
+	if strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../") {
+		return strings.TrimPrefix(path.Join(path.Dir(parent), name), "/")
+	}
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func resolveModule(name string, parent string, exists func(id string) bool) (string, error) {
+
+	id := moduleId(name, parent)
+
+	for _, v := range []string{id, id + ".js", id + ".json", path.Join(id, "index.js")} {
+		if exists(v) {
+			return v, nil
+		}
+	}
+
+	return "", ErrModuleNotFound
+}
+
+type fsResolver struct {
+	fsys fs.FS
+}
+
+// NewFSResolver resolves modules from a file system such as an embed.FS.
+func NewFSResolver(fsys fs.FS) ModuleResolver {
+	return &fsResolver{fsys}
+}
+
+// NewDirResolver resolves modules from the files below dir.
+func NewDirResolver(dir string) ModuleResolver {
+	return &fsResolver{os.DirFS(dir)}
+}
+
+func (r *fsResolver) Resolve(name string, parent string) (string, error) {
+	return resolveModule(name, parent, func(id string) bool {
+		st, err := fs.Stat(r.fsys, id)
+		return err == nil && !st.IsDir()
+	})
+}
+
+func (r *fsResolver) Load(id string) ([]byte, error) {
+	return fs.ReadFile(r.fsys, id)
+}
+
+// MapResolver resolves modules from sources kept in memory, keyed by path.
+type MapResolver map[string]string
+
+func (r MapResolver) Resolve(name string, parent string) (string, error) {
+	return resolveModule(name, parent, func(id string) bool {
+		_, ok := r[id]
+		return ok
+	})
+}
+
+func (r MapResolver) Load(id string) ([]byte, error) {
+	if v, ok := r[id]; ok {
+		return []byte(v), nil
+	}
+	return nil, ErrModuleNotFound
+}
+
+// EnableModules installs a CommonJS require() function backed by resolver.
+// Native modules registered with RegisterModule take precedence. Loaded
+// modules are cached per context, and a module required while it is still
+// loading (a circular dependency) returns its exports as they are so far.
+// A nil resolver only provides the native modules.
+func (d *Context) EnableModules(resolver ModuleResolver) {
+
+	if resolver == nil {
+		resolver = MapResolver{}
+	}
+
+	d.PushGlobalStash()
+	d.PushObject()
+	d.PutPropString(-2, modulesKey)
+	d.Pop()
+
+	d.PushGlobalObject()
+	d.pushRequire(resolver, "")
+	d.PutPropString(-2, "require")
+	d.Pop()
+
+	d.markHostGlobals("require")
+}
+
+func (d *Context) pushRequire(resolver ModuleResolver, parent string) {
+	d.PushGoFunction(func() int {
+		return d.require(resolver, d.SafeToString(0), parent)
+	})
+	d.setFunctionName(-1, "require")
+}
+
+func (d *Context) require(resolver ModuleResolver, name string, parent string) int {
+
+	var fn ModuleFunc = nativeModule(name)
+	var id = name
+
+	if fn == nil {
+		var err error
+		id, err = resolver.Resolve(name, parent)
+		if err != nil {
+			d.PushErrorObject(ErrError, "%s", "cannot find module '"+name+"': "+err.Error())
+			return retThrow
+		}
+	}
+
+	d.PushGlobalStash()
+	d.GetPropString(-1, modulesKey)
+
+	if d.GetPropString(-1, id) {
+		d.GetPropString(-1, "exports")
+		return 1
+	}
+
+	d.Pop()
+
+	d.PushObject()
+	d.PushString(id)
+	d.PutPropString(-2, "id")
+	d.PushObject()
+	d.PutPropString(-2, "exports")
+	d.PushFalse()
+	d.PutPropString(-2, "loaded")
+
+	// [ ... stash modules module ]
+
+	d.Dup(-1)
+	d.PutPropString(-3, id)
+
+	if fn != nil {
+		fn(d)
+		d.PutPropString(-2, "exports")
+	} else if err := d.loadModule(resolver, id); err != nil {
+		d.DelPropString(-3, id)
+		return retThrow
+	}
+
+	d.PushTrue()
+	d.PutPropString(-2, "loaded")
+	d.GetPropString(-1, "exports")
+
+	return 1
+}
+
+// loadModule evaluates the module id into the module object at the top of
+// the stack. On failure the error is left at the top of the stack.
+func (d *Context) loadModule(resolver ModuleResolver, id string) error {
+
+	src, err := resolver.Load(id)
+
+	if err != nil {
+		d.PushErrorObject(ErrError, "%s", "cannot load module '"+id+"': "+err.Error())
+		return err
+	}
+
+	if strings.HasSuffix(id, ".json") {
+		d.GetGlobalString("JSON")
+		d.GetPropString(-1, "parse")
+		d.Remove(-2)
+		d.pushGoString(string(src))
+		if err = d.castStringToError(d.Pcall(1)); err != nil {
+			return err
+		}
+		d.PutPropString(-2, "exports")
+		return nil
+	}
+
+	code := string(src)
+
+	if d.transpile {
+		if code, err = d.transpileSource(id, code); err != nil {
+			return err
+		}
+	}
+
+	// The wrapper is kept on the first line so line numbers stay intact.
+	source := "function (exports, require, module, __filename, __dirname) {" + code + "\n}"
+
+	d.PushString(id)
+
+	if err = d.PcompileLstringFilename(CompileFunction, source, len(source)); err != nil {
+		return err
+	}
+
+	// [ ... module fn ]
+
+	d.GetPropString(-2, "exports")
+	d.GetPropString(-3, "exports")
+	d.pushRequire(resolver, id)
+	d.Dup(-5)
+	d.PushString(id)
+	d.PushString(path.Dir(id))
+
+	// [ ... module fn this exports require module __filename __dirname ]
+
+	if err = d.castStringToError(d.PcallMethod(5)); err != nil {
+		return err
+	}
+
+	d.Pop()
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package duktape
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequire(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.EnableModules(MapResolver{
+		"main.js":       `var a = require("./lib/a"); exports.v = a.name + require("lib/data.json").n + require("./lib").x;`,
+		"lib/a.js":      `exports.name = "a"; exports.loads = (exports.loads || 0) + 1;`,
+		"lib/data.json": `{"n": 1}`,
+		"lib/index.js":  `module.exports = {x: "i", dir: __dirname, file: __filename};`,
+	})
+
+	for src, want := range map[string]string{
+		`require("main").v`:                              "a1i",
+		`require("./main") === require("main.js")`:       "true",
+		`require("lib/a") === require("lib/a.js")`:       "true",
+		`require("lib").dir + " " + require("lib").file`: "lib lib/index.js",
+	} {
+		if got := evalString(t, ctx, src); got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestRequireCycle(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.EnableModules(MapResolver{
+		"a.js": `exports.early = 1; var b = require("./b"); exports.late = b.seen;`,
+		"b.js": `exports.seen = require("./a").early;`,
+	})
+
+	if got := evalString(t, ctx, `require("a").late`); got != "1" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRequireErrors(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.EnableModules(MapResolver{
+		"bad.js":   "var x = 1;\nthrow new Error('bad');",
+		"parse.js": "var = ;",
+	})
+
+	for name, want := range map[string]string{
+		"missing": "cannot find module 'missing'",
+		"bad":     "bad",
+		"parse":   "SyntaxError",
+	} {
+
+		err := ctx.PevalString(`require("` + name + `")`)
+		ctx.Pop()
+
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", name, err, want)
+		}
+	}
+
+	// A module that failed is not cached.
+
+	if got := evalString(t, ctx, `try { require("bad") } catch (e) { e.lineNumber }`); got != "2" {
+		t.Errorf("got line %s", got)
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+
+	RegisterModule("test/native", func(ctx *Context) {
+		ctx.PushValue(map[string]interface{}{"answer": 42})
+	})
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.EnableModules(MapResolver{})
+
+	if got := evalString(t, ctx, `require("test/native").answer`); got != "42" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRequireNilResolver(t *testing.T) {
+
+	RegisterModule("test/nil", func(ctx *Context) {
+		ctx.PushValue(map[string]interface{}{"answer": 42})
+	})
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.EnableModules(nil)
+
+	src := `var out = [require("test/nil").answer];
+		try { require("./missing"); } catch (e) { out.push(e.message); }
+		out.join()`
+
+	if got := evalString(t, ctx, src); !strings.HasPrefix(got, "42,cannot find module './missing'") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,322 @@
+package duktape
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const poolResetKey = "kk.poolReset"
+
+var ErrPoolClosed = errors.New("duktape: pool closed")
+
+// PoolOptions configures a Pool.
+type PoolOptions struct {
+	// Size is the number of contexts kept by the pool, 1 when not set.
+	Size int
+	// MaxUses recycles a context once it was handed out that many times,
+	// 0 means no limit.
+	MaxUses int
+	// New creates the contexts, NewWithOptions(Options{}) when nil. A
+	// Sandbox.New method value fits here.
+	New func() (*Context, error)
+	// Init prepares every new context, e.g. by loading shared libraries.
+	// The globals it defines survive between uses.
+	Init func(ctx *Context) error
+}
+
+// PoolStats counts what happened to the contexts of a Pool.
+type PoolStats struct {
+	// Hits counts the Get calls served by an idle context.
+	Hits int
+	// Waits counts the Get calls that blocked until a context was put back.
+	Waits int
+	// Recycles counts the contexts destroyed after MaxUses or an error.
+	Recycles int
+	// Created counts the contexts created, including replacements.
+	Created int
+	// Idle is the number of contexts ready to be handed out.
+	Idle int
+	// InUse is the number of contexts handed out and not put back.
+	InUse int
+}
+
+// Pool hands out warmed-up contexts. Each context is initialized once and,
+// when put back, its stack is emptied, its deadline removed and its global
+// object restored to the state left by Init: globals added by a request are
+// deleted and replaced ones are put back. Objects reachable from the
+// initial globals are not restored, so requests should not mutate them.
+type Pool struct {
+	options PoolOptions
+	idle    []*Context
+	uses    map[*Context]int
+	count   int
+	closed  bool
+	stats   PoolStats
+	lock    sync.Mutex
+	ready   *sync.Cond
+}
+
+// NewPool creates a pool and its contexts. If one of them cannot be created
+// the ones already created are destroyed and the error is returned.
+func NewPool(options PoolOptions) (*Pool, error) {
+
+	if options.Size < 1 {
+		options.Size = 1
+	}
+
+	p := &Pool{options: options, uses: map[*Context]int{}}
+	p.ready = sync.NewCond(&p.lock)
+
+	for i := 0; i < options.Size; i++ {
+		ctx, err := p.create()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle = append(p.idle, ctx)
+		p.count = p.count + 1
+		p.stats.Created = p.stats.Created + 1
+	}
+
+	return p, nil
+}
+
+func (p *Pool) create() (*Context, error) {
+
+	var ctx *Context
+	var err error
+
+	if p.options.New != nil {
+		ctx, err = p.options.New()
+	} else {
+		ctx, err = NewWithOptions(Options{})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.options.Init != nil {
+		if err = p.options.Init(ctx); err != nil {
+			closeContext(ctx)
+			return nil, err
+		}
+	}
+
+	ctx.SetTop(0)
+
+	ctx.PushGlobalStash()
+
+	if err = ctx.PevalString(poolResetSource); err != nil {
+		closeContext(ctx)
+		return nil, err
+	}
+
+	ctx.PutPropString(-2, poolResetKey)
+	ctx.Pop()
+
+	return ctx, nil
+}
+
+// Get returns an idle context, creating a replacement for a recycled one if
+// needed, and blocks while all of them are in use.
+func (p *Pool) Get() (*Context, error) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	waited := false
+
+	for {
+
+		if p.closed {
+			return nil, ErrPoolClosed
+		}
+
+		if n := len(p.idle); n > 0 {
+			ctx := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.stats.Hits = p.stats.Hits + 1
+			return ctx, nil
+		}
+
+		if p.count < p.options.Size {
+			p.count = p.count + 1
+			p.lock.Unlock()
+			ctx, err := p.create()
+			p.lock.Lock()
+			if err != nil {
+				p.count = p.count - 1
+				p.ready.Signal()
+				return nil, err
+			}
+			p.stats.Created = p.stats.Created + 1
+			return ctx, nil
+		}
+
+		if !waited {
+			waited = true
+			p.stats.Waits = p.stats.Waits + 1
+		}
+
+		p.ready.Wait()
+	}
+}
+
+// Put gives ctx back to the pool. err is the outcome of the last use of
+// ctx: a context that failed, or that reached MaxUses, is destroyed instead
+// of being reused. A context with an event loop is reset, its timers
+// cleared, or destroyed on the loop, so Put must not be called from the
+// dispatch goroutine.
+func (p *Pool) Put(ctx *Context, err error) {
+
+	p.lock.Lock()
+	uses := p.uses[ctx] + 1
+	reuse := err == nil && !p.closed && (p.options.MaxUses == 0 || uses < p.options.MaxUses)
+	p.lock.Unlock()
+
+	// Resetting runs scripts, so it is done out of the lock.
+
+	if reuse {
+
+		onLoop(ctx, func() {
+			err = ctx.reset()
+		})
+
+		if err == nil {
+			p.lock.Lock()
+			if !p.closed {
+				p.uses[ctx] = uses
+				p.idle = append(p.idle, ctx)
+				p.ready.Signal()
+				p.lock.Unlock()
+				return
+			}
+			p.lock.Unlock()
+		}
+	}
+
+	p.lock.Lock()
+	if !p.closed {
+		p.stats.Recycles = p.stats.Recycles + 1
+	}
+	p.lock.Unlock()
+
+	p.destroy(ctx)
+}
+
+// destroy destroys ctx, out of the lock, and makes room for another one.
+func (p *Pool) destroy(ctx *Context) {
+
+	closeContext(ctx)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.uses, ctx)
+	p.count = p.count - 1
+	p.ready.Signal()
+}
+
+// closeContext destroys the heap of ctx, closing its event loop if it has
+// one so that a dispatch created by the loop is stopped too.
+func closeContext(ctx *Context) {
+	if ctx.loop != nil {
+		ctx.loop.Close()
+	} else {
+		ctx.DestroyHeap()
+	}
+}
+
+// onLoop runs fn on the event loop of ctx, if it has one, and waits for it.
+func onLoop(ctx *Context, fn func()) {
+	if ctx.loop != nil {
+		ctx.loop.dispatch.Sync(fn)
+	} else {
+		fn()
+	}
+}
+
+// Stats returns a snapshot of the pool counters.
+func (p *Pool) Stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	v := p.stats
+	v.Idle = len(p.idle)
+	v.InUse = p.count - len(p.idle)
+	return v
+}
+
+// Close destroys the idle contexts and makes Get fail. Contexts still in use
+// are destroyed when they are put back.
+func (p *Pool) Close() {
+
+	p.lock.Lock()
+	idle := p.idle
+	p.closed = true
+	p.idle = nil
+	p.ready.Broadcast()
+	p.lock.Unlock()
+
+	for _, ctx := range idle {
+		p.destroy(ctx)
+	}
+}
+
+func (d *Context) reset() error {
+
+	d.SetTop(0)
+	d.SetDeadline(time.Time{})
+	d.takeInterrupt()
+
+	if d.loop != nil {
+		d.loop.reset()
+	}
+
+	d.PushGlobalStash()
+	d.GetPropString(-1, poolResetKey)
+	err := d.castStringToError(d.Pcall(0))
+	d.SetTop(0)
+
+	return err
+}
+
+// poolResetSource records the own properties of the global object and
+// returns a function putting them back.
+const poolResetSource = `(function (global) {
+
+	var names = Object.getOwnPropertyNames(global);
+	var saved = Object.create(null);
+
+	names.forEach(function (k) {
+		saved[k] = Object.getOwnPropertyDescriptor(global, k);
+	});
+
+	return function () {
+		Object.getOwnPropertyNames(global).forEach(function (k) {
+			if (k in saved) {
+				return;
+			}
+			var d = Object.getOwnPropertyDescriptor(global, k);
+			if (d.configurable) {
+				delete global[k];
+			} else if (d.writable) {
+				global[k] = undefined;
+			}
+		});
+		names.forEach(function (k) {
+			var d = Object.getOwnPropertyDescriptor(global, k);
+			var s = saved[k];
+			if (d && d.value === s.value && d.get === s.get && d.set === s.set) {
+				return;
+			}
+			if (!d || d.configurable) {
+				Object.defineProperty(global, k, s);
+			} else if (d.writable) {
+				global[k] = s.value;
+			}
+		});
+	};
+
+})(this)`
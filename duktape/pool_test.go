@@ -0,0 +1,157 @@
+package duktape
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolReset(t *testing.T) {
+
+	p, err := NewPool(PoolOptions{
+		Size: 1,
+		Init: func(ctx *Context) error {
+			return ctx.PevalString(`var lib = {v: 1}; function answer() { return 42; }`)
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Close()
+
+	ctx, _ := p.Get()
+	evalString(t, ctx, `var added = 1; answer = null; lib = 2;`)
+	p.Put(ctx, nil)
+
+	ctx, _ = p.Get()
+
+	if got := evalString(t, ctx, `typeof added + "," + answer() + "," + lib.v`); got != "undefined,42,1" {
+		t.Errorf("got %q", got)
+	}
+
+	p.Put(ctx, nil)
+
+	if s := p.Stats(); s.Hits != 2 || s.Created != 1 || s.Recycles != 0 || s.Idle != 1 || s.InUse != 0 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestPoolRecycle(t *testing.T) {
+
+	p, err := NewPool(PoolOptions{Size: 1, MaxUses: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Close()
+
+	first, _ := p.Get()
+	p.Put(first, nil)
+
+	ctx, _ := p.Get()
+	p.Put(ctx, nil)
+
+	ctx, _ = p.Get()
+
+	if ctx == first {
+		t.Error("context reused after MaxUses")
+	}
+
+	p.Put(ctx, errors.New("failed"))
+
+	if s := p.Stats(); s.Recycles != 2 || s.Created != 2 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestPoolWaitClose(t *testing.T) {
+
+	p, err := NewPool(PoolOptions{Size: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, _ := p.Get()
+
+	got := make(chan *Context)
+
+	go func() {
+		v, _ := p.Get()
+		got <- v
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	p.Put(ctx, nil)
+
+	if v := <-got; v != ctx {
+		t.Error("waiting Get did not get the context put back")
+	}
+
+	p.Close()
+	p.Put(ctx, nil)
+
+	if _, err := p.Get(); err != ErrPoolClosed {
+		t.Errorf("got %v", err)
+	}
+
+	if s := p.Stats(); s.Waits != 1 || s.Idle != 0 || s.InUse != 0 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestPoolLoop(t *testing.T) {
+
+	p, err := NewPool(PoolOptions{Size: 1, New: NewSandbox().Grant(TimersCapability(nil)).New})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Close()
+
+	ctx, _ := p.Get()
+
+	ctx.Loop().Post(func(ctx *Context) {
+		ctx.PevalString(`var n = 0; setInterval(function () { n++; }, 1); setTimeout(function () {}, 1000);`)
+		ctx.Pop()
+	})
+
+	time.Sleep(5 * time.Millisecond)
+
+	// The timers are cleared when the context is put back.
+
+	p.Put(ctx, nil)
+
+	if err := ctx.Loop().Wait(); err != nil {
+		t.Error(err)
+	}
+
+	ctx, _ = p.Get()
+
+	if err := ctx.Loop().RunString(`setTimeout(function () { throw new Error("late"); }, 1)`); err == nil {
+		t.Error("no error")
+	}
+
+	ctx.Loop().Post(func(ctx *Context) {
+		ctx.PevalString(`setInterval(function () {}, 1)`)
+		ctx.Pop()
+	})
+
+	// A context destroyed with its timers running does not crash, and the
+	// dispatch of its loop is stopped.
+
+	exited := make(chan struct{})
+	ctx.Loop().Dispatch().OnExit = func() { close(exited) }
+
+	p.Put(ctx, errors.New("failed"))
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Error("the dispatch still runs")
+	}
+}
@@ -0,0 +1,349 @@
+package duktape
+
+/*
+#include "duk_config.h"
+#include "duktape.h"
+#include "kk.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// ProfilerOptions configures StartProfiler.
+type ProfilerOptions struct {
+	// Interval is the delay between two samples of the call stack, 10ms
+	// when not set. Duktape checks for a pending sample every 256K bytecode
+	// instructions, shorter intervals are not honored.
+	Interval time.Duration
+	// Lines adds the line being executed to the frames, profiling lines
+	// rather than functions.
+	Lines bool
+}
+
+// GoFunctionStats counts the calls from scripts into a Go function.
+type GoFunctionStats struct {
+	// Name is the name of the function for scripts, or of the Go function
+	// when it has none.
+	Name  string
+	Calls int
+	// Total is the time spent in the function, the scripts it calls back
+	// included.
+	Total time.Duration
+}
+
+// Mean returns the average latency of a call.
+func (s GoFunctionStats) Mean() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Calls)
+}
+
+// Profile is the result of a profiling session.
+type Profile struct {
+	Interval time.Duration
+	Duration time.Duration
+	// Stacks counts the samples of each call stack, given from the
+	// outermost to the innermost frame and separated by semicolons. The
+	// time spent in a Go function called by a script is sampled with its
+	// caller's stack.
+	Stacks map[string]int
+	// GoFunctions are the Go functions called, by decreasing total time.
+	GoFunctions []GoFunctionStats
+}
+
+// WriteFolded writes the stacks in the folded format of flame graph tools
+// (such as flamegraph.pl or speedscope), one "frame;frame;frame count" line
+// per stack.
+func (p *Profile) WriteFolded(w io.Writer) error {
+
+	stacks := make([]string, 0, len(p.Stacks))
+
+	for stack := range p.Stacks {
+		stacks = append(stacks, stack)
+	}
+
+	sort.Strings(stacks)
+
+	for _, stack := range stacks {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, p.Stacks[stack]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Profiler samples the call stack of the scripts of a context and counts
+// their calls into Go functions, see StartProfiler.
+//
+// The executor interrupt only records the stacks, which must not call into
+// Duktape, and the profiler reads them at safe points: when a Go function
+// called by a script returns, and on Stop.
+type Profiler struct {
+	ctx     *Context
+	options ProfilerOptions
+	start   time.Time
+	stop    chan struct{}
+	done    chan struct{}
+	stopped bool
+	// stacks and calls are locked, the profile may be read while the
+	// scripts run.
+	stacks map[string]int
+	calls  map[int]*GoFunctionStats
+	lock   sync.Mutex
+}
+
+// StartProfiler starts profiling the context until Stop is called. There is
+// at most one profiler per heap, starting another stops the previous one.
+// Like the context, the profiler must be used from one goroutine at a time.
+// Destroying the heap stops it.
+func (d *Context) StartProfiler(options ProfilerOptions) *Profiler {
+
+	if options.Interval <= 0 {
+		options.Interval = 10 * time.Millisecond
+	}
+
+	if p := d.s.getProfiler(); p != nil {
+		p.Stop()
+	}
+
+	p := &Profiler{
+		ctx:     d,
+		options: options,
+		start:   time.Now(),
+		stacks:  map[string]int{},
+		calls:   map[int]*GoFunctionStats{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	d.s.setProfiler(p)
+
+	d.heap.profile_len = 0
+
+	if options.Lines {
+		d.heap.profile_lines = 1
+	} else {
+		d.heap.profile_lines = 0
+	}
+
+	samples := (*int32)(unsafe.Pointer(&d.heap.samples))
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				atomic.AddInt32(samples, 1)
+			}
+		}
+	}()
+
+	return p
+}
+
+// Stop stops profiling and returns the profile.
+func (p *Profiler) Stop() *Profile {
+
+	if !p.stopped {
+
+		p.stopped = true
+
+		// The ticker must be done before the heap can be freed.
+
+		close(p.stop)
+		<-p.done
+
+		d := p.ctx
+
+		d.s.lock.Lock()
+		current := d.s.profiler == p
+		if current {
+			d.s.profiler = nil
+		}
+		d.s.lock.Unlock()
+
+		if current && d.heap != nil {
+			p.read()
+			atomic.StoreInt32((*int32)(unsafe.Pointer(&d.heap.samples)), 0)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	profile := &Profile{
+		Interval: p.options.Interval,
+		Duration: time.Since(p.start),
+		Stacks:   map[string]int{},
+	}
+
+	for stack, n := range p.stacks {
+		profile.Stacks[stack] = n
+	}
+
+	// Functions of the same name, such as the methods of several objects,
+	// are counted together.
+
+	calls := map[string]*GoFunctionStats{}
+
+	for _, s := range p.calls {
+		if s.Calls == 0 {
+			continue
+		}
+		if c, ok := calls[s.Name]; ok {
+			c.Calls = c.Calls + s.Calls
+			c.Total = c.Total + s.Total
+		} else {
+			c := *s
+			calls[s.Name] = &c
+		}
+	}
+
+	for _, s := range calls {
+		profile.GoFunctions = append(profile.GoFunctions, *s)
+	}
+
+	sort.Slice(profile.GoFunctions, func(i, j int) bool {
+		return profile.GoFunctions[i].Total > profile.GoFunctions[j].Total
+	})
+
+	return profile
+}
+
+// Profile runs fn, typically an evaluation, with a profiler started.
+func (d *Context) Profile(options ProfilerOptions, fn func() error) (*Profile, error) {
+	p := d.StartProfiler(options)
+	err := fn()
+	return p.Stop(), err
+}
+
+// profileHeader is the length of the "count length\n" header of the stacks
+// recorded by kk_profile_record.
+const profileHeader = 22
+
+// read counts the stacks recorded since the last read, given from the
+// innermost frame, and empties the record. Called at a safe point.
+func (p *Profiler) read() {
+
+	heap := p.ctx.heap
+
+	if heap.profile_len == 0 {
+		return
+	}
+
+	b := C.GoStringN(heap.profile, C.int(heap.profile_len))
+	heap.profile_len = 0
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for len(b) >= profileHeader {
+
+		count, _ := strconv.Atoi(strings.TrimSpace(b[:10]))
+		n, _ := strconv.Atoi(strings.TrimSpace(b[11 : profileHeader-1]))
+
+		if n > len(b)-profileHeader {
+			break
+		}
+
+		frames := strings.Split(b[profileHeader:profileHeader+n], ";")
+		b = b[profileHeader+n:]
+
+		if n == 0 {
+			continue
+		}
+
+		for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+			frames[i], frames[j] = frames[j], frames[i]
+		}
+
+		stack := strings.Join(frames, ";")
+		p.stacks[stack] = p.stacks[stack] + count
+	}
+}
+
+// frameName removes the separators of the folded format from a frame.
+func frameName(s string) string {
+	return strings.ReplaceAll(s, ";", ",")
+}
+
+// goFunctionName names the Go function id, which is at the top of the
+// stack.
+func (p *Profiler) goFunctionName(d *Context, id int) string {
+
+	p.lock.Lock()
+	s, ok := p.calls[id]
+	p.lock.Unlock()
+
+	if ok {
+		return s.Name
+	}
+
+	d.GetPropString(-1, "name")
+	name := d.SafeToString(-1)
+	d.Pop()
+
+	if name == "" {
+		name = "(anonymous)"
+		if v := reflect.ValueOf(d.s.Get(id)); v.Kind() == reflect.Func {
+			if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+				name = fn.Name()
+				name = name[strings.LastIndexByte(name, '/')+1:]
+			}
+		}
+	}
+
+	name = frameName(name)
+
+	p.lock.Lock()
+	p.calls[id] = &GoFunctionStats{Name: name}
+	p.lock.Unlock()
+
+	return name
+}
+
+// callGo calls the Go function id of the scope, named beforehand by
+// goFunctionName, and records the call. The samples due while it ran are
+// taken with it at the top of the stack, then the stacks recorded are read.
+func (p *Profiler) callGo(s *scope, id int) int {
+
+	start := time.Now()
+	r := s.Call(id)
+	elapsed := time.Since(start)
+
+	p.lock.Lock()
+	if stats := p.calls[id]; stats != nil {
+		stats.Calls = stats.Calls + 1
+		stats.Total = stats.Total + elapsed
+	}
+	p.lock.Unlock()
+
+	// The call may have stopped the profiler.
+
+	if s.getProfiler() == p {
+		if p.ctx.heap.samples != 0 {
+			C.kk_profile_record(p.ctx.heap)
+		}
+		p.read()
+	}
+
+	return r
+}
@@ -0,0 +1,152 @@
+package duktape
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+const busySource = `function busy(ms) {
+	var end = Date.now() + ms;
+	while (Date.now() < end) {}
+}
+function outer() {
+	busy(50);
+}
+outer();
+`
+
+// runFile evaluates src as the file filename.
+func runFile(t *testing.T, ctx *Context, filename string, src string) {
+	t.Helper()
+	if err := ctx.compileEval(filename, src); err != nil {
+		ctx.Pop()
+		t.Fatal(err)
+	}
+	err := ctx.castStringToError(ctx.Pcall(0))
+	ctx.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// samples returns the samples of the stacks containing s.
+func samples(p *Profile, s string) int {
+	n := 0
+	for stack, count := range p.Stacks {
+		if strings.Contains(stack, s) {
+			n = n + count
+		}
+	}
+	return n
+}
+
+func TestProfilerStacks(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	p := ctx.StartProfiler(ProfilerOptions{Interval: time.Millisecond})
+	runFile(t, ctx, "busy.js", busySource)
+	profile := p.Stop()
+
+	if samples(profile, "outer (busy.js);busy (busy.js)") == 0 {
+		t.Errorf("got %v", profile.Stacks)
+	}
+
+	var b bytes.Buffer
+
+	if err := profile.WriteFolded(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(b.String(), "outer (busy.js);busy (busy.js) ") {
+		t.Errorf("got %q", b.String())
+	}
+
+	// Stopping again returns the same profile.
+
+	if again := p.Stop(); samples(again, "busy") != samples(profile, "busy") {
+		t.Errorf("got %v after %v", again.Stacks, profile.Stacks)
+	}
+}
+
+func TestProfilerLines(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	p := ctx.StartProfiler(ProfilerOptions{Interval: time.Millisecond, Lines: true})
+	runFile(t, ctx, "busy.js", busySource)
+	profile := p.Stop()
+
+	if samples(profile, "outer (busy.js:6);busy (busy.js:3)") == 0 {
+		t.Errorf("got %v", profile.Stacks)
+	}
+}
+
+func TestProfilerGoFunctions(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	ctx.PushGlobalGoFunction("wait", func() int {
+		time.Sleep(5 * time.Millisecond)
+		return 0
+	})
+
+	p := ctx.StartProfiler(ProfilerOptions{Interval: time.Millisecond})
+	runFile(t, ctx, "wait.js", `function run() { for (var i = 0; i < 4; i++) { wait(); } } run();`)
+	profile := p.Stop()
+
+	if len(profile.GoFunctions) != 1 {
+		t.Fatalf("got %v", profile.GoFunctions)
+	}
+
+	s := profile.GoFunctions[0]
+
+	if s.Name != "wait" || s.Calls != 4 || s.Mean() < 5*time.Millisecond {
+		t.Errorf("got %+v", s)
+	}
+
+	// The time spent in Go is sampled with the stack of its caller.
+
+	if samples(profile, "run (wait.js);wait [Go]") == 0 {
+		t.Errorf("got %v", profile.Stacks)
+	}
+}
+
+func TestProfilerRestart(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	first := ctx.StartProfiler(ProfilerOptions{Interval: time.Millisecond})
+	runFile(t, ctx, "first.js", busySource)
+
+	second := ctx.StartProfiler(ProfilerOptions{Interval: time.Millisecond})
+	runFile(t, ctx, "second.js", busySource)
+
+	if profile := second.Stop(); samples(profile, "first.js") != 0 || samples(profile, "second.js") == 0 {
+		t.Errorf("got %v", profile.Stacks)
+	}
+
+	if profile := first.Stop(); samples(profile, "second.js") != 0 || samples(profile, "first.js") == 0 {
+		t.Errorf("got %v", profile.Stacks)
+	}
+}
+
+func TestProfilerDestroyHeap(t *testing.T) {
+
+	ctx := New()
+
+	p := ctx.StartProfiler(ProfilerOptions{Interval: time.Millisecond})
+	runFile(t, ctx, "busy.js", busySource)
+
+	ctx.DestroyHeap()
+
+	if profile := p.Stop(); samples(profile, "busy.js") == 0 {
+		t.Errorf("got %v", profile.Stacks)
+	}
+}
@@ -0,0 +1,354 @@
+package duktape
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+const promisesKey = "kk.promises"
+const deferredKey = "kk.deferred"
+const awaitKey = "kk.await"
+
+// Resolver settles a Promise pushed by PushPromise. Its methods may be
+// called from any goroutine: the Promise is settled on the event loop of the
+// context. Only the first call has an effect.
+//
+// The loop counts a pending Promise like a timer, so Loop.Wait returns once
+// it is settled: every Promise must eventually be resolved or rejected.
+type Resolver struct {
+	loop *Loop
+	id   string
+	once sync.Once
+}
+
+// PushPromise pushes a new pending Promise and returns its resolver. The
+// context must have an event loop (see NewLoop), nothing is pushed
+// otherwise.
+func (d *Context) PushPromise() (*Resolver, error) {
+
+	l := d.loop
+
+	if l == nil {
+		return nil, ErrNoLoop
+	}
+
+	if err := l.installPromises(); err != nil {
+		return nil, err
+	}
+
+	l.autoId = l.autoId + 1
+
+	r := &Resolver{loop: l, id: strconv.Itoa(l.autoId)}
+
+	// The resolving functions are kept in the stash until the Promise is
+	// settled.
+
+	d.PushGlobalStash()
+	d.GetPropString(-1, deferredKey)
+
+	if err := d.castStringToError(d.Pcall(0)); err != nil {
+		d.Pop2()
+		return nil, err
+	}
+
+	d.GetPropString(-2, promisesKey)
+	d.Dup(-2)
+	d.PutPropString(-2, r.id)
+	d.Pop()
+
+	d.GetPropString(-1, "promise")
+	d.Remove(-2)
+	d.Remove(-2)
+
+	l.add(1)
+
+	return r, nil
+}
+
+// Resolve fulfills the Promise with value, converted by PushValue.
+func (r *Resolver) Resolve(value interface{}) {
+	r.settle("resolve", func(ctx *Context) {
+		ctx.PushValue(value)
+	})
+}
+
+// ResolveWith fulfills the Promise with the value pushed by fn, which is
+// called on the event loop. fn should push one value: the Promise is
+// fulfilled with the last one, or undefined when there is none.
+func (r *Resolver) ResolveWith(fn func(ctx *Context)) {
+	r.settle("resolve", fn)
+}
+
+// Reject rejects the Promise with err, pushed with PushGoError.
+func (r *Resolver) Reject(err error) {
+	r.settle("reject", func(ctx *Context) {
+		ctx.PushGoError(err)
+	})
+}
+
+func (r *Resolver) settle(name string, push func(ctx *Context)) {
+	r.once.Do(func() {
+		r.loop.Post(func(d *Context) {
+
+			d.PushGlobalStash()
+			d.GetPropString(-1, promisesKey)
+			d.GetPropString(-1, r.id)
+			d.DelPropString(-2, r.id)
+			d.GetPropString(-1, name)
+
+			top := d.GetTop()
+			push(d)
+
+			if n := d.GetTop() - top; n == 0 {
+				d.PushUndefined()
+			} else if n > 1 {
+				d.Replace(top)
+				d.SetTop(top + 1)
+			}
+
+			if err := d.castStringToError(d.Pcall(1)); err != nil {
+				r.loop.report(err)
+			}
+
+			d.SetTop(top - 4)
+		})
+
+		// The Post keeps the loop busy from now on.
+
+		r.loop.add(-1)
+	})
+}
+
+// PushGlobalAsyncFunc registers fn as a global function, see PushAsyncFunc.
+func (d *Context) PushGlobalAsyncFunc(key string, fn interface{}) {
+	d.PushGlobalObject()
+	d.PushAsyncFunc(fn)
+	d.setFunctionName(-1, key)
+	d.PutPropString(-2, key)
+	d.Pop()
+	d.markHostGlobals(key)
+}
+
+// PushAsyncFunc pushes a JavaScript function that calls fn on a new
+// goroutine and returns a Promise of its result, so that slow Go code does
+// not block the scripts. Arguments and results are converted like with
+// PushGoFunc: the Promise is fulfilled with the results, or rejected with
+// the error returned by fn, or the one it panics with. A function taking a
+// context.Context as first parameter gets one canceled when the heap is
+// destroyed.
+//
+// The context must have an event loop (see NewLoop) when the function is
+// called, it throws an Error otherwise.
+func (d *Context) PushAsyncFunc(fn interface{}) {
+
+	v := reflect.ValueOf(fn)
+
+	if v.Kind() != reflect.Func {
+		panic(fmt.Sprintf("duktape: PushAsyncFunc expects a function, got %T", fn))
+	}
+
+	d.PushGoFunction(func() int {
+		return d.callAsyncFunc(v)
+	})
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+func (d *Context) callAsyncFunc(fn reflect.Value) int {
+
+	t := fn.Type()
+	skip := 0
+
+	// The context.Context is not an argument of the call.
+
+	if t.NumIn() > 0 && t.In(0) == contextType {
+		skip = 1
+	}
+
+	args, argsErr := d.goFuncArgs(t, skip)
+
+	r, err := d.PushPromise()
+
+	if err != nil {
+		d.SetTop(0)
+		d.PushGoError(err)
+		return retThrow
+	}
+
+	if argsErr != nil {
+		r.settle("reject", func(ctx *Context) {
+			ctx.PushErrorObject(ErrType, "%s", argsErr.Error())
+		})
+		return 1
+	}
+
+	if skip == 1 {
+		args[0] = reflect.ValueOf(d.loop.async)
+	}
+
+	go func() {
+
+		defer func() {
+			if p := recover(); p != nil {
+				if err, ok := p.(error); ok {
+					r.Reject(err)
+				} else {
+					r.Reject(fmt.Errorf("%v", p))
+				}
+			}
+		}()
+
+		rs, err := goFuncResults(t, fn.Call(args))
+
+		if err != nil {
+			r.Reject(err)
+			return
+		}
+
+		r.ResolveWith(func(ctx *Context) {
+			if ctx.pushGoFuncResults(rs) == 0 {
+				ctx.PushUndefined()
+			}
+		})
+	}()
+
+	return 1
+}
+
+// Await posts fn, which must push one value, typically a Promise returned by
+// a script, and waits for it to settle. It returns the fulfillment value
+// converted by ToValue, or the rejection reason as an *Error. A value that
+// is not a Promise is returned as is. When fn returns an error, the value it
+// pushed is discarded and the error returned.
+//
+// The wait ends early with the error of ctx when it is done, the Promise
+// then settling unobserved, or with ErrContextClosed when the heap is
+// destroyed. Like Wait, Await must not be called from the
+// dispatch goroutine.
+func (l *Loop) Await(ctx context.Context, fn func(c *Context) error) (interface{}, error) {
+
+	type result struct {
+		value interface{}
+		err   error
+	}
+
+	done := make(chan result, 1)
+
+	l.Post(func(d *Context) {
+
+		top := d.GetTop()
+
+		if err := fn(d); err != nil {
+			d.SetTop(top)
+			done <- result{nil, err}
+			return
+		}
+
+		if err := l.installPromises(); err != nil {
+			d.SetTop(top)
+			done <- result{nil, err}
+			return
+		}
+
+		d.PushGlobalStash()
+		d.GetPropString(-1, awaitKey)
+		d.Remove(-2)
+		d.Insert(-2)
+
+		d.PushGoFunction(func() int {
+			if d.ToBoolean(0) {
+				done <- result{d.ToValue(1), nil}
+			} else {
+				d.Dup(1)
+				done <- result{nil, d.castStringToError(1)}
+				d.Pop()
+			}
+			return 0
+		})
+
+		if err := d.castStringToError(d.Pcall(2)); err != nil {
+			done <- result{nil, err}
+		}
+
+		d.SetTop(top)
+	})
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.async.Done():
+	}
+
+	// The Promise may have settled before the heap was destroyed.
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	default:
+		return nil, ErrContextClosed
+	}
+}
+
+// AwaitString evaluates src on the loop, transpiled when EnableTranspiler
+// was called, and waits for its result, see Await. It is typically used to
+// call an async function of a script.
+func (l *Loop) AwaitString(ctx context.Context, src string) (interface{}, error) {
+	return l.Await(ctx, func(d *Context) error {
+		if err := d.compileEval("eval", src); err != nil {
+			return err
+		}
+		return d.castStringToError(d.Pcall(0))
+	})
+}
+
+// installPromises installs the helpers of the Promise bridge, on the loop.
+func (l *Loop) installPromises() error {
+
+	d := l.ctx
+
+	d.PushGlobalStash()
+	defer d.Pop()
+
+	if d.HasPropString(-1, promisesKey) {
+		return nil
+	}
+
+	if err := d.PevalString(promiseSource); err != nil {
+		d.Pop()
+		return err
+	}
+
+	d.GetPropString(-1, "deferred")
+	d.PutPropString(-3, deferredKey)
+	d.GetPropString(-1, "await")
+	d.PutPropString(-3, awaitKey)
+	d.Pop()
+
+	d.PushObject()
+	d.PutPropString(-2, promisesKey)
+
+	return nil
+}
+
+const promiseSource = `({
+	deferred: function () {
+		var d = {};
+		d.promise = new Promise(function (resolve, reject) {
+			d.resolve = resolve;
+			d.reject = reject;
+		});
+		return d;
+	},
+	await: function (value, done) {
+		Promise.resolve(value).then(function (v) {
+			done(true, v);
+		}, function (r) {
+			done(false, r);
+		});
+	}
+})`
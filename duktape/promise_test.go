@@ -0,0 +1,118 @@
+package duktape
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushPromise(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	ctx := context.Background()
+
+	var r *Resolver
+
+	v, err := l.Await(ctx, func(d *Context) error {
+		var err error
+		r, err = d.PushPromise()
+		if err == nil {
+			go r.Resolve(map[string]interface{}{"a": 1})
+		}
+		return err
+	})
+
+	if m, ok := v.(map[string]interface{}); err != nil || !ok || m["a"] != float64(1) {
+		t.Errorf("got %v, %v", v, err)
+	}
+
+	_, err = l.Await(ctx, func(d *Context) error {
+		r, err := d.PushPromise()
+		if err == nil {
+			go r.Reject(errors.New("failed"))
+		}
+		return err
+	})
+
+	var e *Error
+
+	if !errors.As(err, &e) || e.Message != "failed" {
+		t.Errorf("got %v", err)
+	}
+
+	// A context without a loop has no Promise bridge.
+
+	plain := New()
+	defer plain.DestroyHeap()
+
+	if _, err := plain.PushPromise(); err != ErrNoLoop {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestPushAsyncFunc(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	l.Dispatch().Sync(func() {
+		l.Context().PushGlobalAsyncFunc("add", func(ctx context.Context, a int, b int) (int, error) {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return a + b, nil
+		})
+		l.Context().PushGlobalAsyncFunc("fail", func() {
+			panic("broken")
+		})
+	})
+
+	ctx := context.Background()
+
+	if v, err := l.AwaitString(ctx, `add(1, 2)`); err != nil || v != float64(3) {
+		t.Errorf("got %v, %v", v, err)
+	}
+
+	// Arguments are numbered as in the script, the context aside.
+
+	if _, err := l.AwaitString(ctx, `add(1, "x")`); err == nil || !strings.Contains(err.Error(), "argument 2") {
+		t.Errorf("got %v", err)
+	}
+
+	if _, err := l.AwaitString(ctx, `fail()`); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestAwaitClosed(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+
+	time.AfterFunc(10*time.Millisecond, l.Close)
+
+	// The Promise never settles.
+
+	if _, err := l.AwaitString(context.Background(), `new Promise(function () {})`); err != ErrContextClosed {
+		t.Errorf("got %v", err)
+	}
+
+	if _, err := l.AwaitString(context.Background(), `1`); err != ErrContextClosed {
+		t.Errorf("got %v after Close", err)
+	}
+
+	// The context ends the wait too.
+
+	l = NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := l.AwaitString(ctx, `new Promise(function () {})`); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+}
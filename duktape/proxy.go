@@ -0,0 +1,329 @@
+package duktape
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+const proxyHandlerKey = "kk.proxyHandler"
+
+// PushGoProxy pushes a live view of a Go struct or map. Reading a property
+// returns the current value of the struct field with that json name (or the
+// map entry), assigning to it writes the converted value back into the Go
+// value and exported methods can be called by their Go name or with a lower
+// case first letter. Nested structs and maps are returned as live views too.
+//
+// Struct fields are only writable when object is a pointer. Values other than
+// structs and maps are pushed with PushGoObject. ToGoObject returns object.
+func (d *Context) PushGoProxy(object interface{}) {
+
+	v := reflect.ValueOf(object)
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			d.PushGoObject(object)
+			return
+		}
+	case reflect.Struct:
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		object = p.Interface()
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			d.PushGoObject(object)
+			return
+		}
+	default:
+		d.PushGoObject(object)
+		return
+	}
+
+	// Duktape only enumerates the keys of a proxy that are enumerable
+	// properties of its target, so the target holds a placeholder for every
+	// field: the traps never read them.
+
+	d.PushGoObject(object)
+
+	if v := reflect.ValueOf(object); v.Kind() == reflect.Ptr {
+		eachField(v.Elem(), func(name string, fv reflect.Value) bool {
+			d.PushUndefined()
+			d.PutPropString(-2, name)
+			return true
+		})
+	}
+
+	d.pushProxyHandler()
+	d.PushProxy(0)
+}
+
+func (d *Context) pushProxyHandler() {
+
+	d.PushGlobalStash()
+
+	if d.GetPropString(-1, proxyHandlerKey) {
+		d.Remove(-2)
+		return
+	}
+
+	d.Pop()
+
+	d.PushObject()
+
+	d.PushGoFunction(d.proxyGet)
+	d.PutPropString(-2, "get")
+
+	d.PushGoFunction(d.proxySet)
+	d.PutPropString(-2, "set")
+
+	d.PushGoFunction(d.proxyHas)
+	d.PutPropString(-2, "has")
+
+	d.PushGoFunction(d.proxyDeleteProperty)
+	d.PutPropString(-2, "deleteProperty")
+
+	d.PushGoFunction(d.proxyOwnKeys)
+	d.PutPropString(-2, "ownKeys")
+
+	d.DupTop()
+	d.PutPropString(-3, proxyHandlerKey)
+	d.Remove(-2)
+}
+
+// proxyValue returns the Go value behind the proxy target at index 0.
+func (d *Context) proxyValue() reflect.Value {
+	v := reflect.ValueOf(d.ToGoObject(0))
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	return v
+}
+
+func proxyField(v reflect.Value, name string) reflect.Value {
+
+	var r reflect.Value
+
+	if v.Kind() == reflect.Map {
+		return v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+	}
+
+	eachField(v, func(key string, fv reflect.Value) bool {
+		if key == name {
+			r = fv
+			return false
+		}
+		return true
+	})
+
+	return r
+}
+
+func proxyMethod(object interface{}, name string) reflect.Value {
+
+	if name == "" {
+		return reflect.Value{}
+	}
+
+	v := reflect.ValueOf(object)
+
+	if m := v.MethodByName(name); m.IsValid() {
+		return m
+	}
+
+	r := []rune(name)
+
+	if unicode.IsLower(r[0]) {
+		r[0] = unicode.ToUpper(r[0])
+		return v.MethodByName(string(r))
+	}
+
+	return reflect.Value{}
+}
+
+func (d *Context) pushProxyField(fv reflect.Value) {
+
+	switch fv.Kind() {
+	case reflect.Struct:
+		if fv.CanAddr() {
+			d.PushGoProxy(fv.Addr().Interface())
+			return
+		}
+	case reflect.Ptr:
+		if !fv.IsNil() && fv.Elem().Kind() == reflect.Struct {
+			d.PushGoProxy(fv.Interface())
+			return
+		}
+	case reflect.Map:
+		if !fv.IsNil() && fv.Type().Key().Kind() == reflect.String {
+			d.PushGoProxy(fv.Interface())
+			return
+		}
+	case reflect.Interface:
+		if !fv.IsNil() {
+			d.pushProxyField(fv.Elem())
+			return
+		}
+	}
+
+	d.PushValue(fv.Interface())
+}
+
+func (d *Context) proxyGet() int {
+
+	key := d.SafeToString(1)
+	v := d.proxyValue()
+
+	if !strings.HasPrefix(key, "__") {
+
+		if fv := proxyField(v, key); fv.IsValid() {
+			d.pushProxyField(fv)
+			return 1
+		}
+
+		if m := proxyMethod(d.ToGoObject(0), key); m.IsValid() {
+			d.PushGoFunc(m.Interface())
+			return 1
+		}
+	}
+
+	d.GetPropString(0, key)
+
+	return 1
+}
+
+func (d *Context) proxySet() int {
+
+	key := d.SafeToString(1)
+	v := d.proxyValue()
+
+	if v.Kind() == reflect.Map {
+		vv, err := convertValue(d.ToValue(2), v.Type().Elem())
+		if err != nil {
+			d.SetTop(0)
+			d.PushErrorObject(ErrType, "%s", key+": "+err.Error())
+			return retThrow
+		}
+		v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), vv)
+		d.PushUndefined()
+		d.PutPropString(0, key)
+		d.PushTrue()
+		return 1
+	}
+
+	if fv := proxyField(v, key); fv.IsValid() {
+		if !fv.CanSet() {
+			d.PushFalse()
+			return 1
+		}
+		vv, err := convertValue(d.ToValue(2), fv.Type())
+		if err != nil {
+			d.SetTop(0)
+			d.PushErrorObject(ErrType, "%s", key+": "+err.Error())
+			return retThrow
+		}
+		fv.Set(vv)
+		d.PushTrue()
+		return 1
+	}
+
+	d.Dup(2)
+	d.PutPropString(0, key)
+	d.PushTrue()
+
+	return 1
+}
+
+func (d *Context) proxyHas() int {
+
+	key := d.SafeToString(1)
+	v := d.proxyValue()
+
+	d.PushBoolean(proxyField(v, key).IsValid() ||
+		proxyMethod(d.ToGoObject(0), key).IsValid() ||
+		d.HasPropString(0, key))
+
+	return 1
+}
+
+func (d *Context) proxyDeleteProperty() int {
+
+	key := d.SafeToString(1)
+	v := d.proxyValue()
+
+	if v.Kind() == reflect.Map {
+		v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), reflect.Value{})
+		d.DelPropString(0, key)
+		d.PushTrue()
+		return 1
+	}
+
+	if proxyField(v, key).IsValid() {
+		d.PushFalse()
+		return 1
+	}
+
+	d.PushBoolean(d.DelPropString(0, key))
+
+	return 1
+}
+
+// proxyOwnKeys lists the field names followed by the properties scripts
+// stored on a struct target, or the map keys. The placeholders of the map
+// keys on the target (see PushGoProxy) are brought up to date first since
+// the map may have changed in Go.
+func (d *Context) proxyOwnKeys() int {
+
+	v := d.proxyValue()
+	keys := []string{}
+	names := map[string]bool{}
+
+	if v.Kind() == reflect.Map {
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+			names[key.String()] = true
+		}
+	} else {
+		eachField(v, func(name string, fv reflect.Value) bool {
+			keys = append(keys, name)
+			names[name] = true
+			return true
+		})
+	}
+
+	var others []string
+
+	d.Enum(0, DUK_ENUM_OWN_PROPERTIES_ONLY)
+
+	for d.Next(-1, false) {
+		if key := d.getGoString(-1); !names[key] {
+			others = append(others, key)
+		}
+		d.Pop()
+	}
+
+	d.Pop()
+
+	if v.Kind() == reflect.Map {
+		for _, key := range others {
+			d.DelPropString(0, key)
+		}
+		for _, key := range keys {
+			if !d.HasPropString(0, key) {
+				d.PushUndefined()
+				d.PutPropString(0, key)
+			}
+		}
+	} else {
+		keys = append(keys, others...)
+	}
+
+	d.PushArray()
+
+	for i, key := range keys {
+		d.PushString(key)
+		d.PutPropIndex(-2, uint(i))
+	}
+
+	return 1
+}
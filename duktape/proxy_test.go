@@ -0,0 +1,91 @@
+package duktape
+
+import (
+	"reflect"
+	"testing"
+)
+
+type proxyInner struct {
+	Z int `json:"z"`
+}
+
+type proxyRequest struct {
+	Name string            `json:"name"`
+	In   proxyInner        `json:"in"`
+	Ptr  *proxyInner       `json:"ptr"`
+	Meta map[string]string `json:"meta"`
+}
+
+func (r *proxyRequest) Greet(s string) string {
+	return s + " " + r.Name
+}
+
+func newProxyContext(object interface{}) *Context {
+	ctx := New()
+	ctx.PushGoProxy(object)
+	ctx.PutGlobalString("req")
+	return ctx
+}
+
+func TestPushGoProxyNested(t *testing.T) {
+
+	req := &proxyRequest{Name: "a", Ptr: &proxyInner{1}, Meta: map[string]string{"k": "v"}}
+
+	ctx := newProxyContext(req)
+	defer ctx.DestroyHeap()
+
+	evalString(t, ctx, `req.name = "b"; req.in.z = 9; req.ptr.z = 2; req.meta.x = "y"; delete req.meta.k`)
+
+	want := &proxyRequest{Name: "b", In: proxyInner{9}, Ptr: &proxyInner{2}, Meta: map[string]string{"x": "y"}}
+
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+
+	if got := evalString(t, ctx, `req.greet("hi")`); got != "hi b" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestPushGoProxyKeys(t *testing.T) {
+
+	req := &proxyRequest{Meta: map[string]string{"k": "v"}}
+
+	ctx := newProxyContext(req)
+	defer ctx.DestroyHeap()
+
+	got := evalString(t, ctx, `req.extra = 1; JSON.stringify([Object.keys(req), Object.keys(req.in), Object.keys(req.meta)])`)
+
+	if want := `[["name","in","ptr","meta","extra"],["z"],["k"]]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// The map changes in Go are seen by the next enumeration.
+
+	delete(req.Meta, "k")
+	req.Meta["n"] = "m"
+
+	if got := evalString(t, ctx, `JSON.stringify(Object.keys(req.meta))`); got != `["n"]` {
+		t.Errorf("got %s", got)
+	}
+
+	// Enumerating does not add properties to the value seen by scripts.
+
+	if got := evalString(t, ctx, `req.meta.k === undefined && !("k" in req.meta)`); got != "true" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestPushGoProxyTypeError(t *testing.T) {
+
+	req := &proxyRequest{}
+
+	ctx := newProxyContext(req)
+	defer ctx.DestroyHeap()
+
+	got := evalString(t, ctx, `try { req.in.z = [1]; "no error" } catch (e) { e.name }`)
+
+	if got != "TypeError" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,287 @@
+package duktape
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// REPLOptions configures Context.REPL.
+type REPLOptions struct {
+	// Prompt is "> " when empty, ContinuePrompt, shown while an input is
+	// incomplete, "... ".
+	Prompt         string
+	ContinuePrompt string
+	// Filename names the inputs in error stacks, "repl" when empty.
+	Filename string
+}
+
+const replHelp = `.break    Abandon the input being entered
+.exit     Exit the REPL
+.help     Print this help
+.load     Evaluate a file: .load path/to/file.js
+`
+
+// REPL runs a read-eval-print loop on the context, reading from in until
+// .exit or the end of the input and writing to out. Results are printed with
+// Inspect and kept in the global _. An input is read over several lines
+// until it is complete, e.g. until its brackets are closed. Scripts are
+// transpiled when EnableTranspiler was called.
+//
+// With an event loop (see NewLoop), the inputs are evaluated on the loop, so
+// that timers keep running between them, and ErrContextClosed is returned
+// once the heap is destroyed.
+func (d *Context) REPL(in io.Reader, out io.Writer, options REPLOptions) error {
+
+	if options.Prompt == "" {
+		options.Prompt = "> "
+	}
+
+	if options.ContinuePrompt == "" {
+		options.ContinuePrompt = "... "
+	}
+
+	if options.Filename == "" {
+		options.Filename = "repl"
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var input []string
+
+	for {
+
+		if len(input) == 0 {
+			fmt.Fprint(out, options.Prompt)
+		} else {
+			fmt.Fprint(out, options.ContinuePrompt)
+		}
+
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+
+		line := scanner.Text()
+
+		if len(input) == 0 || strings.HasPrefix(line, ".") {
+
+			command, arg := line, ""
+
+			if i := strings.IndexByte(line, ' '); i >= 0 {
+				command, arg = line[:i], strings.TrimSpace(line[i+1:])
+			}
+
+			switch command {
+			case ".exit":
+				return nil
+			case ".break":
+				input = nil
+				continue
+			case ".help":
+				fmt.Fprint(out, replHelp)
+				continue
+			case ".load":
+				if err := d.replDo(func() {
+					d.replLoad(arg, out)
+				}); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		input = append(input, line)
+		source := strings.Join(input, "\n")
+
+		if strings.TrimSpace(source) == "" {
+			input = nil
+			continue
+		}
+
+		if incompleteSource(source) {
+			continue
+		}
+
+		input = nil
+
+		if err := d.replDo(func() {
+			d.replEval(source, options.Filename, out)
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// replDo runs fn on the event loop of the context, if any, and waits for it.
+// It returns ErrContextClosed when the heap is destroyed meanwhile, fn being
+// dropped.
+func (d *Context) replDo(fn func()) error {
+
+	if d.loop == nil {
+		fn()
+		return nil
+	}
+
+	done := make(chan struct{})
+
+	d.loop.Post(func(ctx *Context) {
+		defer close(done)
+		fn()
+	})
+
+	select {
+	case <-done:
+		return nil
+	case <-d.loop.async.Done():
+	}
+
+	// fn may have run before the heap was destroyed.
+
+	select {
+	case <-done:
+		return nil
+	default:
+		return ErrContextClosed
+	}
+}
+
+func (d *Context) replEval(source string, filename string, out io.Writer) {
+
+	// Like Node.js, an input starting with a brace is an object literal
+	// rather than a block when it parses as one.
+
+	trimmed := strings.TrimSpace(source)
+
+	if strings.HasPrefix(trimmed, "{") && !strings.HasSuffix(trimmed, ";") {
+		if err := d.compileEval(filename, "("+source+"\n)"); err == nil {
+			d.replPrint(out)
+			return
+		}
+		d.Pop()
+	}
+
+	if err := d.compileEval(filename, source); err != nil {
+		fmt.Fprintln(out, errorStack(err))
+		d.Pop()
+		return
+	}
+
+	d.replPrint(out)
+}
+
+// replPrint calls the function at the top of the stack and prints its
+// result.
+func (d *Context) replPrint(out io.Writer) {
+
+	defer d.Pop()
+
+	if err := d.castStringToError(d.Pcall(0)); err != nil {
+		fmt.Fprintln(out, "Uncaught "+errorStack(err))
+		return
+	}
+
+	fmt.Fprintln(out, d.Inspect(-1))
+
+	d.PushGlobalObject()
+	d.Dup(-2)
+	d.PutPropString(-2, "_")
+	d.Pop()
+}
+
+func (d *Context) replLoad(filename string, out io.Writer) {
+
+	if filename == "" {
+		fmt.Fprintln(out, "usage: .load path/to/file.js")
+		return
+	}
+
+	b, err := os.ReadFile(filename)
+
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return
+	}
+
+	if err := d.compileEval(filename, string(b)); err != nil {
+		fmt.Fprintln(out, errorStack(err))
+		d.Pop()
+		return
+	}
+
+	if err := d.castStringToError(d.Pcall(0)); err != nil {
+		fmt.Fprintln(out, "Uncaught "+errorStack(err))
+	}
+
+	d.Pop()
+}
+
+// compileEval pushes the function for source compiled as eval code, which
+// returns the value of its last statement, transpiled when enabled. On
+// failure the error is returned and left on the stack.
+func (d *Context) compileEval(filename string, source string) error {
+
+	if d.transpile {
+
+		if err := d.installTranspilerHelpers(); err != nil {
+			d.pushTranspileError(err, filename)
+			return err
+		}
+
+		code, err := d.transpileSource(filename, source)
+
+		if err != nil {
+			return err
+		}
+
+		source = code
+	}
+
+	d.PushString(filename)
+
+	return d.PcompileLstringFilename(CompileEval, source, len(source))
+}
+
+func errorStack(err error) string {
+	var e *Error
+	if errors.As(err, &e) && e.Stack != "" {
+		return e.Stack
+	}
+	return err.Error()
+}
+
+// incompleteSource tells whether source looks like the beginning of an
+// input rather than an input with a syntax error: a bracket, a comment or a
+// template literal is left open, or it ends with an operator.
+func incompleteSource(source string) bool {
+
+	tokens, err := tokenize(source)
+
+	if err != nil {
+		e, ok := err.(*Error)
+		return ok && (strings.HasPrefix(e.Message, "unclosed") ||
+			e.Message == "unterminated comment" ||
+			e.Message == "unterminated template literal")
+	}
+
+	if len(tokens) < 2 {
+		return false
+	}
+
+	last := tokens[len(tokens)-2]
+
+	if last.kind != tokenPunct {
+		return false
+	}
+
+	switch last.text {
+	case ")", "]", "}", ";", "++", "--":
+		return false
+	}
+
+	return true
+}
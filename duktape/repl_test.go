@@ -0,0 +1,116 @@
+package duktape
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestREPL(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	in := strings.Join([]string{
+		`var a = 1`,
+		`a + 1`,
+		`_ * 10`,
+		`{a: [1, "b"]}`,
+		`function f() {`,
+		`  return 3;`,
+		`}`,
+		`f()`,
+		`(1 +`,
+		`.break`,
+		`null.x`,
+		`var = ;`,
+		`.help`,
+		`.exit`,
+		`"after exit"`,
+	}, "\n")
+
+	var out bytes.Buffer
+
+	if err := ctx.REPL(strings.NewReader(in), &out, REPLOptions{Prompt: "$ "}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+
+	for _, want := range []string{
+		"$ undefined\n$ 2\n$ 20\n$ { a: [ 1, 'b' ] }\n$ ... ... undefined\n$ 3\n$ ... $ Uncaught TypeError",
+		"SyntaxError",
+		".exit     Exit the REPL\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in %q", want, got)
+		}
+	}
+
+	if strings.Contains(got, "after exit") {
+		t.Errorf("read after .exit: %q", got)
+	}
+}
+
+func TestREPLLoop(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer l.Close()
+
+	// Timers keep running between the inputs and after .exit until the
+	// loop is closed.
+
+	in := "var n = 0; setInterval(function () { n++; }, 1); 'started'\n.exit\n"
+
+	var out bytes.Buffer
+
+	if err := l.Context().REPL(strings.NewReader(in), &out, REPLOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "'started'") {
+		t.Errorf("got %q", out.String())
+	}
+
+	time.Sleep(5 * time.Millisecond)
+}
+
+func TestREPLClosed(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer l.Close()
+
+	closed := make(chan struct{})
+
+	l.Dispatch().Sync(func() {
+		l.Context().PushGlobalGoFunction("exit", func() int {
+			go func() {
+				l.Close()
+				close(closed)
+			}()
+			return 0
+		})
+	})
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		done <- l.Context().REPL(r, io.Discard, REPLOptions{})
+	}()
+
+	io.WriteString(w, "exit()\n")
+	<-closed
+	io.WriteString(w, "1\n")
+
+	select {
+	case err := <-done:
+		if err != ErrContextClosed {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the REPL still waits")
+	}
+}
@@ -0,0 +1,123 @@
+package duktape
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/hailongz/kk-lib/kk"
+)
+
+var ErrContextClosed = errors.New("duktape: context closed")
+
+// SafeContext makes a Context usable from any goroutine by running every
+// operation on a single goroutine, locked to its OS thread, of a
+// kk.Dispatch. A context with an event loop (see NewLoop) runs on the
+// dispatch of the loop, and the Promise jobs are run after each operation.
+type SafeContext struct {
+	ctx      *Context
+	dispatch *kk.Dispatch
+	closed   bool
+	lock     sync.RWMutex
+}
+
+type safePanic struct {
+	value interface{}
+}
+
+// NewSafeContext wraps ctx, a new context when nil. From then on ctx must
+// only be used through the SafeContext.
+func NewSafeContext(ctx *Context) *SafeContext {
+
+	if ctx == nil {
+		ctx = New()
+	}
+
+	s := &SafeContext{ctx: ctx}
+
+	if ctx.loop != nil {
+		s.dispatch = ctx.loop.dispatch
+	} else {
+		s.dispatch = kk.NewDispatch()
+	}
+
+	// The dispatch goroutine keeps the thread until it exits.
+	s.dispatch.Async(runtime.LockOSThread)
+
+	return s
+}
+
+// Do calls fn with the context on the goroutine of the context and waits
+// for it to return. A panic in fn is raised again in the caller. fn must
+// not call Do itself.
+func (s *SafeContext) Do(fn func(ctx *Context)) error {
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return ErrContextClosed
+	}
+
+	var p *safePanic
+
+	s.dispatch.Sync(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				p = &safePanic{r}
+			}
+		}()
+		fn(s.ctx)
+		if s.ctx.loop != nil {
+			s.ctx.loop.runJobs()
+		}
+	})
+
+	if p != nil {
+		panic(p.value)
+	}
+
+	return nil
+}
+
+// Eval evaluates src and returns its result converted by ToValue. Script
+// errors are returned as *Error.
+func (s *SafeContext) Eval(src string) (interface{}, error) {
+
+	var v interface{}
+	var err error
+
+	if e := s.Do(func(ctx *Context) {
+		defer ctx.Pop()
+		if err = ctx.PevalString(src); err == nil {
+			v = ctx.ToValue(-1)
+		}
+	}); e != nil {
+		return nil, e
+	}
+
+	return v, err
+}
+
+// Close destroys the heap once the operations in progress are done. A
+// context with an event loop is closed with Loop.Close, otherwise the
+// dispatch is stopped.
+func (s *SafeContext) Close() {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+
+	if s.ctx.loop != nil {
+		s.ctx.loop.Close()
+		return
+	}
+
+	s.dispatch.Sync(s.ctx.DestroyHeap)
+	s.dispatch.Break()
+}
@@ -0,0 +1,124 @@
+package duktape
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSafeContext(t *testing.T) {
+
+	s := NewSafeContext(nil)
+
+	if _, err := s.Eval(`var n = 0; function inc() { return ++n; }`); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := s.Eval(`inc()`); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if v, err := s.Eval(`n`); err != nil || v != 400.0 {
+		t.Errorf("got %v, %v", v, err)
+	}
+
+	if _, err := s.Eval(`null.x`); err == nil {
+		t.Error("expected an error")
+	}
+
+	s.Close()
+	s.Close()
+
+	if _, err := s.Eval(`n`); err != ErrContextClosed {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSafeContextPanic(t *testing.T) {
+
+	s := NewSafeContext(nil)
+	defer s.Close()
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("got %v", r)
+			}
+		}()
+		s.Do(func(ctx *Context) {
+			panic("boom")
+		})
+	}()
+
+	// The context is still usable.
+
+	if v, err := s.Eval(`1 + 1`); err != nil || v != 2.0 {
+		t.Errorf("got %v, %v", v, err)
+	}
+}
+
+func TestSafeContextLoop(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+
+	exited := make(chan struct{})
+	l.Dispatch().OnExit = func() { close(exited) }
+
+	s := NewSafeContext(l.Context())
+
+	// Promise jobs run after each operation.
+
+	if v, err := s.Eval(`var out = []; Promise.resolve(1).then(function (v) { out.push(v); }); out.length`); err != nil || v != 0.0 {
+		t.Fatalf("got %v, %v", v, err)
+	}
+
+	if v, err := s.Eval(`out.join()`); err != nil || v != "1" {
+		t.Errorf("got %v, %v", v, err)
+	}
+
+	// Close stops the pending timers with the heap.
+
+	if _, err := s.Eval(`setInterval(function () { out.push(2); }, 1); setTimeout(function () {}, 1000)`); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	s.Close()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- l.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the timers are still counted")
+	}
+
+	// The loop created the dispatch, which is stopped with it.
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Error("the dispatch still runs")
+	}
+}
@@ -0,0 +1,292 @@
+package duktape
+
+import (
+	"errors"
+	"fmt"
+	xhttp "net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/hailongz/kk-lib/dynamic"
+	"github.com/hailongz/kk-lib/http"
+	"github.com/hailongz/kk-lib/kk"
+)
+
+// sandboxGlobals are the side effect free built-ins kept in every sandbox.
+var sandboxGlobals = []string{
+	"Array", "ArrayBuffer", "Boolean", "DataView", "Date", "Error", "EvalError",
+	"Float32Array", "Float64Array", "Function", "Infinity", "Int16Array",
+	"Int32Array", "Int8Array", "JSON", "Math", "NaN", "Number", "Object",
+	"RangeError", "ReferenceError", "RegExp", "String", "SyntaxError",
+	"TypeError", "URIError", "Uint16Array", "Uint32Array", "Uint8Array",
+	"Uint8ClampedArray", "decodeURI", "decodeURIComponent", "encodeURI",
+	"encodeURIComponent", "escape", "eval", "isFinite", "isNaN", "parseFloat",
+	"parseInt", "undefined", "unescape",
+}
+
+const blockEvalSource = `(function (global) {
+	var blocked = function () {
+		throw new EvalError('code generation from strings is not allowed');
+	};
+	blocked.prototype = Function.prototype;
+	Object.defineProperty(Function.prototype, 'constructor', { value: blocked });
+	Object.defineProperty(global, 'Function', { value: blocked, writable: true, configurable: true });
+	delete global.eval;
+})(this)`
+
+// Capability installs globals granted to a sandboxed context.
+type Capability func(ctx *Context) error
+
+// Sandbox builds contexts for untrusted scripts. The global object only
+// keeps the standard ECMAScript built-ins (no Duktape, Proxy, Reflect,
+// performance...) plus what is explicitly allowed or granted.
+type Sandbox struct {
+	options      Options
+	allowed      []string
+	disableEval  bool
+	capabilities []Capability
+}
+
+func NewSandbox() *Sandbox {
+	return &Sandbox{}
+}
+
+// WithOptions sets the options of the heaps created by the sandbox.
+func (s *Sandbox) WithOptions(options Options) *Sandbox {
+	s.options = options
+	return s
+}
+
+// Allow keeps additional built-in globals, e.g. "TextEncoder".
+func (s *Sandbox) Allow(names ...string) *Sandbox {
+	s.allowed = append(s.allowed, names...)
+	return s
+}
+
+// DisableEval removes eval and makes the Function constructor throw, so
+// scripts cannot compile code from strings.
+func (s *Sandbox) DisableEval() *Sandbox {
+	s.disableEval = true
+	return s
+}
+
+// Grant adds a capability, capabilities are installed in order.
+func (s *Sandbox) Grant(capability Capability) *Sandbox {
+	s.capabilities = append(s.capabilities, capability)
+	return s
+}
+
+// New creates a sandboxed context.
+func (s *Sandbox) New() (*Context, error) {
+
+	ctx, err := NewWithOptions(s.options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keep := map[string]bool{}
+
+	for _, name := range sandboxGlobals {
+		keep[name] = true
+	}
+
+	for _, name := range s.allowed {
+		keep[name] = true
+	}
+
+	ctx.PushGlobalObject()
+
+	for _, name := range ctx.GlobalNames() {
+		if !keep[name] {
+			ctx.DelPropString(-1, name)
+		}
+	}
+
+	ctx.Pop()
+
+	if s.disableEval {
+		if err = ctx.PevalString(blockEvalSource); err != nil {
+			ctx.DestroyHeap()
+			return nil, err
+		}
+		ctx.Pop()
+	}
+
+	for _, capability := range s.capabilities {
+		if err = capability(ctx); err != nil {
+			ctx.DestroyHeap()
+			return nil, err
+		}
+	}
+
+	return ctx, nil
+}
+
+// GlobalNames returns the sorted names of all own properties of the global
+// object, enumerable or not.
+func (d *Context) GlobalNames() []string {
+
+	names := []string{}
+
+	d.PushGlobalObject()
+	d.Enum(-1, DUK_ENUM_OWN_PROPERTIES_ONLY|DUK_ENUM_INCLUDE_NONENUMERABLE)
+
+	for d.Next(-1, false) {
+		names = append(names, d.getGoString(-1))
+		d.Pop()
+	}
+
+	d.Pop2()
+
+	sort.Strings(names)
+
+	return names
+}
+
+// TimersCapability grants setTimeout and friends by binding an event loop on
+// dispatch (a new one when nil) to the context.
+func TimersCapability(dispatch *kk.Dispatch) Capability {
+	return func(ctx *Context) error {
+		NewLoop(ctx, dispatch)
+		return nil
+	}
+}
+
+// KVCapability grants a frozen global object name with get(key), has(key)
+// and keys() reading from data. Scripts receive copies of the values, so
+// they cannot modify the store.
+func KVCapability(name string, data map[string]interface{}) Capability {
+	return func(ctx *Context) error {
+
+		ctx.PushGlobalObject()
+		ctx.PushObject()
+
+		ctx.PushGoFunc(func(key string) interface{} {
+			return data[key]
+		})
+		ctx.PutPropString(-2, "get")
+
+		ctx.PushGoFunc(func(key string) bool {
+			_, ok := data[key]
+			return ok
+		})
+		ctx.PutPropString(-2, "has")
+
+		ctx.PushGoFunc(func() []string {
+			keys := make([]string, 0, len(data))
+			for key := range data {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			return keys
+		})
+		ctx.PutPropString(-2, "keys")
+
+		ctx.Freeze(-1)
+		ctx.PutPropString(-2, name)
+		ctx.Pop()
+
+		ctx.markHostGlobals(name)
+
+		return nil
+	}
+}
+
+var ErrHostNotAllowed = errors.New("host not allowed")
+
+// HostAllowed reports whether the host of rawurl is one of hosts. A host
+// starting with "*." also matches its subdomains.
+func HostAllowed(rawurl string, hosts []string) bool {
+
+	u, err := url.Parse(rawurl)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if h == host || h == u.Host || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// restrictedClient returns a copy of client (a new http package client when
+// nil) refusing to follow redirects to hosts not allowed.
+func restrictedClient(client *xhttp.Client, hosts []string) *xhttp.Client {
+
+	var c xhttp.Client
+
+	if client != nil {
+		c = *client
+	} else {
+		c = *http.NewClient()
+	}
+
+	c.CheckRedirect = func(req *xhttp.Request, via []*xhttp.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !HostAllowed(req.URL.String(), hosts) {
+			return fmt.Errorf("%s: %s", req.URL.String(), ErrHostNotAllowed)
+		}
+		return nil
+	}
+
+	return &c
+}
+
+// HTTPCapability grants a global http.request(options) restricted to hosts.
+// The options are url, method, type, responseType, data and headers as in
+// the http package; the call blocks until the response arrives. Redirects to
+// other hosts fail.
+func HTTPCapability(hosts ...string) Capability {
+
+	client := restrictedClient(nil, hosts)
+
+	return func(ctx *Context) error {
+
+		ctx.PushGlobalObject()
+		ctx.PushObject()
+
+		ctx.PushGoFunc(func(options map[string]interface{}) (interface{}, error) {
+
+			opt := http.Options{
+				Url:          dynamic.StringValue(options["url"], ""),
+				Method:       strings.ToUpper(dynamic.StringValue(options["method"], "GET")),
+				Type:         dynamic.StringValue(options["type"], http.OptionTypeUrlencode),
+				ResponseType: dynamic.StringValue(options["responseType"], http.OptionResponseTypeText),
+				Data:         options["data"],
+				Headers:      map[string]string{},
+				Client:       client,
+			}
+
+			if !HostAllowed(opt.Url, hosts) {
+				return nil, fmt.Errorf("%s: %s", opt.Url, ErrHostNotAllowed)
+			}
+
+			dynamic.Each(options["headers"], func(key interface{}, value interface{}) bool {
+				opt.Headers[dynamic.StringValue(key, "")] = dynamic.StringValue(value, "")
+				return true
+			})
+
+			return http.Send(&opt)
+		})
+		ctx.PutPropString(-2, "request")
+
+		ctx.Freeze(-1)
+		ctx.PutPropString(-2, "http")
+		ctx.Pop()
+
+		ctx.markHostGlobals("http")
+
+		return nil
+	}
+}
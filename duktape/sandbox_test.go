@@ -0,0 +1,155 @@
+package duktape
+
+import (
+	"fmt"
+	xhttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSandboxGlobals(t *testing.T) {
+
+	ctx, err := NewSandbox().Allow("Proxy").New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ctx.DestroyHeap()
+
+	for src, want := range map[string]string{
+		`typeof Duktape`:                 "undefined",
+		`typeof Reflect`:                 "undefined",
+		`typeof Proxy`:                   "function",
+		`typeof JSON.stringify`:          "function",
+		`eval("1 + 1")`:                  "2",
+		`new Function("return 3")()`:     "3",
+		`Object.keys(this).length === 0`: "true",
+		`[1, 2].map(function (v) { return v * 2; }).join()`: "2,4",
+	} {
+		if got := evalString(t, ctx, src); got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestSandboxDisableEval(t *testing.T) {
+
+	ctx, err := NewSandbox().DisableEval().New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ctx.DestroyHeap()
+
+	for _, src := range []string{
+		`eval("1")`,
+		`new Function("return 1")()`,
+		`(function () {}).constructor("return 1")()`,
+	} {
+
+		err := ctx.PevalString(src)
+		ctx.Pop()
+
+		if err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+
+	if got := evalString(t, ctx, `(function () { return 1; }) instanceof Function`); got != "true" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSandboxKVCapability(t *testing.T) {
+
+	ctx, err := NewSandbox().Grant(KVCapability("kv", map[string]interface{}{
+		"a": map[string]interface{}{"n": 1.0},
+		"b": "x",
+	})).New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ctx.DestroyHeap()
+
+	for src, want := range map[string]string{
+		`kv.get("a").n`:                                       "1",
+		`kv.has("b") + "," + kv.has("c")`:                     "true,false",
+		`kv.keys().join()`:                                    "a,b",
+		`kv.get("a").n = 2; kv.get("a").n`:                    "1",
+		`kv.get = null; typeof kv.get`:                        "function",
+		`"use strict"; try { kv.x = 1 } catch (e) { e.name }`: "TypeError",
+	} {
+		if got := evalString(t, ctx, src); got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+
+	hosts := []string{"example.com", "*.api.test", "localhost:8080"}
+
+	for rawurl, want := range map[string]bool{
+		"https://example.com/a":        true,
+		"http://EXAMPLE.com":           true,
+		"https://www.example.com":      false,
+		"https://v1.api.test/x":        true,
+		"https://api.test":             false,
+		"http://localhost:8080/":       true,
+		"http://localhost:9090/":       false,
+		"ftp://example.com":            false,
+		"https://example.com.evil.net": false,
+	} {
+		if got := HostAllowed(rawurl, hosts); got != want {
+			t.Errorf("%s: got %v", rawurl, got)
+		}
+	}
+}
+
+func TestSandboxHTTPCapability(t *testing.T) {
+
+	other := httptest.NewServer(xhttp.HandlerFunc(func(w xhttp.ResponseWriter, r *xhttp.Request) {
+		fmt.Fprint(w, "other")
+	}))
+	defer other.Close()
+
+	server := httptest.NewServer(xhttp.HandlerFunc(func(w xhttp.ResponseWriter, r *xhttp.Request) {
+		if r.URL.Path == "/redirect" {
+			xhttp.Redirect(w, r, other.URL, xhttp.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "hello "+r.URL.Query().Get("name"))
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ctx, err := NewSandbox().Grant(HTTPCapability(host)).New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ctx.DestroyHeap()
+
+	src := fmt.Sprintf(`http.request({url: %q, data: {name: "js"}})`, server.URL+"/")
+
+	if got := evalString(t, ctx, src); got != "hello js" {
+		t.Errorf("got %q", got)
+	}
+
+	for _, u := range []string{other.URL, server.URL + "/redirect"} {
+
+		err := ctx.PevalString(fmt.Sprintf(`http.request({url: %q})`, u))
+		ctx.Pop()
+
+		if err == nil || !strings.Contains(err.Error(), ErrHostNotAllowed.Error()) {
+			t.Errorf("%s: got %v", u, err)
+		}
+	}
+}
@@ -0,0 +1,720 @@
+package duktape
+
+/*
+#include "duk_config.h"
+#include "duktape.h"
+#include "kk.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"unsafe"
+)
+
+const snapshotHelperKey = "kk.snapshot"
+const hostGlobalsKey = "kk.hostGlobals"
+
+var ErrSnapshotUnsupported = errors.New("value cannot be saved")
+var ErrSnapshotInvalid = errors.New("duktape: invalid snapshot or snapshot of another Duktape build")
+
+// SnapshotError reports a value Snapshot cannot save, such as a Go object.
+type SnapshotError struct {
+	// Path locates the value from the global object, e.g. order.items[2].
+	Path   string
+	Reason string
+}
+
+func (e *SnapshotError) Error() string {
+	return "duktape: cannot save " + e.Path + ": " + e.Reason
+}
+
+func (e *SnapshotError) Unwrap() error {
+	return ErrSnapshotUnsupported
+}
+
+// SnapshotOptions selects the globals saved by Snapshot.
+type SnapshotOptions struct {
+	// Globals lists the globals to save when not nil. By default every
+	// enumerable global is saved but the built-in ones and the ones
+	// installed by the host, such as the timers of NewLoop, console,
+	// require or the functions of PushGlobalGoFunc, which the host of the
+	// restoring context installs again.
+	Globals []string
+	// Exclude lists other globals not to save.
+	Exclude []string
+}
+
+const (
+	snapshotUndefined byte = iota
+	snapshotNull
+	snapshotBoolean
+	snapshotNumber
+	snapshotString
+	snapshotRef
+)
+
+type snapshotValue struct {
+	Type   byte
+	Bool   bool
+	Number float64
+	String string
+	// Ref is the index of an object in snapshotData.Nodes.
+	Ref int
+}
+
+// Property flags, as returned by the describe helper.
+const (
+	snapshotEnumerable = 1 << iota
+	snapshotWritable
+	snapshotConfigurable
+	snapshotAccessor
+)
+
+type snapshotProp struct {
+	Key   string
+	Flags int
+	Value snapshotValue
+	Get   snapshotValue
+	Set   snapshotValue
+}
+
+type snapshotNode struct {
+	// Kind is object, array, function, date, regexp, error or buffer.
+	Kind string
+	// Class is the constructor of errors and buffers.
+	Class string
+	// Data holds the bytes of buffers and the bytecode of functions.
+	Data   []byte
+	Time   float64
+	Source string
+	Flags  string
+	Length int
+	// Proto is the prototype when not the default one.
+	Proto *snapshotValue
+	Props []snapshotProp
+	// Fixed is set for objects not extensible, sealed or frozen.
+	Fixed bool
+}
+
+type snapshotData struct {
+	Globals []snapshotProp
+	Nodes   []snapshotNode
+}
+
+// Snapshot serializes global variables so that Restore can recreate them in
+// another heap, possibly in another process. Objects keep their identity,
+// cycles included, along with their own properties (attributes, getters and
+// setters included) and prototype. Supported values are the primitives,
+// plain objects, arrays, dates, regular expressions, errors, buffers and
+// script functions, saved as bytecode (see DumpFunction).
+//
+// Since bytecode does not capture variables, only the functions created in
+// the global scope can be saved: closures over the variables of an enclosing
+// function, Go functions and objects, native functions, bound functions and
+// other objects fail with a *SnapshotError locating the value.
+func (d *Context) Snapshot(options SnapshotOptions) ([]byte, error) {
+
+	w := &snapshotWriter{d: d, refs: map[unsafe.Pointer]int{}}
+
+	exclude := map[string]bool{}
+
+	for _, name := range options.Exclude {
+		exclude[name] = true
+	}
+
+	top := d.GetTop()
+	defer d.SetTop(top)
+
+	names := options.Globals
+
+	d.PushGlobalObject()
+
+	if names == nil {
+		host := d.hostGlobals()
+		d.Enum(-1, DUK_ENUM_OWN_PROPERTIES_ONLY)
+		for d.Next(-1, false) {
+			if name := d.getGoString(-1); !snapshotBuiltins[name] && !host[name] {
+				names = append(names, name)
+			}
+			d.Pop()
+		}
+		d.Pop()
+	}
+
+	var data snapshotData
+
+	for _, name := range names {
+
+		if exclude[name] {
+			continue
+		}
+
+		d.GetPropString(-1, name)
+		v, err := w.value(-1, name)
+		d.Pop()
+
+		if err != nil {
+			return nil, err
+		}
+
+		data.Globals = append(data.Globals, snapshotProp{Key: name, Value: v})
+	}
+
+	data.Nodes = w.nodes
+
+	var b bytes.Buffer
+
+	if err := gob.NewEncoder(&b).Encode(&data); err != nil {
+		return nil, err
+	}
+
+	// Like the bytecode files of ScriptCache, the snapshot is checked
+	// before its bytecode is loaded, which Duktape does not validate.
+
+	sum := sha256.Sum256(b.Bytes())
+	header := "kksnap " + bytecodeVersion + " " + hex.EncodeToString(sum[:]) + "\n"
+
+	return append([]byte(header), b.Bytes()...), nil
+}
+
+// markHostGlobals records globals installed by the host, which Snapshot
+// skips by default.
+func (d *Context) markHostGlobals(names ...string) {
+
+	d.PushGlobalStash()
+
+	if !d.GetPropString(-1, hostGlobalsKey) {
+		d.Pop()
+		d.PushObject()
+		d.Dup(-1)
+		d.PutPropString(-3, hostGlobalsKey)
+	}
+
+	for _, name := range names {
+		d.PushBoolean(true)
+		d.PutPropString(-2, name)
+	}
+
+	d.Pop2()
+}
+
+func (d *Context) hostGlobals() map[string]bool {
+
+	names := map[string]bool{}
+
+	d.PushGlobalStash()
+
+	if d.GetPropString(-1, hostGlobalsKey) {
+		d.Enum(-1, DUK_ENUM_OWN_PROPERTIES_ONLY)
+		for d.Next(-1, false) {
+			names[d.getGoString(-1)] = true
+			d.Pop()
+		}
+		d.Pop()
+	}
+
+	d.Pop2()
+
+	return names
+}
+
+type snapshotWriter struct {
+	d     *Context
+	refs  map[unsafe.Pointer]int
+	nodes []snapshotNode
+}
+
+// snapshotBuiltins are the enumerable globals defined by Duktape.
+var snapshotBuiltins = map[string]bool{"performance": true}
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+func propertyPath(path string, key string) string {
+	if identifierPattern.MatchString(key) {
+		return path + "." + key
+	}
+	if _, err := strconv.ParseUint(key, 10, 32); err == nil {
+		return path + "[" + key + "]"
+	}
+	return path + "[" + strconv.Quote(key) + "]"
+}
+
+func (w *snapshotWriter) value(idx int, path string) (snapshotValue, error) {
+
+	d := w.d
+
+	switch d.GetType(idx) {
+	case TypeNone, TypeUndefined:
+		return snapshotValue{Type: snapshotUndefined}, nil
+	case TypeNull:
+		return snapshotValue{Type: snapshotNull}, nil
+	case TypeBoolean:
+		return snapshotValue{Type: snapshotBoolean, Bool: d.GetBoolean(idx)}, nil
+	case TypeNumber:
+		return snapshotValue{Type: snapshotNumber, Number: d.GetNumber(idx)}, nil
+	case TypeString:
+		return snapshotValue{Type: snapshotString, String: d.getGoString(idx)}, nil
+	case TypeBuffer:
+		w.nodes = append(w.nodes, snapshotNode{Kind: "buffer", Data: d.getBytes(idx)})
+		return snapshotValue{Type: snapshotRef, Ref: len(w.nodes) - 1}, nil
+	case TypeObject:
+		return w.object(d.NormalizeIndex(idx), path)
+	case TypeLightFunc:
+		return snapshotValue{}, &SnapshotError{path, "native function"}
+	}
+
+	return snapshotValue{}, &SnapshotError{path, "pointer"}
+}
+
+func (w *snapshotWriter) object(idx int, path string) (snapshotValue, error) {
+
+	d := w.d
+	ptr := d.GetHeapptr(idx)
+
+	if ref, ok := w.refs[ptr]; ok {
+		return snapshotValue{Type: snapshotRef, Ref: ref}, nil
+	}
+
+	if object := d.ToGoObject(idx); object != nil {
+		if _, ok := object.(func() int); ok {
+			return snapshotValue{}, &SnapshotError{path, "Go function"}
+		}
+		return snapshotValue{}, &SnapshotError{path, fmt.Sprintf("Go object (%T)", object)}
+	}
+
+	ref := len(w.nodes)
+	w.refs[ptr] = ref
+	w.nodes = append(w.nodes, snapshotNode{})
+
+	class, err := w.helperString("classOf", idx)
+
+	if err != nil {
+		return snapshotValue{}, err
+	}
+
+	node := snapshotNode{Kind: "object"}
+	skip := map[string]bool{}
+
+	switch {
+	case d.IsFunction(idx):
+		if d.IsBoundFunction(idx) {
+			return snapshotValue{}, &SnapshotError{path, "bound function"}
+		}
+		if !d.IsEcmascriptFunction(idx) {
+			return snapshotValue{}, &SnapshotError{path, "native function"}
+		}
+		if C.kk_is_global_function(d.duk_context, C.duk_idx_t(idx)) == 0 {
+			return snapshotValue{}, &SnapshotError{path, "closure over the variables of an enclosing function"}
+		}
+		d.Dup(idx)
+		b, err := d.dumpBytecode()
+		if err != nil {
+			return snapshotValue{}, &SnapshotError{path, err.Error()}
+		}
+		node.Kind = "function"
+		node.Data = b
+		// Restored from the bytecode.
+		skip["length"] = true
+		skip["name"] = true
+		skip["fileName"] = true
+	case C.duk_is_buffer_data(d.duk_context, C.duk_idx_t(idx)) != 0:
+		node.Kind = "buffer"
+		node.Class = class
+		node.Data = d.getBytes(idx)
+		w.nodes[ref] = node
+		return snapshotValue{Type: snapshotRef, Ref: ref}, nil
+	case d.IsArray(idx):
+		node.Kind = "array"
+		node.Length = d.GetLength(idx)
+		skip["length"] = true
+	case class == "Date":
+		node.Kind = "date"
+		if err := w.helper("time", idx); err != nil {
+			return snapshotValue{}, err
+		}
+		node.Time = d.GetNumber(-1)
+		d.Pop()
+	case class == "RegExp":
+		node.Kind = "regexp"
+		if err := w.helper("regexp", idx); err != nil {
+			return snapshotValue{}, err
+		}
+		d.GetPropIndex(-1, 0)
+		node.Source = d.getGoString(-1)
+		d.GetPropIndex(-2, 1)
+		node.Flags = d.getGoString(-1)
+		d.PopN(3)
+		skip["lastIndex"] = true
+	case class == "Error":
+		node.Kind = "error"
+		if node.Class, err = w.helperString("errorName", idx); err != nil {
+			return snapshotValue{}, err
+		}
+	case class != "Object":
+		return snapshotValue{}, &SnapshotError{path, class + " object"}
+	}
+
+	if node.Kind == "object" || node.Kind == "error" {
+		if err := w.helper("prototype", idx); err != nil {
+			return snapshotValue{}, err
+		}
+		if !d.IsUndefined(-1) {
+			v, err := w.value(-1, path+".__proto__")
+			if err != nil {
+				return snapshotValue{}, err
+			}
+			node.Proto = &v
+		}
+		d.Pop()
+	}
+
+	if err := w.helper("extensible", idx); err != nil {
+		return snapshotValue{}, err
+	}
+
+	node.Fixed = !d.GetBoolean(-1)
+	d.Pop()
+
+	if err := w.helper("describe", idx); err != nil {
+		return snapshotValue{}, err
+	}
+
+	n := d.GetLength(-1)
+
+	for i := 0; i < n; i++ {
+
+		d.GetPropIndex(-1, uint(i))
+
+		d.GetPropIndex(-1, 0)
+		key := d.getGoString(-1)
+		d.GetPropIndex(-2, 1)
+		flags := d.GetInt(-1)
+		d.Pop2()
+
+		if skip[key] {
+			d.Pop()
+			continue
+		}
+
+		p := snapshotProp{Key: key, Flags: flags}
+		keyPath := propertyPath(path, key)
+
+		if flags&snapshotAccessor != 0 {
+			d.GetPropIndex(-1, 3)
+			p.Get, err = w.value(-1, keyPath+" getter")
+			d.Pop()
+			if err == nil {
+				d.GetPropIndex(-1, 4)
+				p.Set, err = w.value(-1, keyPath+" setter")
+				d.Pop()
+			}
+		} else {
+			d.GetPropIndex(-1, 2)
+			p.Value, err = w.value(-1, keyPath)
+			d.Pop()
+		}
+
+		d.Pop()
+
+		if err != nil {
+			return snapshotValue{}, err
+		}
+
+		node.Props = append(node.Props, p)
+	}
+
+	d.Pop()
+
+	w.nodes[ref] = node
+
+	return snapshotValue{Type: snapshotRef, Ref: ref}, nil
+}
+
+// helper calls a function of snapshotSource with the value at idx and
+// pushes the result.
+func (w *snapshotWriter) helper(name string, idx int) error {
+	d := w.d
+	idx = d.NormalizeIndex(idx)
+	d.pushSnapshotHelper(name)
+	d.Dup(idx)
+	if err := d.castStringToError(d.Pcall(1)); err != nil {
+		d.Pop()
+		return err
+	}
+	return nil
+}
+
+func (w *snapshotWriter) helperString(name string, idx int) (string, error) {
+	if err := w.helper(name, idx); err != nil {
+		return "", err
+	}
+	s := w.d.getGoString(-1)
+	w.d.Pop()
+	return s, nil
+}
+
+// Restore recreates in the context the globals saved by Snapshot, replacing
+// existing globals of the same names. Snapshots only restore in a build of
+// the same Duktape version and platform, and ErrSnapshotInvalid is returned
+// for a truncated or corrupted one.
+func (d *Context) Restore(b []byte) error {
+
+	i := bytes.IndexByte(b, '\n')
+
+	if i < 0 {
+		return ErrSnapshotInvalid
+	}
+
+	sum := sha256.Sum256(b[i+1:])
+
+	if string(b[:i]) != "kksnap "+bytecodeVersion+" "+hex.EncodeToString(sum[:]) {
+		return ErrSnapshotInvalid
+	}
+
+	var data snapshotData
+
+	if err := gob.NewDecoder(bytes.NewReader(b[i+1:])).Decode(&data); err != nil {
+		return ErrSnapshotInvalid
+	}
+
+	top := d.GetTop()
+	defer d.SetTop(top)
+
+	d.PushArray()
+	nodes := d.GetTop() - 1
+
+	for i, n := range data.Nodes {
+		if err := d.pushSnapshotNode(n); err != nil {
+			return err
+		}
+		d.PutPropIndex(nodes, uint(i))
+	}
+
+	for i, n := range data.Nodes {
+
+		if n.Proto == nil && len(n.Props) == 0 && n.Kind != "array" && !n.Fixed {
+			continue
+		}
+
+		d.GetPropIndex(nodes, uint(i))
+
+		if n.Proto != nil {
+			d.pushSnapshotHelper("setPrototype")
+			d.Dup(-2)
+			d.pushSnapshotValue(*n.Proto, nodes)
+			if err := d.castStringToError(d.Pcall(2)); err != nil {
+				return err
+			}
+			d.Pop()
+		}
+
+		for _, p := range n.Props {
+			d.pushSnapshotHelper("define")
+			d.Dup(-2)
+			d.pushGoString(p.Key)
+			d.PushInt(p.Flags)
+			d.pushSnapshotValue(p.Value, nodes)
+			d.pushSnapshotValue(p.Get, nodes)
+			d.pushSnapshotValue(p.Set, nodes)
+			if err := d.castStringToError(d.Pcall(6)); err != nil {
+				return err
+			}
+			d.Pop()
+		}
+
+		if n.Kind == "array" {
+			d.PushInt(n.Length)
+			d.PutPropString(-2, "length")
+		}
+
+		if n.Fixed {
+			d.pushSnapshotHelper("preventExtensions")
+			d.Dup(-2)
+			if err := d.castStringToError(d.Pcall(1)); err != nil {
+				return err
+			}
+			d.Pop()
+		}
+
+		d.Pop()
+	}
+
+	d.PushGlobalObject()
+
+	for _, p := range data.Globals {
+		d.pushSnapshotValue(p.Value, nodes)
+		d.PutPropString(-2, p.Key)
+	}
+
+	return nil
+}
+
+func (d *Context) pushSnapshotValue(v snapshotValue, nodes int) {
+	switch v.Type {
+	case snapshotNull:
+		d.PushNull()
+	case snapshotBoolean:
+		d.PushBoolean(v.Bool)
+	case snapshotNumber:
+		d.PushNumber(v.Number)
+	case snapshotString:
+		d.pushGoString(v.String)
+	case snapshotRef:
+		d.GetPropIndex(nodes, uint(v.Ref))
+	default:
+		d.PushUndefined()
+	}
+}
+
+// pushSnapshotNode pushes a new object of the kind of n, without its
+// properties.
+func (d *Context) pushSnapshotNode(n snapshotNode) error {
+
+	switch n.Kind {
+	case "object":
+		d.PushObject()
+		return nil
+	case "array":
+		d.PushArray()
+		return nil
+	case "function":
+		return d.loadBytecode(n.Data)
+	case "buffer":
+		if n.Class == "" {
+			d.pushBytes(n.Data)
+			return nil
+		}
+	}
+
+	d.pushSnapshotHelper("create")
+	d.PushString(n.Kind)
+	d.PushString(n.Class)
+
+	switch n.Kind {
+	case "buffer":
+		d.pushBytes(n.Data)
+		d.PushUndefined()
+	case "date":
+		d.PushNumber(n.Time)
+		d.PushUndefined()
+	case "regexp":
+		d.pushGoString(n.Source)
+		d.PushString(n.Flags)
+	default:
+		d.PushUndefined()
+		d.PushUndefined()
+	}
+
+	return d.castStringToError(d.Pcall(4))
+}
+
+func (d *Context) pushSnapshotHelper(name string) {
+
+	d.PushGlobalStash()
+
+	if !d.GetPropString(-1, snapshotHelperKey) {
+		d.Pop()
+		d.PevalString(snapshotSource)
+		d.Dup(-1)
+		d.PutPropString(-3, snapshotHelperKey)
+	}
+
+	d.GetPropString(-1, name)
+	d.Remove(-2)
+	d.Remove(-2)
+}
+
+const snapshotSource = `(function (global) {
+
+	var toString = Object.prototype.toString;
+	var errors = ['EvalError', 'RangeError', 'ReferenceError', 'SyntaxError', 'TypeError', 'URIError', 'Error'];
+
+	var errorConstructor = function (e) {
+		for (var i = 0; i < errors.length; i++) {
+			if (e instanceof global[errors[i]]) {
+				return global[errors[i]];
+			}
+		}
+		return Error;
+	};
+
+	return {
+		classOf: function (v) {
+			return toString.call(v).slice(8, -1);
+		},
+		errorName: function (e) {
+			return errorConstructor(e).name;
+		},
+		prototype: function (v) {
+			var p = Object.getPrototypeOf(v);
+			if (p === Object.prototype || (v instanceof Error && p === errorConstructor(v).prototype)) {
+				return undefined;
+			}
+			return p;
+		},
+		describe: function (o) {
+			return Object.getOwnPropertyNames(o).map(function (k) {
+				var d = Object.getOwnPropertyDescriptor(o, k);
+				var accessor = 'get' in d || 'set' in d;
+				var flags = (d.enumerable ? 1 : 0) | (d.writable ? 2 : 0) | (d.configurable ? 4 : 0) | (accessor ? 8 : 0);
+				return [k, flags, d.value, d.get, d.set];
+			});
+		},
+		extensible: function (o) {
+			return Object.isExtensible(o);
+		},
+		preventExtensions: function (o) {
+			Object.preventExtensions(o);
+		},
+		time: function (d) {
+			return d.getTime();
+		},
+		regexp: function (r) {
+			return [r.source, (r.global ? 'g' : '') + (r.ignoreCase ? 'i' : '') + (r.multiline ? 'm' : '')];
+		},
+		create: function (kind, cls, a, b) {
+			switch (kind) {
+			case 'date':
+				return new Date(a);
+			case 'regexp':
+				return new RegExp(a, b);
+			case 'error':
+				return new (errors.indexOf(cls) >= 0 ? global[cls] : Error)();
+			}
+			var buffer = new Uint8Array(a).buffer;
+			if (cls === 'ArrayBuffer') {
+				return buffer;
+			}
+			var C = typeof global[cls] === 'function' ? global[cls] : Uint8Array;
+			return new C(buffer);
+		},
+		setPrototype: function (o, p) {
+			Object.setPrototypeOf(o, p);
+		},
+		define: function (o, k, flags, value, get, set) {
+			var d = Object.getOwnPropertyDescriptor(o, k);
+			if (d && !d.configurable) {
+				if (d.writable) {
+					o[k] = value;
+				}
+				return;
+			}
+			if (flags & 8) {
+				d = { get: get, set: set };
+			} else {
+				d = { value: value, writable: (flags & 2) !== 0 };
+			}
+			d.enumerable = (flags & 1) !== 0;
+			d.configurable = (flags & 4) !== 0;
+			Object.defineProperty(o, k, d);
+		}
+	};
+})(this)`
@@ -0,0 +1,169 @@
+package duktape
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	evalString(t, ctx, `var order = {id: 7, items: ["a", "b"], at: new Date(1000), re: /x+/gi, err: new RangeError("far")};
+		order.self = order;
+		Object.defineProperty(order, "total", {get: function () { return this.items.length * 10; }, enumerable: true});
+		var bytes = new Uint8Array([1, 2, 3]);
+		function describe(o) { return o.id + ":" + o.items.join("+"); }
+		var frozen = Object.freeze({k: 1});`)
+
+	b, err := ctx.Snapshot(SnapshotOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New()
+	defer restored.DestroyHeap()
+
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+
+	src := `[describe(order), order.self === order, order.total, order.at.getTime(), order.re.source + order.re.flags,
+		order.err instanceof RangeError, order.err.message, bytes[2], bytes instanceof Uint8Array, Object.isFrozen(frozen)].join()`
+
+	want := "7:a+b,true,20,1000,x+gi,true,far,3,true,true"
+
+	if got := evalString(t, restored, src); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSnapshotOptions(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	evalString(t, ctx, `var a = 1, b = 2, c = 3;`)
+
+	b, err := ctx.Snapshot(SnapshotOptions{Globals: []string{"a", "b"}, Exclude: []string{"b"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New()
+	defer restored.DestroyHeap()
+
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := evalString(t, restored, `[typeof a, typeof b, typeof c].join()`); got != "number,undefined,undefined" {
+		t.Errorf("got %q", got)
+	}
+
+	if err := restored.Restore([]byte("kksnap other\n")); err != ErrSnapshotInvalid {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	evalString(t, ctx, `function f() { return 1; } var o = {f: f};`)
+
+	b, err := ctx.Snapshot(SnapshotOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := append([]byte(nil), b...)
+	flipped[len(flipped)-10] ^= 0xff
+
+	for _, c := range [][]byte{b[:len(b)-20], flipped, []byte("kksnap")} {
+		if err := ctx.Restore(c); err != ErrSnapshotInvalid {
+			t.Errorf("got %v", err)
+		}
+	}
+
+	if err := ctx.Restore(b); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotHostGlobals(t *testing.T) {
+
+	newContext := func() *Context {
+		ctx := New()
+		NewLoop(ctx, nil)
+		ctx.EnableConsole(nil)
+		ctx.EnableModules(NewDirResolver(t.TempDir()))
+		ctx.PushGlobalGoFunc("twice", func(n int) int { return 2 * n })
+		return ctx
+	}
+
+	ctx := newContext()
+	defer ctx.Loop().Close()
+
+	var b []byte
+	var err error
+
+	// The globals installed by the host are left to the restoring host.
+
+	ctx.Loop().Dispatch().Sync(func() {
+		ctx.PevalString(`var n = 21;`)
+		ctx.Pop()
+		b, err = ctx.Snapshot(SnapshotOptions{})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newContext()
+	defer restored.Loop().Close()
+
+	restored.Loop().Dispatch().Sync(func() {
+		err = restored.Restore(b)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loopString(t, restored.Loop(), `[twice(n), typeof setTimeout, typeof console.log, typeof require].join()`); got != "42,function,function,function" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+
+	for src, want := range map[string]string{
+		`var counter = (function () { var n = 0; return {next: function () { return ++n; }}; })();`: "counter.next",
+		`var o = {"a b": [0, function () {}.bind(null)]};`:                                          `o["a b"][1]`,
+		`var m = {f: Math.max};`: "m.f",
+		`var p = {go: goFn};`:    "p.go",
+		`try { throw 1; } catch (e) { var g = function () { return e; }; }`: "g",
+	} {
+
+		ctx := New()
+
+		ctx.PushGlobalGoFunction("goFn", func() int { return 0 })
+		evalString(t, ctx, src)
+
+		_, err := ctx.Snapshot(SnapshotOptions{Exclude: []string{"goFn"}})
+
+		var e *SnapshotError
+
+		if !errors.As(err, &e) || e.Path != want || !errors.Is(err, ErrSnapshotUnsupported) {
+			t.Errorf("%s: got %v, want %s", src, err, want)
+		}
+
+		ctx.DestroyHeap()
+	}
+}
@@ -0,0 +1,2086 @@
+package duktape
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The transpiler lowers the ES2015+ syntax most used by scripts to the
+// ES5.1 understood by Duktape:
+//
+//	arrow functions     function expressions, bound when they use this
+//	let and const       var, renamed in blocks (see scope)
+//	template literals   string concatenations, tag(strings, ...values) calls
+//	classes             constructor functions defined inside a closure
+//	async and await     functions running on a Duktape.Thread
+//
+// It rewrites the token stream rather than an AST, keeping every token on
+// its line, so the line numbers of errors still point into the original
+// source. Anything else, such as destructuring or for-of loops, is passed
+// through and left for Duktape to reject.
+//
+// Known differences with ES2015: let and const have no temporal dead zone
+// and assignments to constants are rejected when transpiling; closures can
+// only capture the variables of a for loop whose body may run in a function
+// of its own (see checkLoop); arrow functions see their own arguments;
+// tagged templates get no raw strings; class constructors can be called
+// without new; and await is only allowed directly in the body of an async
+// function.
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenName
+	tokenNumber
+	tokenString
+	tokenRegexp
+	tokenPunct
+	tokenTemplate
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// pre holds the white space and comments preceding the token.
+	pre  string
+	line int
+	// nl reports a line break in pre.
+	nl bool
+	// match is the index of the matching bracket or, for template pieces,
+	// of the next piece.
+	match int
+	// head and tail mark the template pieces starting and ending with a
+	// backquote.
+	head bool
+	tail bool
+}
+
+var punctuators = []string{
+	">>>=", "...", "===", "!==", "**=", "<<=", ">>=", ">>>",
+	"=>", "==", "!=", "<=", ">=", "&&", "||", "??", "?.", "++", "--",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "<<", ">>", "**",
+}
+
+var reservedWords = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true,
+	"continue": true, "debugger": true, "default": true, "delete": true,
+	"do": true, "else": true, "export": true, "extends": true, "finally": true,
+	"for": true, "function": true, "if": true, "import": true, "in": true,
+	"instanceof": true, "new": true, "return": true, "super": true,
+	"switch": true, "this": true, "throw": true, "try": true, "typeof": true,
+	"var": true, "void": true, "while": true, "with": true, "yield": true,
+	"null": true, "true": true, "false": true, "let": true, "await": true,
+}
+
+// Keywords after which a slash starts a regular expression.
+var regexpKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true, "of": true,
+	"new": true, "delete": true, "void": true, "throw": true, "case": true,
+	"do": true, "else": true, "yield": true, "await": true,
+}
+
+type lexer struct {
+	src    string
+	pos    int
+	line   int
+	tokens []token
+	// braces tells for each open brace whether it opened a template
+	// substitution.
+	braces []bool
+}
+
+func syntaxError(line int, format string, args ...interface{}) *Error {
+	return &Error{
+		Type:       "SyntaxError",
+		Message:    fmt.Sprintf(format, args...),
+		LineNumber: line,
+	}
+}
+
+func tokenize(src string) ([]token, error) {
+
+	l := &lexer{src: src, line: 1}
+
+	for {
+
+		start := l.pos
+
+		if err := l.skipSpace(); err != nil {
+			return nil, err
+		}
+
+		pre := src[start:l.pos]
+		tok := token{pre: pre, line: l.line, nl: strings.ContainsAny(pre, "\n\r\u2028\u2029"), match: -1}
+
+		if l.pos >= len(src) {
+			l.tokens = append(l.tokens, tok)
+			break
+		}
+
+		start = l.pos
+		c := src[l.pos]
+
+		var err error
+
+		switch {
+		case c == '`':
+			tok.kind = tokenTemplate
+			tok.head = true
+			err = l.template(&tok)
+		case c == '}' && len(l.braces) > 0 && l.braces[len(l.braces)-1]:
+			l.braces = l.braces[:len(l.braces)-1]
+			tok.kind = tokenTemplate
+			err = l.template(&tok)
+		case isDigit(c) || (c == '.' && l.pos+1 < len(src) && isDigit(src[l.pos+1])):
+			tok.kind = tokenNumber
+			l.number()
+		case c == '"' || c == '\'':
+			tok.kind = tokenString
+			err = l.string(c)
+		case c == '/' && l.regexpAllowed():
+			tok.kind = tokenRegexp
+			err = l.regexp()
+		case c == '\\' || c == '$' || c == '_' || c >= utf8.RuneSelf || isLetter(c):
+			tok.kind = tokenName
+			l.name()
+		default:
+			tok.kind = tokenPunct
+			l.punct()
+			switch src[start] {
+			case '{':
+				l.braces = append(l.braces, false)
+			case '}':
+				if len(l.braces) > 0 {
+					l.braces = l.braces[:len(l.braces)-1]
+				}
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		tok.text = src[start:l.pos]
+		l.line = l.line + strings.Count(tok.text, "\n")
+		l.tokens = append(l.tokens, tok)
+	}
+
+	if err := matchTokens(l.tokens); err != nil {
+		return nil, err
+	}
+
+	return l.tokens, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "//"):
+			i := strings.IndexByte(l.src[l.pos:], '\n')
+			if i < 0 {
+				l.pos = len(l.src)
+			} else {
+				l.pos = l.pos + i
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			i := strings.Index(l.src[l.pos+2:], "*/")
+			if i < 0 {
+				return syntaxError(l.line, "unterminated comment")
+			}
+			l.line = l.line + strings.Count(l.src[l.pos:l.pos+i+4], "\n")
+			l.pos = l.pos + i + 4
+		case c >= utf8.RuneSelf:
+			r, n := utf8.DecodeRuneInString(l.src[l.pos:])
+			if !unicode.IsSpace(r) && r != '\uFEFF' {
+				return nil
+			}
+			l.pos = l.pos + n
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) name() {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\\':
+			l.pos = l.pos + 2
+		case c == '$' || c == '_' || isLetter(c) || isDigit(c):
+			l.pos++
+		case c >= utf8.RuneSelf:
+			r, n := utf8.DecodeRuneInString(l.src[l.pos:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r) && !unicode.Is(unicode.Mc, r) && !unicode.Is(unicode.Pc, r) {
+				return
+			}
+			l.pos = l.pos + n
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) number() {
+	hex := strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X")
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if (c == '+' || c == '-') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E') && !hex {
+			l.pos++
+			continue
+		}
+		if c != '.' && c != '_' && !isDigit(c) && !isLetter(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+func (l *lexer) string(quote byte) error {
+	line := l.line
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos++
+		case '\n':
+			return syntaxError(line, "unterminated string")
+		case quote:
+			l.pos++
+			return nil
+		}
+	}
+	return syntaxError(line, "unterminated string")
+}
+
+func (l *lexer) regexp() error {
+	class := false
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos++
+		case '\n':
+			return syntaxError(l.line, "unterminated regular expression")
+		case '[':
+			class = true
+		case ']':
+			class = false
+		case '/':
+			if !class {
+				l.pos++
+				for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+					l.pos++
+				}
+				return nil
+			}
+		}
+	}
+	return syntaxError(l.line, "unterminated regular expression")
+}
+
+// template scans a template piece from its opening backquote or brace to
+// its closing backquote or ${.
+func (l *lexer) template(tok *token) error {
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos++
+		case '`':
+			l.pos++
+			tok.tail = true
+			return nil
+		case '$':
+			if l.pos+1 < len(l.src) && l.src[l.pos+1] == '{' {
+				l.pos = l.pos + 2
+				l.braces = append(l.braces, true)
+				return nil
+			}
+		}
+	}
+	return syntaxError(tok.line, "unterminated template literal")
+}
+
+func (l *lexer) punct() {
+	for _, p := range punctuators {
+		if strings.HasPrefix(l.src[l.pos:], p) {
+			l.pos = l.pos + len(p)
+			return
+		}
+	}
+	l.pos++
+}
+
+// regexpAllowed tells whether a slash starts a regular expression rather
+// than a division, from the token preceding it.
+func (l *lexer) regexpAllowed() bool {
+
+	if len(l.tokens) == 0 {
+		return true
+	}
+
+	prev := l.tokens[len(l.tokens)-1]
+
+	switch prev.kind {
+	case tokenName:
+		return regexpKeywords[prev.text]
+	case tokenNumber, tokenString, tokenRegexp:
+		return false
+	case tokenTemplate:
+		return !prev.tail
+	case tokenPunct:
+		return prev.text != ")" && prev.text != "]" && prev.text != "}"
+	}
+
+	return true
+}
+
+var closingBrackets = map[string]string{")": "(", "]": "[", "}": "{"}
+
+func matchTokens(tokens []token) error {
+
+	var stack []int
+
+	for i := range tokens {
+
+		tok := &tokens[i]
+
+		switch tok.kind {
+		case tokenPunct:
+			switch tok.text {
+			case "(", "[", "{":
+				stack = append(stack, i)
+			case ")", "]", "}":
+				if len(stack) == 0 || tokens[stack[len(stack)-1]].text != closingBrackets[tok.text] {
+					return syntaxError(tok.line, "unexpected '%s'", tok.text)
+				}
+				j := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				tokens[j].match = i
+				tok.match = j
+			}
+		case tokenTemplate:
+			if !tok.head {
+				if len(stack) == 0 || tokens[stack[len(stack)-1]].kind != tokenTemplate {
+					return syntaxError(tok.line, "unexpected '}'")
+				}
+				j := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				tokens[j].match = i
+			}
+			if !tok.tail {
+				stack = append(stack, i)
+			}
+		}
+	}
+
+	if len(stack) > 0 {
+		tok := tokens[stack[len(stack)-1]]
+		return syntaxError(tok.line, "unclosed '%s'", tok.text)
+	}
+
+	return nil
+}
+
+type transpiler struct {
+	tokens []token
+	out    *strings.Builder
+	// async is set in the body of async functions, where await applies.
+	async bool
+	// superBase replaces super.name in class methods.
+	superBase string
+	// members marks the member names of class bodies.
+	members map[int]bool
+	// declared marks the names declared by var, let and const.
+	declared map[int]bool
+	// loops maps the loop bodies to wrap to the variables they capture.
+	loops   map[int]string
+	renames int
+}
+
+// Transpile lowers the arrow functions, let and const declarations,
+// template literals, classes and async functions of source to ES5.1,
+// keeping each line of code on its original line. Transpiled code that uses
+// classes or async functions needs the helpers installed by
+// EnableTranspiler, and async functions also need a Promise (see NewLoop).
+// Syntax errors found on the way are returned as *Error.
+func Transpile(source string) (code string, err error) {
+
+	tokens, err := tokenize(source)
+
+	if err != nil {
+		return "", err
+	}
+
+	t := &transpiler{
+		tokens:   tokens,
+		out:      &strings.Builder{},
+		members:  map[int]bool{},
+		declared: map[int]bool{},
+		loops:    map[int]string{},
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+
+	t.scope()
+	t.emit(0, len(tokens))
+
+	return t.out.String(), nil
+}
+
+func (t *transpiler) is(i int, text string) bool {
+	return i >= 0 && i < len(t.tokens) && (t.tokens[i].kind == tokenPunct || t.tokens[i].kind == tokenName) && t.tokens[i].text == text
+}
+
+func (t *transpiler) isName(i int) bool {
+	return i < len(t.tokens) && t.tokens[i].kind == tokenName && !reservedWords[t.tokens[i].text]
+}
+
+// isArrow tells whether the token at i starts the parameters of an arrow
+// function.
+func (t *transpiler) isArrow(i int) bool {
+	tok := t.tokens[i]
+	switch {
+	case tok.kind == tokenName && !reservedWords[tok.text]:
+		return t.is(i+1, "=>") && !t.tokens[i+1].nl
+	case tok.kind == tokenPunct && tok.text == "(":
+		return t.is(tok.match+1, "=>") && !t.tokens[tok.match+1].nl
+	}
+	return false
+}
+
+func (t *transpiler) write(s ...string) {
+	for _, v := range s {
+		t.out.WriteString(v)
+	}
+}
+
+// takePre returns the text preceding the token at i, which is then left
+// out when the token is emitted.
+func (t *transpiler) takePre(i int) string {
+	pre := t.tokens[i].pre
+	t.tokens[i].pre = ""
+	return pre
+}
+
+// lineBreaks returns the line breaks of the text preceding the token at i,
+// written in place of tokens moved elsewhere.
+func (t *transpiler) lineBreaks(i int) string {
+	n := strings.Count(t.tokens[i].pre, "\n")
+	if n == 0 {
+		return " "
+	}
+	return strings.Repeat("\n", n)
+}
+
+// capture returns the output of the tokens from i to end.
+func (t *transpiler) capture(i int, end int) string {
+	out := t.out
+	t.out = &strings.Builder{}
+	t.emit(i, end)
+	s := t.out.String()
+	t.out = out
+	return s
+}
+
+func (t *transpiler) emit(i int, end int) {
+	for i < end {
+		i = t.emitAt(i)
+	}
+}
+
+func (t *transpiler) emitAt(i int) int {
+
+	tok := t.tokens[i]
+	member := i > 0 && (t.is(i-1, ".") || t.is(i-1, "?."))
+
+	switch tok.kind {
+	case tokenTemplate:
+		return t.template(i)
+	case tokenName:
+		if member {
+			break
+		}
+		switch tok.text {
+		case "let":
+			if t.isName(i+1) || t.is(i+1, "[") || t.is(i+1, "{") {
+				t.write(tok.pre, "var")
+				return i + 1
+			}
+		case "const":
+			t.write(tok.pre, "var")
+			return i + 1
+		case "class":
+			if t.isName(i+1) || t.is(i+1, "{") || t.is(i+1, "extends") {
+				return t.class(i)
+			}
+		case "function":
+			return t.function(i, false)
+		case "async":
+			if t.is(i+1, "function") && !t.tokens[i+1].nl {
+				t.write(tok.pre)
+				return t.function(i+1, true)
+			}
+			if i+1 < len(t.tokens) && !t.tokens[i+1].nl && t.isArrow(i+1) {
+				t.write(tok.pre)
+				return t.arrow(i+1, true)
+			}
+		case "await":
+			if t.async {
+				return t.await(i)
+			}
+		case "super":
+			if t.superBase != "" {
+				return t.super(i)
+			}
+		}
+		if t.isArrow(i) {
+			return t.arrow(i, false)
+		}
+	case tokenPunct:
+		if tok.text == "(" && t.isArrow(i) {
+			return t.arrow(i, false)
+		}
+		if params, ok := t.loops[i]; ok {
+			return t.loopBody(i, params)
+		}
+	}
+
+	t.write(tok.pre, tok.text)
+
+	return i + 1
+}
+
+// body emits the function body whose opening brace is at i and returns the
+// index following its closing brace. The body of an async function runs
+// inside __kk_async, which receives the original this and arguments.
+func (t *transpiler) body(i int, async bool) int {
+
+	end := t.tokens[i].match
+	saved := t.async
+
+	t.async = async
+	t.write(t.tokens[i].pre, "{")
+
+	if async {
+		t.write(" return __kk_async(this, arguments, function () {")
+	}
+
+	t.emit(i+1, end)
+
+	if async {
+		t.write(t.tokens[end].pre, "}); }")
+	} else {
+		t.write(t.tokens[end].pre, "}")
+	}
+
+	t.async = saved
+
+	return end + 1
+}
+
+// function emits the function declaration or expression starting at the
+// function keyword at i.
+func (t *transpiler) function(i int, async bool) int {
+
+	t.write(t.tokens[i].pre, "function")
+
+	j := i + 1
+
+	if t.is(j, "*") {
+		// Generators are left for Duktape to reject.
+		return j
+	}
+
+	if t.isName(j) || (j < len(t.tokens) && t.tokens[j].kind == tokenName && !t.is(j, "(")) {
+		t.write(t.tokens[j].pre, t.tokens[j].text)
+		j++
+	}
+
+	if !t.is(j, "(") || !t.is(t.tokens[j].match+1, "{") {
+		return j
+	}
+
+	saved := t.superBase
+	t.superBase = ""
+
+	t.emit(j, t.tokens[j].match+1)
+	j = t.body(t.tokens[j].match+1, async)
+
+	t.superBase = saved
+
+	return j
+}
+
+// arrow emits the arrow function whose parameters start at i.
+func (t *transpiler) arrow(i int, async bool) int {
+
+	var params string
+	var arrow int
+
+	pre := t.takePre(i)
+
+	if t.tokens[i].kind == tokenName {
+		params = "(" + t.tokens[i].text + ")"
+		arrow = i + 1
+	} else {
+		close := t.tokens[i].match
+		arrow = close + 1
+		params = "(" + t.capture(i+1, close) + t.tokens[close].pre + ")"
+	}
+
+	b := arrow + 1
+	block := t.is(b, "{")
+
+	var end int
+
+	if block {
+		end = t.tokens[b].match + 1
+	} else {
+		end = t.expressionEnd(b)
+	}
+
+	bind := async || t.usesThis(b, end)
+
+	t.write(pre)
+
+	if bind {
+		t.write("(")
+	}
+
+	t.write("function ", params)
+
+	if block {
+		t.body(b, async)
+	} else {
+		saved := t.async
+		t.async = async
+		if async {
+			t.write(" { return __kk_async(this, arguments, function () { return (")
+		} else {
+			t.write(" { return (")
+		}
+		t.emit(b, end)
+		if async {
+			t.write("); }); }")
+		} else {
+			t.write("); }")
+		}
+		t.async = saved
+	}
+
+	if bind {
+		t.write(").bind(this)")
+	}
+
+	return end
+}
+
+// usesThis tells whether this or super appear in the tokens from i to end
+// outside nested functions.
+func (t *transpiler) usesThis(i int, end int) bool {
+	for ; i < end; i++ {
+		tok := t.tokens[i]
+		switch {
+		case tok.kind != tokenName:
+		case tok.text == "this" || tok.text == "super":
+			return true
+		case tok.text == "function":
+			j := i + 1
+			for j < end && !t.is(j, "(") {
+				j++
+			}
+			if j < end && t.is(t.tokens[j].match+1, "{") {
+				i = t.tokens[t.tokens[j].match+1].match
+			}
+		}
+	}
+	return false
+}
+
+// endsExpression tells whether an expression may end with the token at i.
+func (t *transpiler) endsExpression(i int) bool {
+	tok := t.tokens[i]
+	switch tok.kind {
+	case tokenName:
+		return !reservedWords[tok.text] || tok.text == "this" || tok.text == "null" || tok.text == "true" || tok.text == "false" || tok.text == "super"
+	case tokenNumber, tokenString, tokenRegexp:
+		return true
+	case tokenTemplate:
+		return tok.tail
+	case tokenPunct:
+		return tok.text == ")" || tok.text == "]" || tok.text == "}" || tok.text == "++" || tok.text == "--"
+	}
+	return false
+}
+
+// expressionEnd returns the end of the assignment expression starting at i,
+// the body of an arrow function.
+func (t *transpiler) expressionEnd(i int) int {
+
+	conditionals := 0
+
+	for j := i; ; j++ {
+
+		tok := t.tokens[j]
+
+		if tok.kind == tokenEOF {
+			return j
+		}
+
+		// A line break ends the expression when automatic semicolon
+		// insertion would.
+		if j > i && tok.nl && t.endsExpression(j-1) {
+			switch tok.kind {
+			case tokenName:
+				if tok.text != "in" && tok.text != "instanceof" {
+					return j
+				}
+			case tokenNumber, tokenString:
+				return j
+			case tokenTemplate:
+				if tok.head {
+					return j
+				}
+			case tokenPunct:
+				if tok.text == "++" || tok.text == "--" {
+					return j
+				}
+			}
+		}
+
+		switch tok.kind {
+		case tokenTemplate:
+			if !tok.head {
+				return j
+			}
+			j = t.templateEnd(j) - 1
+		case tokenPunct:
+			switch tok.text {
+			case "(", "[", "{":
+				j = tok.match
+			case ")", "]", "}", ",", ";":
+				return j
+			case "?":
+				conditionals++
+			case ":":
+				if conditionals == 0 {
+					return j
+				}
+				conditionals--
+			}
+		}
+	}
+}
+
+// templateEnd returns the index following the last piece of the template
+// starting at i.
+func (t *transpiler) templateEnd(i int) int {
+	for !t.tokens[i].tail {
+		i = t.tokens[i].match
+	}
+	return i + 1
+}
+
+// unaryEnd returns the end of the unary expression starting at i, the
+// operand of await.
+func (t *transpiler) unaryEnd(i int) int {
+
+	for {
+		tok := t.tokens[i]
+		if tok.kind == tokenPunct && (tok.text == "!" || tok.text == "~" || tok.text == "+" || tok.text == "-" || tok.text == "++" || tok.text == "--") {
+			i++
+		} else if tok.kind == tokenName && (tok.text == "typeof" || tok.text == "void" || tok.text == "delete" || tok.text == "await") {
+			i++
+		} else {
+			break
+		}
+	}
+
+	return t.postfixEnd(t.primaryEnd(i), true)
+}
+
+func (t *transpiler) primaryEnd(i int) int {
+
+	tok := t.tokens[i]
+
+	switch tok.kind {
+	case tokenEOF:
+		panic(syntaxError(tok.line, "unexpected end of input"))
+	case tokenTemplate:
+		return t.templateEnd(i)
+	case tokenPunct:
+		switch tok.text {
+		case "(", "[", "{":
+			return tok.match + 1
+		}
+		panic(syntaxError(tok.line, "unexpected '%s'", tok.text))
+	case tokenName:
+		switch tok.text {
+		case "new":
+			j := t.postfixEnd(t.primaryEnd(i+1), false)
+			if t.is(j, "(") {
+				j = t.tokens[j].match + 1
+			}
+			return j
+		case "function", "async":
+			j := i + 1
+			for !t.is(j, "(") {
+				if t.tokens[j].kind == tokenEOF {
+					return j
+				}
+				j++
+			}
+			if t.is(t.tokens[j].match+1, "{") {
+				return t.tokens[t.tokens[j].match+1].match + 1
+			}
+			return t.tokens[j].match + 1
+		}
+	}
+
+	return i + 1
+}
+
+// postfixEnd skips the property accesses, calls (when calls is set) and
+// postfix operators following the expression ending at i.
+func (t *transpiler) postfixEnd(i int, calls bool) int {
+	for {
+		tok := t.tokens[i]
+		switch {
+		case tok.kind == tokenTemplate && tok.head:
+			i = t.templateEnd(i)
+		case tok.kind != tokenPunct:
+			return i
+		case tok.text == "." || tok.text == "?.":
+			if t.is(i+1, "(") || t.is(i+1, "[") {
+				i = t.tokens[i+1].match + 1
+			} else {
+				i = i + 2
+			}
+		case tok.text == "[":
+			i = tok.match + 1
+		case tok.text == "(" && calls:
+			i = tok.match + 1
+		case (tok.text == "++" || tok.text == "--") && !tok.nl:
+			return i + 1
+		default:
+			return i
+		}
+	}
+}
+
+func (t *transpiler) await(i int) int {
+	end := t.unaryEnd(i + 1)
+	t.write(t.tokens[i].pre, "__kk_await(")
+	t.emit(i+1, end)
+	t.write(")")
+	return end
+}
+
+// super emits super(...), super.name and super[name] in class methods.
+func (t *transpiler) super(i int) int {
+
+	pre := t.tokens[i].pre
+	j := i + 1
+
+	if t.is(j, "(") {
+		end := t.tokens[j].match
+		t.write(pre, "_super.call(this")
+		if end > j+1 {
+			t.write(",")
+			t.emit(j+1, end)
+		}
+		t.write(t.tokens[end].pre, ")")
+		return end + 1
+	}
+
+	var property string
+
+	switch {
+	case t.is(j, ".") && j+1 < len(t.tokens) && t.tokens[j+1].kind == tokenName:
+		property = "." + t.tokens[j+1].text
+		j = j + 2
+	case t.is(j, "["):
+		property = "[" + t.capture(j+1, t.tokens[j].match) + "]"
+		j = t.tokens[j].match + 1
+	default:
+		panic(syntaxError(t.tokens[i].line, "unexpected 'super'"))
+	}
+
+	if !t.is(j, "(") {
+		t.write(pre, t.superBase, property)
+		return j
+	}
+
+	end := t.tokens[j].match
+	t.write(pre, t.superBase, property, ".call(this")
+
+	if end > j+1 {
+		t.write(",")
+		t.emit(j+1, end)
+	}
+
+	t.write(t.tokens[end].pre, ")")
+
+	return end + 1
+}
+
+// templateString returns the string literal with the value of a template
+// piece. Line breaks are kept as line continuations.
+func templateString(tok token) string {
+
+	s := tok.text[1:]
+
+	if tok.tail {
+		s = s[:len(s)-1]
+	} else {
+		s = s[:len(s)-2]
+	}
+
+	var b strings.Builder
+
+	b.WriteByte('"')
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				switch s[i] {
+				case '`', '$':
+					b.WriteByte(s[i])
+				case '\r':
+					b.WriteString("\\\r")
+					if i+1 < len(s) && s[i+1] == '\n' {
+						i++
+						b.WriteByte('\n')
+					}
+				default:
+					b.WriteByte('\\')
+					b.WriteByte(s[i])
+				}
+			}
+		case '"':
+			b.WriteString("\\\"")
+		case '\r':
+			if i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+			b.WriteString("\\n\\\n")
+		case '\n':
+			b.WriteString("\\n\\\n")
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// template emits the template literal starting at i, as a call of its tag
+// when it has one.
+func (t *transpiler) template(i int) int {
+
+	var pieces []int
+
+	for j := i; ; j = t.tokens[j].match {
+		pieces = append(pieces, j)
+		if t.tokens[j].tail {
+			break
+		}
+	}
+
+	tagged := i > 0 && t.endsExpression(i-1)
+
+	if tagged {
+		strs := make([]string, len(pieces))
+		for k, p := range pieces {
+			strs[k] = templateString(t.tokens[p])
+		}
+		t.write(t.tokens[i].pre, "([", strings.Join(strs, ", "), "]")
+		for k := 0; k+1 < len(pieces); k++ {
+			t.write(", ")
+			t.emit(pieces[k]+1, pieces[k+1])
+		}
+		t.write(")")
+		return pieces[len(pieces)-1] + 1
+	}
+
+	if len(pieces) == 1 {
+		t.write(t.tokens[i].pre, templateString(t.tokens[i]))
+		return i + 1
+	}
+
+	t.write(t.tokens[i].pre, "(", templateString(t.tokens[i]))
+
+	for k := 0; k+1 < len(pieces); k++ {
+		t.write(" + (")
+		t.emit(pieces[k]+1, pieces[k+1])
+		t.write(") + ", templateString(t.tokens[pieces[k+1]]))
+	}
+
+	t.write(")")
+
+	return pieces[len(pieces)-1] + 1
+}
+
+// class emits the class declaration or expression starting at i as a call
+// of a closure defining and returning its constructor, in parentheses for an
+// expression:
+//
+//	var A = (function (_super) { 'use strict'; __kk_inherits(A, _super); ...
+//		function A(x) { _super.call(this, x); }
+//		__kk_define(A.prototype, "m", "value", function () { ... });
+//	return A; })(B);
+func (t *transpiler) class(i int) int {
+
+	declaration := i == 0 || t.is(i-1, ";") || t.is(i-1, "{") || t.is(i-1, "}") || (t.tokens[i].nl && t.endsExpression(i-1))
+
+	name := "_class"
+	j := i + 1
+
+	if t.isName(j) {
+		name = t.tokens[j].text
+		j++
+	} else if declaration {
+		panic(syntaxError(t.tokens[i].line, "class name expected"))
+	}
+
+	breaks := ""
+	superStart := -1
+
+	if t.is(j, "extends") {
+		breaks = breaks + t.lineBreaks(j)
+		superStart = j + 1
+		for j++; !t.is(j, "{"); j++ {
+			tok := t.tokens[j]
+			if tok.kind == tokenEOF {
+				panic(syntaxError(t.tokens[i].line, "class body expected"))
+			}
+			breaks = breaks + t.lineBreaks(j)
+			switch {
+			case tok.kind == tokenPunct && (tok.text == "(" || tok.text == "["):
+				for k := j + 1; k <= tok.match; k++ {
+					breaks = breaks + t.lineBreaks(k)
+				}
+				j = tok.match
+			case tok.kind == tokenTemplate:
+				end := t.templateEnd(j)
+				for k := j + 1; k < end; k++ {
+					breaks = breaks + t.lineBreaks(k)
+				}
+				j = end - 1
+			}
+		}
+	}
+
+	if !t.is(j, "{") {
+		panic(syntaxError(t.tokens[i].line, "class body expected"))
+	}
+
+	open := j
+	end := t.tokens[open].match
+
+	var b strings.Builder
+
+	b.WriteString(t.tokens[i].pre)
+
+	// An expression is parenthesized, so that new applies to the
+	// constructor rather than to the closure returning it.
+
+	if declaration {
+		b.WriteString("var " + name + " = ")
+	} else {
+		b.WriteString("(")
+	}
+
+	if superStart >= 0 {
+		b.WriteString("(function (_super) { 'use strict'; __kk_inherits(" + name + ", _super);")
+		if !t.hasConstructor(open) {
+			b.WriteString(" function " + name + "() { _super.apply(this, arguments); }")
+		}
+	} else {
+		b.WriteString("(function () { 'use strict';")
+		if !t.hasConstructor(open) {
+			b.WriteString(" function " + name + "() {}")
+		}
+	}
+
+	t.write(b.String(), strings.Replace(breaks+t.lineBreaks(open), " ", "", -1))
+
+	savedSuper := t.superBase
+	savedAsync := t.async
+	t.async = false
+
+	for k := open + 1; k < end; {
+		k = t.member(k, name, superStart >= 0)
+	}
+
+	t.superBase = savedSuper
+	t.async = savedAsync
+
+	superExpr := ""
+
+	if superStart >= 0 {
+		superExpr = strings.Join(strings.Fields(t.capture(superStart, open)), " ")
+	}
+
+	t.write(t.tokens[end].pre, " return ", name, "; })(", superExpr, ")")
+
+	if declaration {
+		t.write(";")
+	} else {
+		t.write(")")
+	}
+
+	return end + 1
+}
+
+// hasConstructor tells whether the class body opening at i defines a
+// constructor.
+func (t *transpiler) hasConstructor(i int) bool {
+	for j := i + 1; j < t.tokens[i].match; j++ {
+		tok := t.tokens[j]
+		if tok.kind == tokenPunct && (tok.text == "(" || tok.text == "[" || tok.text == "{") {
+			j = tok.match
+			continue
+		}
+		if (t.is(j, "constructor") || tok.text == `"constructor"` || tok.text == `'constructor'`) && t.is(j+1, "(") && !t.is(j-1, "static") {
+			return true
+		}
+	}
+	return false
+}
+
+// member emits the class member starting at i and returns the index of the
+// next one.
+func (t *transpiler) member(i int, name string, extends bool) int {
+
+	if t.is(i, ";") {
+		t.write(t.tokens[i].pre)
+		return i + 1
+	}
+
+	line := t.tokens[i].line
+	pre := t.tokens[i].pre
+	j := i
+
+	static := false
+	async := false
+	kind := "value"
+
+	if t.is(j, "static") && !t.is(j+1, "(") {
+		static = true
+		j++
+		pre = pre + t.lineBreaks(j)
+	}
+
+	if t.is(j, "async") && !t.is(j+1, "(") && !t.tokens[j+1].nl {
+		async = true
+		j++
+		pre = pre + t.lineBreaks(j)
+	}
+
+	if (t.is(j, "get") || t.is(j, "set")) && !t.is(j+1, "(") {
+		kind = t.tokens[j].text
+		j++
+		pre = pre + t.lineBreaks(j)
+	}
+
+	if t.is(j, "*") {
+		panic(syntaxError(line, "generator methods are not supported"))
+	}
+
+	var key string
+	constructor := false
+
+	tok := t.tokens[j]
+
+	switch {
+	case tok.kind == tokenPunct && tok.text == "[":
+		key = "(" + strings.Join(strings.Fields(t.capture(j+1, tok.match)), " ") + ")"
+		j = tok.match + 1
+	case tok.kind == tokenName:
+		key = strconv.Quote(tok.text)
+		constructor = tok.text == "constructor"
+		j++
+	case tok.kind == tokenString:
+		key = tok.text
+		constructor = tok.text[1:len(tok.text)-1] == "constructor"
+		j++
+	case tok.kind == tokenNumber:
+		key = tok.text
+		j++
+	default:
+		panic(syntaxError(line, "unexpected '%s' in class body", tok.text))
+	}
+
+	if !t.is(j, "(") {
+		panic(syntaxError(line, "class fields are not supported"))
+	}
+
+	if !t.is(t.tokens[j].match+1, "{") {
+		panic(syntaxError(line, "method body expected"))
+	}
+
+	constructor = constructor && !static && kind == "value"
+
+	switch {
+	case !extends:
+		t.superBase = ""
+	case static:
+		t.superBase = "_super"
+	default:
+		t.superBase = "_super.prototype"
+	}
+
+	t.write(pre)
+
+	// The pre of the parameters is dropped since pre above holds it.
+	t.tokens[j].pre = strings.Replace(t.lineBreaks(j), " ", "", -1)
+
+	if constructor {
+		t.write("function ", name)
+		t.emit(j, t.tokens[j].match+1)
+		return t.body(t.tokens[j].match+1, false)
+	}
+
+	target := name + ".prototype"
+
+	if static {
+		target = name
+	}
+
+	t.write("__kk_define(", target, ", ", key, ", \"", kind, "\", function ")
+	t.emit(j, t.tokens[j].match+1)
+	end := t.body(t.tokens[j].match+1, async)
+	t.write(");")
+
+	return end
+}
+
+// Block scoping
+//
+// let and const become var, which is correct for declarations at the top of
+// a function. A declaration in a block is renamed within the block when its
+// name is also used elsewhere in the function, and the body of a for loop
+// is wrapped in a function called at every iteration when closures capture
+// the variables declared by the loop header. Assignments to constants are
+// rejected.
+
+// binding is a let or const declaration, or the ones of a for loop header,
+// with the range of tokens it is visible in.
+type binding struct {
+	names    []int
+	constant bool
+	start    int
+	end      int
+	// loop is the index of the for keyword, -1 for other declarations.
+	loop int
+	// block is set for declarations scoped to a block rather than a
+	// function or the program.
+	block bool
+}
+
+var assignmentOperators = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"**=": true, "<<=": true, ">>=": true, ">>>=": true, "&=": true, "|=": true,
+	"^=": true,
+}
+
+// controlKeywords start the statements whose parentheses precede a block
+// rather than a function body.
+var controlKeywords = map[string]bool{
+	"if": true, "for": true, "while": true, "switch": true, "catch": true, "with": true,
+}
+
+// scope renames the block scoped declarations, marks the loop bodies to
+// wrap and checks the assignments to constants.
+func (t *transpiler) scope() {
+
+	var bindings []*binding
+
+	for i, tok := range t.tokens {
+
+		if tok.kind != tokenName || (i > 0 && (t.is(i-1, ".") || t.is(i-1, "?."))) {
+			continue
+		}
+
+		switch tok.text {
+		case "class":
+			if open := t.classBody(i); open >= 0 {
+				t.markMembers(open)
+			}
+		case "var":
+			for _, j := range t.declarators(i) {
+				t.declared[j] = true
+			}
+		case "let", "const":
+			names := t.declarators(i)
+			if len(names) == 0 {
+				continue
+			}
+			for _, j := range names {
+				t.declared[j] = true
+			}
+			b := &binding{names: names, constant: tok.text == "const", loop: -1}
+			if t.is(i-1, "(") && t.is(i-2, "for") {
+				b.loop = i - 2
+				b.start = i - 2
+				b.end = t.statementEnd(t.parenEnd(i - 1))
+				b.block = true
+			} else if k := t.enclosingBrace(i); k >= 0 {
+				b.start = k + 1
+				b.end = t.tokens[k].match
+				b.block = !t.isFunctionBody(k)
+			} else {
+				b.end = len(t.tokens)
+			}
+			bindings = append(bindings, b)
+		}
+	}
+
+	// Inner declarations first, so that the outer ones see their renamed
+	// references.
+
+	sort.SliceStable(bindings, func(a, b int) bool {
+		return bindings[a].start > bindings[b].start
+	})
+
+	origins := map[int]string{}
+
+	for _, b := range bindings {
+		for _, n := range b.names {
+			origins[n] = t.tokens[n].text
+			if b.block {
+				t.rename(b, n)
+			}
+		}
+	}
+
+	for _, b := range bindings {
+		if b.constant {
+			for _, n := range b.names {
+				t.checkConstant(b, n, origins[n])
+			}
+		}
+		if b.loop >= 0 {
+			t.checkLoop(b, origins)
+		}
+	}
+}
+
+// declarators returns the indices of the names declared by the var, let or
+// const keyword at i. Destructuring patterns are left for Duktape to reject.
+func (t *transpiler) declarators(i int) []int {
+
+	var names []int
+
+	for j := i + 1; t.isName(j); {
+		names = append(names, j)
+		j++
+		if t.is(j, "=") {
+			j = t.expressionEnd(j + 1)
+		}
+		if !t.is(j, ",") {
+			break
+		}
+		j++
+	}
+
+	return names
+}
+
+// rename gives the name declared at n a name of its own within the scope of
+// b when the enclosing function uses it elsewhere.
+func (t *transpiler) rename(b *binding, n int) {
+
+	name := t.tokens[n].text
+	start, end := t.functionRange(b.start - 1)
+	used := false
+
+	for j := start; j < end && !used; j++ {
+		if j == b.start {
+			j = b.end
+		}
+		used = j < end && t.tokens[j].text == name && t.isReference(j)
+	}
+
+	if !used {
+		return
+	}
+
+	t.renames++
+	renamed := name + "$" + strconv.Itoa(t.renames)
+
+	for j := b.start; j < b.end; j++ {
+		if t.tokens[j].text == name && (j == n || t.isReference(j)) {
+			t.tokens[j].text = renamed
+		}
+	}
+}
+
+// checkConstant rejects the assignments to the constant declared at n,
+// unless another declaration of the name in its scope makes it ambiguous.
+func (t *transpiler) checkConstant(b *binding, n int, origin string) {
+
+	name := t.tokens[n].text
+
+	for j := b.start; j < b.end; j++ {
+		if j != n && t.tokens[j].text == name && t.declares(j) {
+			return
+		}
+	}
+
+	for j := b.start; j < b.end; j++ {
+		if j != n && t.tokens[j].text == name && t.isReference(j) && t.assigns(j) {
+			panic(syntaxError(t.tokens[j].line, "assignment to constant variable '%s'", origin))
+		}
+	}
+}
+
+// checkLoop marks the body of the for loop of b to be wrapped when closures
+// capture its variables. The wrapped body runs in a function of its own, so
+// it must not return, leave the loop, declare variables with var, use
+// arguments, await or yield, or assign the loop variables.
+func (t *transpiler) checkLoop(b *binding, origins map[int]string) {
+
+	open := b.loop + 1
+	body := t.parenEnd(open)
+
+	names := map[string]string{}
+	params := []string{}
+
+	for _, n := range b.names {
+		names[t.tokens[n].text] = origins[n]
+		params = append(params, t.tokens[n].text)
+	}
+
+	captured := ""
+
+	for j := open; j < b.end && captured == ""; j++ {
+		if end := t.functionEnd(j); end > j {
+			for k := j; k < end && captured == ""; k++ {
+				if _, ok := names[t.tokens[k].text]; ok && t.isReference(k) {
+					captured = t.tokens[k].text
+				}
+			}
+			j = end - 1
+		}
+	}
+
+	if captured == "" {
+		return
+	}
+
+	line := t.tokens[b.loop].line
+
+	fail := func(format string, args ...interface{}) {
+		panic(syntaxError(line, "closures capture the loop variable '%s', which needs %s", names[captured], fmt.Sprintf(format, args...)))
+	}
+
+	if !t.is(body, "{") {
+		fail("a block as loop body")
+	}
+
+	for j := open; j < body; j++ {
+		if end := t.functionEnd(j); end > j {
+			fail("no closures in the loop header")
+		}
+	}
+
+	end := t.tokens[body].match
+
+	// Statements nested in the body may break out of their own loops and
+	// switches.
+
+	type nested struct {
+		end  int
+		loop bool
+	}
+
+	var inner []nested
+
+	inside := func(k int, loop bool) bool {
+		for _, v := range inner {
+			if k < v.end && (v.loop || !loop) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for j := body + 1; j < end; j++ {
+
+		if _, ok := names[t.tokens[j].text]; ok && t.isReference(j) && t.assigns(j) {
+			fail("a loop body not assigning it")
+		}
+
+		if f := t.functionEnd(j); f > j {
+			for k := j; k < f; k++ {
+				if _, ok := names[t.tokens[k].text]; ok && t.isReference(k) && t.assigns(k) {
+					fail("a loop body not assigning it")
+				}
+			}
+			j = f - 1
+			continue
+		}
+
+		tok := t.tokens[j]
+
+		if tok.kind != tokenName || t.is(j-1, ".") || t.is(j-1, "?.") {
+			continue
+		}
+
+		switch tok.text {
+		case "for", "while", "do":
+			inner = append(inner, nested{t.statementEnd(j), true})
+		case "switch":
+			inner = append(inner, nested{t.statementEnd(j), false})
+		case "break", "continue":
+			if t.isName(j+1) && !t.tokens[j+1].nl {
+				fail("a loop body without labeled %s", tok.text)
+			}
+			if !inside(j, tok.text == "continue") {
+				fail("a loop body without %s", tok.text)
+			}
+		case "return", "var", "arguments", "await", "yield":
+			fail("a loop body without %s", tok.text)
+		}
+	}
+
+	t.loops[body] = strings.Join(params, ", ")
+}
+
+// loopBody emits the block at i, the body of a for loop whose variables are
+// captured by closures, as a function called with their current values.
+func (t *transpiler) loopBody(i int, params string) int {
+
+	end := t.tokens[i].match
+	call := "(" + params + ")"
+
+	if t.usesThis(i, end) {
+		call = ".call(this, " + params + ")"
+	}
+
+	t.write(t.tokens[i].pre, "{ (function (", params, ") {")
+	t.emit(i+1, end)
+	t.write(t.tokens[end].pre, "})", call, "; }")
+
+	return end + 1
+}
+
+// isReference tells whether the name at j refers to a variable, rather than
+// being a keyword, a property, a label or a class member.
+func (t *transpiler) isReference(j int) bool {
+
+	tok := t.tokens[j]
+
+	if tok.kind != tokenName || reservedWords[tok.text] || t.members[j] {
+		return false
+	}
+
+	if j == 0 {
+		return !t.is(j+1, ":")
+	}
+
+	switch {
+	case t.is(j-1, ".") || t.is(j-1, "?.") || t.is(j-1, "break") || t.is(j-1, "continue"):
+		return false
+	case t.is(j+1, ":") && (t.is(j-1, "{") || t.is(j-1, ",") || t.is(j-1, ";") || t.is(j-1, "}")):
+		return false
+	case (t.is(j-1, "get") || t.is(j-1, "set")) && t.is(j+1, "("):
+		return false
+	}
+
+	return true
+}
+
+// declares tells whether the name at j is declared there, by var, let,
+// const, function, class, or as a parameter.
+func (t *transpiler) declares(j int) bool {
+
+	if t.declared[j] || t.is(j-1, "function") || t.is(j-1, "class") || t.is(j+1, "=>") {
+		return true
+	}
+
+	for k := j - 1; k >= 0; k-- {
+		tok := t.tokens[k]
+		if tok.kind != tokenPunct {
+			continue
+		}
+		switch tok.text {
+		case ")", "]", "}":
+			k = tok.match
+		case "(":
+			m := tok.match
+			return t.is(m+1, "=>") || t.is(k-1, "catch") || (t.is(m+1, "{") && t.isFunctionBody(m+1))
+		case "[", "{":
+			return false
+		}
+	}
+
+	return false
+}
+
+// assigns tells whether the variable at j is assigned or incremented.
+func (t *transpiler) assigns(j int) bool {
+
+	next := t.tokens[j+1]
+
+	if next.kind == tokenPunct && (assignmentOperators[next.text] || ((next.text == "++" || next.text == "--") && !next.nl)) {
+		return true
+	}
+
+	// A prefix operator, unless it is the postfix one of the expression
+	// before.
+	return j > 0 && (t.is(j-1, "++") || t.is(j-1, "--")) && !(j > 1 && !t.tokens[j-1].nl && t.endsExpression(j-2))
+}
+
+// enclosingBrace returns the index of the innermost brace enclosing i, -1 at
+// the top level.
+func (t *transpiler) enclosingBrace(i int) int {
+	for k := i - 1; k >= 0; k-- {
+		tok := t.tokens[k]
+		if tok.kind != tokenPunct {
+			continue
+		}
+		switch tok.text {
+		case ")", "]", "}":
+			k = tok.match
+		case "{":
+			return k
+		}
+	}
+	return -1
+}
+
+// isFunctionBody tells whether the brace at k opens the body of a function
+// or method.
+func (t *transpiler) isFunctionBody(k int) bool {
+
+	if t.is(k-1, "=>") {
+		return true
+	}
+
+	if !t.is(k-1, ")") {
+		return false
+	}
+
+	p := t.tokens[k-1].match
+
+	return p > 0 && t.tokens[p-1].kind == tokenName && !controlKeywords[t.tokens[p-1].text]
+}
+
+// functionRange returns the range of the innermost function enclosing i,
+// parameters included, or the whole program.
+func (t *transpiler) functionRange(i int) (int, int) {
+
+	k := t.enclosingBrace(i + 1)
+
+	for k >= 0 && !t.isFunctionBody(k) {
+		k = t.enclosingBrace(k)
+	}
+
+	if k < 0 {
+		return 0, len(t.tokens)
+	}
+
+	start := k - 1
+
+	if t.is(k-1, "=>") {
+		start = k - 2
+	}
+
+	if t.is(start, ")") {
+		start = t.tokens[start].match
+	}
+
+	return start, t.tokens[k].match
+}
+
+// functionEnd returns the end of the function, arrow function or class
+// starting at i, or i.
+func (t *transpiler) functionEnd(i int) int {
+
+	tok := t.tokens[i]
+
+	if i > 0 && (t.is(i-1, ".") || t.is(i-1, "?.")) {
+		return i
+	}
+
+	switch {
+	case tok.kind == tokenName && tok.text == "function":
+		j := i + 1
+		for !t.is(j, "(") {
+			if t.tokens[j].kind == tokenEOF {
+				return i
+			}
+			j++
+		}
+		if b := t.tokens[j].match + 1; t.is(b, "{") {
+			return t.tokens[b].match + 1
+		}
+	case tok.kind == tokenName && tok.text == "class":
+		if open := t.classBody(i); open >= 0 {
+			return t.tokens[open].match + 1
+		}
+	case (tok.kind == tokenName || t.is(i, "(")) && t.isArrow(i):
+		arrow := i + 1
+		if t.is(i, "(") {
+			arrow = tok.match + 1
+		}
+		if t.is(arrow+1, "{") {
+			return t.tokens[arrow+1].match + 1
+		}
+		return t.expressionEnd(arrow + 1)
+	}
+
+	return i
+}
+
+// classBody returns the index of the body of the class starting at i, -1
+// when there is none.
+func (t *transpiler) classBody(i int) int {
+	for j := i + 1; ; j++ {
+		tok := t.tokens[j]
+		switch {
+		case tok.kind == tokenEOF:
+			return -1
+		case tok.kind == tokenPunct && tok.text == "{":
+			return j
+		case tok.kind == tokenPunct && (tok.text == "(" || tok.text == "["):
+			j = tok.match
+		case tok.kind == tokenPunct && (tok.text == ";" || tok.text == ")" || tok.text == "]" || tok.text == "}"):
+			return -1
+		}
+	}
+}
+
+// markMembers marks the names directly in the class body opening at i,
+// which are member names and modifiers.
+func (t *transpiler) markMembers(i int) {
+	for j := i + 1; j < t.tokens[i].match; j++ {
+		tok := t.tokens[j]
+		if tok.kind == tokenPunct && (tok.text == "(" || tok.text == "[" || tok.text == "{") {
+			j = tok.match
+		} else if tok.kind == tokenName {
+			t.members[j] = true
+		}
+	}
+}
+
+// parenEnd returns the index following the parentheses opening at i.
+func (t *transpiler) parenEnd(i int) int {
+	if !t.is(i, "(") {
+		panic(syntaxError(t.tokens[i].line, "'(' expected"))
+	}
+	return t.tokens[i].match + 1
+}
+
+// statementEnd returns the end of the statement starting at i.
+func (t *transpiler) statementEnd(i int) int {
+
+	tok := t.tokens[i]
+
+	if tok.kind == tokenEOF {
+		return i
+	}
+
+	if tok.kind == tokenPunct {
+		switch tok.text {
+		case "{":
+			return tok.match + 1
+		case ";":
+			return i + 1
+		}
+	}
+
+	j := i
+
+	if tok.kind == tokenName {
+		switch tok.text {
+		case "if":
+			j = t.statementEnd(t.parenEnd(i + 1))
+			if t.is(j, "else") {
+				j = t.statementEnd(j + 1)
+			}
+			return j
+		case "for", "while", "with":
+			return t.statementEnd(t.parenEnd(i + 1))
+		case "do":
+			j = t.statementEnd(i + 1)
+			if t.is(j, "while") {
+				j = t.parenEnd(j + 1)
+			}
+			if t.is(j, ";") {
+				j++
+			}
+			return j
+		case "try":
+			j = t.statementEnd(i + 1)
+			if t.is(j, "catch") {
+				j = j + 1
+				if t.is(j, "(") {
+					j = t.parenEnd(j)
+				}
+				j = t.statementEnd(j)
+			}
+			if t.is(j, "finally") {
+				j = t.statementEnd(j + 1)
+			}
+			return j
+		case "switch":
+			return t.statementEnd(t.parenEnd(i + 1))
+		case "function", "class":
+			if end := t.functionEnd(i); end > i {
+				return end
+			}
+		case "break", "continue", "debugger":
+			j = i + 1
+			if t.isName(j) && !t.tokens[j].nl {
+				j++
+			}
+			if t.is(j, ";") {
+				j++
+			}
+			return j
+		case "return", "throw":
+			j = i + 1
+			if t.tokens[j].nl || t.is(j, ";") || t.is(j, "}") {
+				if t.is(j, ";") {
+					j++
+				}
+				return j
+			}
+		case "var", "let", "const":
+			j = i + 1
+		}
+	}
+
+	j = t.expressionEnd(j)
+
+	for t.is(j, ",") {
+		j = t.expressionEnd(j + 1)
+	}
+
+	if t.is(j, ";") {
+		j++
+	}
+
+	return j
+}
+
+// EnableTranspiler installs the helpers used by transpiled code, and makes
+// require() and ScriptCache transpile the scripts they load (see Transpile).
+func (d *Context) EnableTranspiler() error {
+
+	if err := d.installTranspilerHelpers(); err != nil {
+		return err
+	}
+
+	d.transpile = true
+
+	return nil
+}
+
+// TranspilerCapability grants a sandbox ES2015+ scripts, see
+// EnableTranspiler.
+func TranspilerCapability() Capability {
+	return func(ctx *Context) error {
+		return ctx.EnableTranspiler()
+	}
+}
+
+// PevalTranspiled transpiles source and runs it, leaving the result (or the
+// error) on the stack. It installs the transpiler helpers when needed.
+func (d *Context) PevalTranspiled(filename string, source string) error {
+
+	if err := d.PcompileTranspiled(filename, source); err != nil {
+		return err
+	}
+
+	return d.castStringToError(d.Pcall(0))
+}
+
+// PcompileTranspiled transpiles source and pushes the function for its
+// global code, as PcompileLstringFilename with no flags would. On failure
+// the error is returned and left on the stack.
+func (d *Context) PcompileTranspiled(filename string, source string) error {
+
+	if err := d.installTranspilerHelpers(); err != nil {
+		d.pushTranspileError(err, filename)
+		return err
+	}
+
+	code, err := d.transpileSource(filename, source)
+
+	if err != nil {
+		return err
+	}
+
+	d.PushString(filename)
+
+	return d.PcompileLstringFilename(0, code, len(code))
+}
+
+// transpileSource returns source transpiled, or pushes the error.
+func (d *Context) transpileSource(filename string, source string) (string, error) {
+
+	code, err := Transpile(source)
+
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			e.FileName = filename
+		}
+		d.pushTranspileError(err, filename)
+		return "", err
+	}
+
+	return code, nil
+}
+
+func (d *Context) pushTranspileError(err error, filename string) {
+
+	e, ok := err.(*Error)
+
+	if !ok {
+		d.PushGoError(err)
+		return
+	}
+
+	d.PushErrorObject(ErrSyntax, "%s", e.Message)
+	d.PushString(filename)
+	d.PutPropString(-2, "fileName")
+	d.PushInt(e.LineNumber)
+	d.PutPropString(-2, "lineNumber")
+}
+
+func (d *Context) installTranspilerHelpers() error {
+
+	d.PushGlobalObject()
+	installed := d.HasPropString(-1, "__kk_async")
+	d.Pop()
+
+	if installed {
+		return nil
+	}
+
+	if err := d.PevalString(transpilerSource); err != nil {
+		d.Pop()
+		return err
+	}
+
+	d.PushGlobalObject()
+	d.PushGlobalStash()
+	d.GetPropString(-1, duktapeKey)
+	d.Remove(-2)
+
+	defer d.Pop()
+
+	return d.castStringToError(d.Pcall(2))
+}
+
+const transpilerSource = `(function (global, Duktape) {
+
+	var Thread = Duktape.Thread;
+
+	var define = function (name, value) {
+		Object.defineProperty(global, name, { value: value, writable: true, configurable: true });
+	};
+
+	var Await = function (value) {
+		this.value = value;
+	};
+
+	var Done = function (value) {
+		this.value = value;
+	};
+
+	define('__kk_async', function (self, args, fn) {
+		return new Promise(function (resolve, reject) {
+			var thread = new Thread(function () {
+				return new Done(fn.apply(self, args));
+			});
+			var step = function (value, error) {
+				var r;
+				try {
+					r = Thread.resume(thread, value, error);
+				} catch (e) {
+					reject(e);
+					return;
+				}
+				if (r instanceof Done) {
+					resolve(r.value);
+				} else {
+					Promise.resolve(r.value).then(function (v) {
+						step(v, false);
+					}, function (e) {
+						step(e, true);
+					});
+				}
+			};
+			step(undefined, false);
+		});
+	});
+
+	define('__kk_await', function (value) {
+		return Thread.yield(new Await(value));
+	});
+
+	define('__kk_inherits', function (C, P) {
+		if (typeof P !== 'function' && P !== null) {
+			throw new TypeError('Class extends value ' + String(P) + ' is not a constructor or null');
+		}
+		C.prototype = Object.create(P && P.prototype, {
+			constructor: { value: C, writable: true, configurable: true }
+		});
+		if (P) {
+			Object.setPrototypeOf(C, P);
+		}
+	});
+
+	define('__kk_define', function (target, key, kind, fn) {
+		var d = Object.getOwnPropertyDescriptor(target, key);
+		if (kind === 'value' || !d || !('get' in d || 'set' in d)) {
+			d = { configurable: true, enumerable: false };
+		}
+		if (kind === 'value') {
+			d.value = fn;
+			d.writable = true;
+		} else {
+			d[kind] = fn;
+		}
+		Object.defineProperty(target, key, d);
+	});
+
+})`
@@ -0,0 +1,160 @@
+package duktape
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func evalTranspiled(t *testing.T, ctx *Context, src string) string {
+	t.Helper()
+	defer ctx.Pop()
+	if err := ctx.PevalTranspiled("test.js", src); err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return ctx.SafeToString(-1)
+}
+
+func TestTranspile(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	for src, want := range map[string]string{
+		`[1, 2].map(x => x * 2).join()`: "2,4",
+		`var o = {v: 3}; o.g = function () { return [1].map(() => this.v)[0]; }; o.g()`: "3",
+		"var n = 2; `a${n + 1}b${`c${n}`}`":                                             "a3bc2",
+		`class A { constructor(x) { this.x = x; } get y() { return this.x + 1; } m() { return this.y; } static s() { return "s"; } }
+		class B extends A { constructor() { super(1); } m() { return super.m() * 10; } }
+		new B().m() + A.s()`: "20s",
+		`var o = new class { constructor() { this.v = 1; } }; o.v + ":" + (o instanceof Object) + ":" + (typeof o)`: "1:true:object",
+		`var a = new (class A { constructor(x) { this.x = x; } })(2); a.x + ":" + a.constructor.name`:               "2:A",
+		`var C = class extends Array {}; typeof C`:                                                                  "function",
+	} {
+		if got := evalTranspiled(t, ctx, src); got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestTranspileBlockScope(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	for src, want := range map[string]string{
+		`let x = 1; { let x = 2; } x`:                                                       "1",
+		`(function (x) { { let x = 2; } return x; })(1)`:                                    "1",
+		`var y = 1; (function () { { let y = 2; } return y; })()`:                           "1",
+		`let s = 0; for (let i = 0; i < 3; i++) { for (let i = 0; i < 2; i++) { s++; } } s`: "6",
+		`var o = {k: 1}; { let k = 2; o.k + k + ({k: k}).k }`:                               "5",
+		`const c = {n: 1}; c.n = 2; c.n`:                                                    "2",
+		`switch (1) { case 1: let z = "case"; z }`:                                          "case",
+	} {
+		if got := evalTranspiled(t, ctx, src); got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestTranspileLoopClosures(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	for src, want := range map[string]string{
+		`var fns = []; for (let i = 0; i < 3; i++) { fns.push(() => i); } fns.map(f => f()).join()`:                   "0,1,2",
+		`var fns = []; for (let k in {a: 1, b: 2}) { fns.push(function () { return k; }); } fns.map(f => f()).join()`: "a,b",
+		`var o = {v: "v"}; o.run = function () {
+			var fns = [];
+			for (let i = 0; i < 2; i++) {
+				for (;;) { fns.push(() => this.v + i); break; }
+			}
+			return fns.map(f => f()).join();
+		}; o.run()`: "v0,v1",
+		`var fns = []; for (var i = 0; i < 2; i++) { fns.push(() => i); } fns.map(f => f()).join()`: "2,2",
+	} {
+		if got := evalTranspiled(t, ctx, src); got != want {
+			t.Errorf("%s: got %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestTranspileErrors(t *testing.T) {
+
+	for src, want := range map[string]string{
+		"const c = 1;\nc = 2;": "assignment to constant variable 'c'",
+		"const c = 1;\nc++;":   "assignment to constant variable 'c'",
+		"for (let i = 0; i < 3; i++) {\n f(() => i); if (i) break;\n}": "without break",
+		"for (let i = 0; i < 3; i++) {\n f(() => i); return;\n}":       "without return",
+		"for (let i = 0; i < 3; i++) {\n f(() => i); i++;\n}":          "not assigning it",
+		"for (let i = 0; i < 3; i++) f(() => i);":                      "a block as loop body",
+		"class {": "unclosed '{'",
+	} {
+
+		_, err := Transpile(src)
+
+		var e *Error
+
+		if !errors.As(err, &e) || e.Type != "SyntaxError" || !strings.Contains(e.Message, want) {
+			t.Errorf("%s: got %v, want %q", src, err, want)
+		}
+	}
+
+	// A shadowing declaration makes the assignment legal.
+
+	if _, err := Transpile(`const c = 1; function f(c) { c = 2; }`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTranspileLines(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	err := ctx.PevalTranspiled("lines.js", "var g = function () {}; let f = (a) => {\n\treturn `x${a}`;\n};\nfor (let i = 0; i < 1; i++) {\n\tg(() => i);\n\tnull.x;\n}")
+	ctx.Pop()
+
+	var e *Error
+
+	if !errors.As(err, &e) || e.LineNumber != 6 || e.FileName != "lines.js" {
+		t.Errorf("got %#v", err)
+	}
+}
+
+func TestTranspileAsync(t *testing.T) {
+
+	l := NewLoop(New(), nil)
+	defer destroyLoop(l)
+
+	l.Dispatch().Sync(func() {
+		if err := l.Context().EnableTranspiler(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	err := l.Run(func(ctx *Context) {
+		if err := ctx.PevalTranspiled("async.js", `var out = [];
+		var wait = v => new Promise(resolve => setTimeout(() => resolve(v), 1));
+		var f = async function (n) {
+			var s = 0;
+			for (var i = 1; i <= n; i++) {
+				s += await wait(i);
+			}
+			return s;
+		};
+		f(3).then(v => out.push(v));`); err != nil {
+			t.Error(err)
+		}
+		ctx.Pop()
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loopString(t, l, `out.join()`); got != "6" {
+		t.Errorf("got %q", got)
+	}
+}
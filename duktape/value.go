@@ -0,0 +1,438 @@
+package duktape
+
+/*
+#include <string.h>
+#include "duk_config.h"
+#include "duktape.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/hailongz/kk-lib/dynamic"
+)
+
+const maxValueDepth = 128
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// PushValue converts a Go value into its JavaScript counterpart and pushes it
+// onto the stack. Maps and structs become objects (struct fields are named by
+// their json tag, see eachField), slices and arrays become arrays, []byte
+// becomes a buffer, time.Time becomes a Date and nil becomes null.
+func (d *Context) PushValue(v interface{}) {
+	d.pushReflectValue(reflect.ValueOf(v), 0)
+}
+
+func (d *Context) pushReflectValue(v reflect.Value, depth int) {
+
+	if !v.IsValid() {
+		d.PushNull()
+		return
+	}
+
+	if depth > maxValueDepth {
+		d.PushUndefined()
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		d.PushBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		d.PushNumber(float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		d.PushNumber(float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		d.PushNumber(v.Float())
+	case reflect.String:
+		d.pushGoString(v.String())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			d.PushNull()
+		} else {
+			d.pushReflectValue(v.Elem(), depth+1)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			d.pushBytes(v.Bytes())
+			return
+		}
+		d.pushReflectArray(v, depth)
+	case reflect.Array:
+		d.pushReflectArray(v, depth)
+	case reflect.Map:
+		d.PushObject()
+		for _, key := range v.MapKeys() {
+			vv := v.MapIndex(key)
+			if key.CanInterface() && vv.CanInterface() {
+				d.pushReflectValue(vv, depth+1)
+				d.PutPropString(-2, dynamic.StringValue(key.Interface(), ""))
+			}
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			d.pushDate(v.Interface().(time.Time))
+			return
+		}
+		d.PushObject()
+		eachField(v, func(name string, fv reflect.Value) bool {
+			d.pushReflectValue(fv, depth+1)
+			d.PutPropString(-2, name)
+			return true
+		})
+	case reflect.Func:
+		if v.IsNil() {
+			d.PushNull()
+		} else if fn, ok := v.Interface().(func() int); ok {
+			d.PushGoFunction(fn)
+		} else {
+			d.PushGoFunc(v.Interface())
+		}
+	default:
+		d.PushUndefined()
+	}
+}
+
+// eachField calls fn with the exported fields of the struct v named by their
+// json tag, until fn returns false, and returns false when it did. Untagged
+// fields are skipped, except embedded structs whose fields are walked as if
+// they were fields of v. Unlike dynamic.EachReflect, struct fields are not
+// flattened.
+func eachField(v reflect.Value, fn func(name string, fv reflect.Value) bool) bool {
+
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+
+		tf := t.Field(i)
+		name := strings.Split(tf.Tag.Get("json"), ",")[0]
+
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			if tf.Anonymous && tf.Type.Kind() == reflect.Struct {
+				if !eachField(v.Field(i), fn) {
+					return false
+				}
+			}
+			continue
+		}
+
+		if tf.PkgPath != "" {
+			continue
+		}
+
+		if !fn(name, v.Field(i)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pushDate pushes t as a Date.
+func (d *Context) pushDate(t time.Time) {
+	d.GetGlobalString("Date")
+	// UnixNano overflows outside of the years 1678 to 2262.
+	d.PushNumber(float64(t.Unix())*1000 + float64(t.Nanosecond())/float64(time.Millisecond))
+	d.New(1)
+}
+
+// isDate tells whether the value at idx is a Date.
+func (d *Context) isDate(idx int) bool {
+	idx = d.NormalizeIndex(idx)
+	if !d.GetGlobalString("Date") {
+		d.Pop()
+		return false
+	}
+	r := C.duk_instanceof(d.duk_context, C.duk_idx_t(idx), -1) != 0
+	d.Pop()
+	return r
+}
+
+// getDate returns the time of the Date at idx, the zero time for an invalid
+// Date.
+func (d *Context) getDate(idx int) time.Time {
+	d.Dup(idx)
+	d.PushString("getTime")
+	d.PcallProp(-2, 0)
+	ms := d.GetNumber(-1)
+	d.Pop2()
+	if math.IsNaN(ms) {
+		return time.Time{}
+	}
+	sec := math.Floor(ms / 1000)
+	return time.Unix(int64(sec), int64((ms-sec*1000)*float64(time.Millisecond)))
+}
+
+func (d *Context) pushReflectArray(v reflect.Value, depth int) {
+	d.PushArray()
+	for i := 0; i < v.Len(); i++ {
+		d.pushReflectValue(v.Index(i), depth+1)
+		d.PutPropIndex(-2, uint(i))
+	}
+}
+
+func (d *Context) pushGoString(s string) {
+	if len(s) == 0 {
+		C.duk_push_lstring(d.duk_context, nil, 0)
+		return
+	}
+	p := C.CString(s)
+	C.duk_push_lstring(d.duk_context, p, C.duk_size_t(len(s)))
+	C.free(unsafe.Pointer(p))
+}
+
+func (d *Context) pushBytes(b []byte) {
+	p := C.duk_push_buffer_raw(d.duk_context, C.duk_size_t(len(b)), 0)
+	if len(b) > 0 {
+		C.memcpy(p, unsafe.Pointer(&b[0]), C.size_t(len(b)))
+	}
+}
+
+// ToValue converts the value at idx into a Go value without modifying the
+// stack. undefined and null become nil, numbers become float64, arrays become
+// []interface{}, buffers become []byte, Dates become time.Time, objects
+// pushed with PushGoObject
+// return the original Go object and other objects become
+// map[string]interface{}. Functions and cyclic references become nil.
+func (d *Context) ToValue(idx int) interface{} {
+	return d.toValue(d.NormalizeIndex(idx), map[unsafe.Pointer]bool{}, 0)
+}
+
+func (d *Context) toValue(idx int, visited map[unsafe.Pointer]bool, depth int) interface{} {
+
+	if depth > maxValueDepth {
+		return nil
+	}
+
+	switch d.GetType(idx) {
+	case TypeBoolean:
+		return d.GetBoolean(idx)
+	case TypeNumber:
+		return d.GetNumber(idx)
+	case TypeString:
+		return d.getGoString(idx)
+	case TypeBuffer:
+		return d.getBytes(idx)
+	case TypeObject:
+
+		if d.IsFunction(idx) {
+			return nil
+		}
+
+		if C.duk_is_buffer_data(d.duk_context, C.duk_idx_t(idx)) != 0 {
+			return d.getBytes(idx)
+		}
+
+		if object := d.ToGoObject(idx); object != nil {
+			return object
+		}
+
+		if d.isDate(idx) {
+			return d.getDate(idx)
+		}
+
+		ptr := d.GetHeapptr(idx)
+
+		if visited[ptr] {
+			return nil
+		}
+
+		visited[ptr] = true
+		defer delete(visited, ptr)
+
+		if d.IsArray(idx) {
+			n := d.GetLength(idx)
+			vs := make([]interface{}, n)
+			for i := 0; i < n; i++ {
+				d.GetPropIndex(idx, uint(i))
+				vs[i] = d.toValue(d.NormalizeIndex(-1), visited, depth+1)
+				d.Pop()
+			}
+			return vs
+		}
+
+		m := map[string]interface{}{}
+
+		d.Enum(idx, DUK_ENUM_OWN_PROPERTIES_ONLY)
+
+		for d.Next(-1, true) {
+			if !d.IsFunction(-1) {
+				m[d.getGoString(-2)] = d.toValue(d.NormalizeIndex(-1), visited, depth+1)
+			}
+			d.Pop2()
+		}
+
+		d.Pop()
+
+		return m
+	}
+
+	return nil
+}
+
+func (d *Context) getGoString(idx int) string {
+	var n C.duk_size_t
+	s := C.duk_get_lstring(d.duk_context, C.duk_idx_t(idx), &n)
+	if s == nil {
+		return ""
+	}
+	return C.GoStringN(s, C.int(n))
+}
+
+func (d *Context) getBytes(idx int) []byte {
+	var n C.duk_size_t
+	p := C.duk_get_buffer_data(d.duk_context, C.duk_idx_t(idx), &n)
+	if p == nil || n == 0 {
+		return []byte{}
+	}
+	return C.GoBytes(p, C.int(n))
+}
+
+// convertValue converts a value produced by ToValue into the Go type t.
+func convertValue(value interface{}, t reflect.Type) (reflect.Value, error) {
+
+	if value == nil {
+		return reflect.Zero(t), nil
+	}
+
+	v := reflect.ValueOf(value)
+
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+
+	switch s := value.(type) {
+	case string:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+			// Like Number(s), but a string that is not a number is an
+			// error rather than NaN.
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("cannot convert string %q to %s", s, t.String())
+			}
+			value = f
+		}
+	case []interface{}, map[string]interface{}:
+		switch t.Kind() {
+		case reflect.String, reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+			return reflect.Value{}, fmt.Errorf("cannot convert %s to %s", jsTypeName(value), t.String())
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if b, ok := value.([]byte); ok {
+			return reflect.ValueOf(string(b)).Convert(t), nil
+		}
+		return reflect.ValueOf(dynamic.StringValue(value, "")).Convert(t), nil
+	case reflect.Bool:
+		return reflect.ValueOf(dynamic.BooleanValue(value, false)).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.ValueOf(dynamic.IntValue(value, 0)).Convert(t), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return reflect.ValueOf(dynamic.UintValue(value, 0)).Convert(t), nil
+	case reflect.Float32, reflect.Float64:
+		return reflect.ValueOf(dynamic.FloatValue(value, 0)).Convert(t), nil
+	case reflect.Ptr:
+		vv, err := convertValue(value, t.Elem())
+		if err != nil {
+			return vv, err
+		}
+		p := reflect.New(t.Elem())
+		p.Elem().Set(vv)
+		return p, nil
+	case reflect.Slice:
+		if s, ok := value.(string); ok && t.Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf([]byte(s)).Convert(t), nil
+		}
+		if vs, ok := value.([]interface{}); ok {
+			r := reflect.MakeSlice(t, len(vs), len(vs))
+			for i, item := range vs {
+				vv, err := convertValue(item, t.Elem())
+				if err != nil {
+					return vv, err
+				}
+				r.Index(i).Set(vv)
+			}
+			return r, nil
+		}
+	case reflect.Map:
+		if m, ok := value.(map[string]interface{}); ok {
+			r := reflect.MakeMap(t)
+			for key, item := range m {
+				kv, err := convertValue(key, t.Key())
+				if err != nil {
+					return kv, err
+				}
+				vv, err := convertValue(item, t.Elem())
+				if err != nil {
+					return vv, err
+				}
+				r.SetMapIndex(kv, vv)
+			}
+			return r, nil
+		}
+	case reflect.Struct:
+		if m, ok := value.(map[string]interface{}); ok && t != timeType {
+			r := reflect.New(t).Elem()
+			var err error
+			eachField(r, func(name string, fv reflect.Value) bool {
+				item, ok := m[name]
+				if !ok {
+					return true
+				}
+				var vv reflect.Value
+				if vv, err = convertValue(item, fv.Type()); err != nil {
+					err = fmt.Errorf("%s: %s", name, err.Error())
+					return false
+				}
+				fv.Set(vv)
+				return true
+			})
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return r, nil
+		}
+	}
+
+	return reflect.Value{}, fmt.Errorf("cannot convert %s to %s", jsTypeName(value), t.String())
+}
+
+func jsTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []byte:
+		return "buffer"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,137 @@
+package duktape
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type valueInner struct {
+	Z int `json:"z"`
+}
+
+type valueOuter struct {
+	Name string     `json:"name"`
+	In   valueInner `json:"in"`
+	At   time.Time  `json:"at"`
+	Tags []string   `json:"tags"`
+}
+
+func TestPushValueNestedStruct(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	at := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+
+	ctx.PushValue(valueOuter{Name: "a", In: valueInner{Z: 3}, At: at, Tags: []string{"x"}})
+	ctx.PutGlobalString("v")
+
+	if err := ctx.PevalString(`[typeof v.z, v.in.z, v.at instanceof Date, v.at.toISOString(), v.tags[0]].join(",")`); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := ctx.SafeToString(-1); s != "undefined,3,true,2020-05-17T10:30:00.000Z,x" {
+		t.Errorf("got %q", s)
+	}
+
+	ctx.Pop()
+}
+
+func TestConvertValueNestedStruct(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	if err := ctx.PevalString(`({name: "a", in: {z: 3}, at: new Date(Date.UTC(2020, 4, 17)), tags: ["x", "y"]})`); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := convertValue(ctx.ToValue(-1), reflect.TypeOf(valueOuter{}))
+	ctx.Pop()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := v.Interface().(valueOuter)
+
+	if got.Name != "a" || got.In.Z != 3 || len(got.Tags) != 2 {
+		t.Errorf("got %+v", got)
+	}
+
+	if !got.At.Equal(time.Date(2020, 5, 17, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got time %v", got.At)
+	}
+}
+
+func TestDateRoundTrip(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	for _, c := range []struct {
+		at  time.Time
+		iso string
+	}{
+		{time.Time{}, "0001-01-01T00:00:00.000Z"},
+		{time.Date(1500, 3, 1, 12, 0, 0, 0, time.UTC), "1500-03-01T12:00:00.000Z"},
+		{time.Date(1969, 12, 31, 23, 59, 59, 250*int(time.Millisecond), time.UTC), "1969-12-31T23:59:59.250Z"},
+		{time.Date(3000, 1, 2, 3, 4, 5, 6*int(time.Millisecond), time.UTC), "3000-01-02T03:04:05.006Z"},
+	} {
+
+		ctx.PushValue(c.at)
+
+		ctx.GetPropString(-1, "toISOString")
+		ctx.Dup(-2)
+
+		if ctx.PcallMethod(0) != ExecSuccess {
+			t.Fatal(ctx.SafeToString(-1))
+		}
+
+		if got := ctx.SafeToString(-1); got != c.iso {
+			t.Errorf("pushed %v as %s", c.at, got)
+		}
+
+		ctx.Pop()
+
+		if got, ok := ctx.ToValue(-1).(time.Time); !ok || !got.Equal(c.at) {
+			t.Errorf("got %v back for %v", got, c.at)
+		}
+
+		ctx.Pop()
+	}
+}
+
+func TestConvertValueNestedError(t *testing.T) {
+
+	_, err := convertValue(map[string]interface{}{
+		"in": map[string]interface{}{"z": []interface{}{1.0}},
+	}, reflect.TypeOf(valueOuter{}))
+
+	if err == nil || !strings.Contains(err.Error(), "in: z: cannot convert array to int") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestToValueCycle(t *testing.T) {
+
+	ctx := New()
+	defer ctx.DestroyHeap()
+
+	if err := ctx.PevalString(`var o = {a: [1, "b", null]}; o.self = o; o`); err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := ctx.ToValue(-1).(map[string]interface{})
+	ctx.Pop()
+
+	if !ok {
+		t.Fatalf("got %T", m)
+	}
+
+	if !reflect.DeepEqual(m["a"], []interface{}{1.0, "b", nil}) || m["self"] != nil {
+		t.Errorf("got %v", m)
+	}
+}
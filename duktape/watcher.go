@@ -0,0 +1,426 @@
+package duktape
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrScriptNotFound = errors.New("duktape: script not found")
+var ErrWatcherClosed = errors.New("duktape: script watcher closed")
+
+// ScriptWatcherOptions configures a ScriptWatcher.
+type ScriptWatcherOptions struct {
+	// Interval is the delay between two scans of the directory, 1 second
+	// when not set.
+	Interval time.Duration
+	// New creates the contexts, NewWithOptions(Options{}) when nil.
+	New func() (*Context, error)
+	// Init prepares every new context before its script runs. require()
+	// is already enabled on the directory, see EnableModules.
+	Init func(ctx *Context) error
+	// OnError is called when a script fails to load, the previous version
+	// of the script staying in use. The errors are logged when nil.
+	OnError func(name string, err error)
+	// OnLoad is called when a new version of a script is in use.
+	OnLoad func(name string)
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+type watchedScript struct {
+	ctx  *Context
+	lock sync.Mutex
+	// refs counts the Do calls using ctx, which is destroyed once the
+	// script is replaced and refs drops to 0.
+	refs    int
+	retired bool
+}
+
+// ScriptWatcher runs each .js file at the top of a directory in its own
+// context and reloads it when it changes. The other files of the directory
+// (below it included) are modules for require(), a change to any of them
+// reloads every script.
+//
+// A reloaded script runs in a new context, which replaces the previous one
+// for the Do calls made from then on; the calls in progress complete on the
+// previous context, destroyed afterwards. A script failing to load or run
+// is reported and its previous version stays in use.
+type ScriptWatcher struct {
+	dir     string
+	options ScriptWatcherOptions
+	stamps  map[string]fileStamp
+	scripts map[string]*watchedScript
+	errs    map[string]error
+	closed  bool
+	lock    sync.Mutex
+	scan    sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewScriptWatcher loads the scripts of dir and starts watching it. Only a
+// failure to read dir is returned, scripts failing to load are reported to
+// options.OnError.
+func NewScriptWatcher(dir string, options ScriptWatcherOptions) (*ScriptWatcher, error) {
+
+	if options.Interval <= 0 {
+		options.Interval = time.Second
+	}
+
+	w := &ScriptWatcher{
+		dir:     dir,
+		options: options,
+		stamps:  map[string]fileStamp{},
+		scripts: map[string]*watchedScript{},
+		errs:    map[string]error{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := w.Scan(); err != nil {
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+func (w *ScriptWatcher) run() {
+
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if err := w.Scan(); err != nil {
+				w.report("", err)
+			}
+		}
+	}
+}
+
+// Scan checks the directory for changes now, without waiting for the next
+// scan, and reloads the scripts affected.
+func (w *ScriptWatcher) Scan() error {
+
+	w.scan.Lock()
+	defer w.scan.Unlock()
+
+	stamps := map[string]fileStamp{}
+
+	err := filepath.WalkDir(w.dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(w.dir, p)
+		if err != nil {
+			return err
+		}
+		stamps[filepath.ToSlash(name)] = fileStamp{info.ModTime(), info.Size()}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	modules := false
+	var changed []string
+	var removed []string
+
+	for name, stamp := range stamps {
+		if prev, ok := w.stamps[name]; ok && prev == stamp {
+			continue
+		}
+		if isScriptName(name) {
+			changed = append(changed, name)
+		} else {
+			modules = true
+		}
+	}
+
+	for name := range w.stamps {
+		if _, ok := stamps[name]; ok {
+			continue
+		}
+		if isScriptName(name) {
+			removed = append(removed, name)
+		} else {
+			modules = true
+		}
+	}
+
+	w.stamps = stamps
+
+	if modules {
+		changed = changed[:0]
+		for name := range stamps {
+			if isScriptName(name) {
+				changed = append(changed, name)
+			}
+		}
+	}
+
+	sort.Strings(changed)
+
+	for _, name := range removed {
+		w.swap(name, nil, nil)
+	}
+
+	for _, name := range changed {
+		ctx, err := w.load(name)
+		w.swap(name, ctx, err)
+		if err != nil {
+			w.report(name, err)
+		} else if w.options.OnLoad != nil {
+			w.options.OnLoad(name)
+		}
+	}
+
+	return nil
+}
+
+func isScriptName(name string) bool {
+	return path.Ext(name) == ".js" && !strings.Contains(name, "/")
+}
+
+func (w *ScriptWatcher) report(name string, err error) {
+	if w.options.OnError != nil {
+		w.options.OnError(name, err)
+	} else if name == "" {
+		log.Printf("[ScriptWatcher] %s: %s", w.dir, err)
+	} else {
+		log.Printf("[ScriptWatcher] %s: %s", filepath.Join(w.dir, name), err)
+	}
+}
+
+// load runs the script name in a new context.
+func (w *ScriptWatcher) load(name string) (*Context, error) {
+
+	b, err := os.ReadFile(filepath.Join(w.dir, filepath.FromSlash(name)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ctx *Context
+
+	if w.options.New != nil {
+		ctx, err = w.options.New()
+	} else {
+		ctx, err = NewWithOptions(Options{})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.EnableModules(NewDirResolver(w.dir))
+
+	if w.options.Init != nil {
+		if err = w.options.Init(ctx); err != nil {
+			ctx.DestroyHeap()
+			return nil, err
+		}
+	}
+
+	source := string(b)
+
+	if ctx.transpile {
+		err = ctx.PcompileTranspiled(name, source)
+	} else {
+		ctx.PushString(name)
+		err = ctx.PcompileLstringFilename(0, source, len(source))
+	}
+
+	if err == nil {
+		err = ctx.castStringToError(ctx.Pcall(0))
+	}
+
+	if err != nil {
+		ctx.DestroyHeap()
+		return nil, err
+	}
+
+	ctx.SetTop(0)
+
+	return ctx, nil
+}
+
+// swap makes ctx the current context of the script name. A nil ctx with a
+// nil err removes the script, with an error it keeps the current one.
+func (w *ScriptWatcher) swap(name string, ctx *Context, err error) {
+
+	w.lock.Lock()
+
+	if err != nil {
+		w.errs[name] = err
+		w.lock.Unlock()
+		return
+	}
+
+	delete(w.errs, name)
+
+	prev := w.scripts[name]
+	closed := w.closed
+
+	if ctx == nil || closed {
+		delete(w.scripts, name)
+	} else {
+		w.scripts[name] = &watchedScript{ctx: ctx}
+	}
+
+	destroy := prev != nil && prev.retire()
+
+	w.lock.Unlock()
+
+	if destroy {
+		prev.ctx.DestroyHeap()
+	}
+
+	if ctx != nil && closed {
+		ctx.DestroyHeap()
+	}
+}
+
+// retire marks the script as replaced and tells whether its context can
+// be destroyed right away. Called with the lock of the watcher held.
+func (s *watchedScript) retire() bool {
+	s.retired = true
+	return s.refs == 0
+}
+
+// Do calls fn with the current context of the script name, a path relative
+// to the directory such as "rules.js". Calls on the same script are
+// serialized. The stack is emptied after fn.
+func (w *ScriptWatcher) Do(name string, fn func(ctx *Context) error) error {
+
+	w.lock.Lock()
+
+	if w.closed {
+		w.lock.Unlock()
+		return ErrWatcherClosed
+	}
+
+	s := w.scripts[name]
+
+	if s == nil {
+		err := w.errs[name]
+		w.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		return ErrScriptNotFound
+	}
+
+	s.refs = s.refs + 1
+	w.lock.Unlock()
+
+	defer w.release(s)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	defer s.ctx.SetTop(0)
+
+	return fn(s.ctx)
+}
+
+func (w *ScriptWatcher) release(s *watchedScript) {
+
+	w.lock.Lock()
+	s.refs = s.refs - 1
+	destroy := s.retired && s.refs == 0
+	w.lock.Unlock()
+
+	if destroy {
+		s.ctx.DestroyHeap()
+	}
+}
+
+// Names returns the names of the scripts in use, sorted.
+func (w *ScriptWatcher) Names() []string {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	names := make([]string, 0, len(w.scripts))
+
+	for name := range w.scripts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Err returns the error of the last attempt to load the script name, nil
+// once it loaded successfully.
+func (w *ScriptWatcher) Err(name string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.errs[name]
+}
+
+// Close stops watching and destroys the contexts, those used by Do calls in
+// progress once the calls return.
+func (w *ScriptWatcher) Close() {
+
+	w.lock.Lock()
+
+	if w.closed {
+		w.lock.Unlock()
+		return
+	}
+
+	w.closed = true
+	w.lock.Unlock()
+
+	close(w.stop)
+	<-w.done
+
+	w.scan.Lock()
+	defer w.scan.Unlock()
+
+	w.lock.Lock()
+
+	var destroy []*Context
+
+	for name, s := range w.scripts {
+		if s.retire() {
+			destroy = append(destroy, s.ctx)
+		}
+		delete(w.scripts, name)
+	}
+
+	w.lock.Unlock()
+
+	for _, ctx := range destroy {
+		ctx.DestroyHeap()
+	}
+}
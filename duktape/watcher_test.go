@@ -0,0 +1,203 @@
+package duktape
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeScript writes a file of the watcher directory, moving its time
+// forward so that the next scan sees the change.
+func writeScript(t *testing.T, dir string, name string, src string) {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(time.Duration(len(src)) * time.Second)
+	if err := os.Chtimes(p, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func watchedString(t *testing.T, w *ScriptWatcher, name string, src string) string {
+	t.Helper()
+	var s string
+	err := w.Do(name, func(ctx *Context) error {
+		if err := ctx.PevalString(src); err != nil {
+			return err
+		}
+		s = ctx.SafeToString(-1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return s
+}
+
+func TestScriptWatcher(t *testing.T) {
+
+	dir := t.TempDir()
+
+	writeScript(t, dir, "a.js", `var v = "a" + require("./lib/m").v;`)
+	writeScript(t, dir, "b.js", `var v = "b";`)
+	writeScript(t, dir, "lib/m.js", `exports.v = 1;`)
+
+	var loaded []string
+	errs := map[string]error{}
+
+	w, err := NewScriptWatcher(dir, ScriptWatcherOptions{
+		Interval: time.Hour,
+		OnLoad:   func(name string) { loaded = append(loaded, name) },
+		OnError:  func(name string, err error) { errs[name] = err },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	if got := w.Names(); len(got) != 2 || got[0] != "a.js" || got[1] != "b.js" {
+		t.Errorf("got %v", got)
+	}
+
+	if got := watchedString(t, w, "a.js", "v"); got != "a1" {
+		t.Errorf("got %q", got)
+	}
+
+	// A change to a script reloads it alone.
+
+	loaded = nil
+	writeScript(t, dir, "b.js", `var v = "b2";`)
+
+	if err := w.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := watchedString(t, w, "b.js", "v"); got != "b2" || len(loaded) != 1 {
+		t.Errorf("got %q, loaded %v", got, loaded)
+	}
+
+	// A change to a module reloads every script.
+
+	loaded = nil
+	writeScript(t, dir, "lib/m.js", `exports.v = 22;`)
+
+	if err := w.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := watchedString(t, w, "a.js", "v"); got != "a22" || len(loaded) != 2 {
+		t.Errorf("got %q, loaded %v", got, loaded)
+	}
+
+	// A broken version keeps the previous one in use.
+
+	writeScript(t, dir, "b.js", `var v = ;`)
+
+	if err := w.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := watchedString(t, w, "b.js", "v"); got != "b2" {
+		t.Errorf("got %q", got)
+	}
+
+	if w.Err("b.js") == nil || errs["b.js"] != w.Err("b.js") {
+		t.Errorf("got %v, reported %v", w.Err("b.js"), errs["b.js"])
+	}
+
+	writeScript(t, dir, "b.js", `var v = "b3";`)
+
+	if err := w.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := watchedString(t, w, "b.js", "v"); got != "b3" || w.Err("b.js") != nil {
+		t.Errorf("got %q, %v", got, w.Err("b.js"))
+	}
+}
+
+func TestScriptWatcherRemoved(t *testing.T) {
+
+	dir := t.TempDir()
+
+	writeScript(t, dir, "a.js", `var v = 1;`)
+	writeScript(t, dir, "bad.js", `throw new Error("no");`)
+
+	w, err := NewScriptWatcher(dir, ScriptWatcherOptions{
+		Interval: time.Hour,
+		OnError:  func(name string, err error) {},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A script that never loaded returns its error.
+
+	if err := w.Do("bad.js", func(ctx *Context) error { return nil }); err == nil || err != w.Err("bad.js") {
+		t.Errorf("got %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "a.js")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Do("a.js", func(ctx *Context) error { return nil }); err != ErrScriptNotFound {
+		t.Errorf("got %v", err)
+	}
+
+	w.Close()
+
+	if err := w.Do("bad.js", func(ctx *Context) error { return nil }); err != ErrWatcherClosed {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestScriptWatcherReloadDuringDo(t *testing.T) {
+
+	dir := t.TempDir()
+
+	writeScript(t, dir, "a.js", `var v = 1;`)
+
+	w, err := NewScriptWatcher(dir, ScriptWatcherOptions{Interval: time.Hour})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	// The call in progress completes on the previous context.
+
+	err = w.Do("a.js", func(ctx *Context) error {
+		writeScript(t, dir, "a.js", `var v = 2;`)
+		if err := w.Scan(); err != nil {
+			return err
+		}
+		ctx.GetGlobalString("v")
+		if ctx.GetInt(-1) != 1 {
+			t.Errorf("got %d", ctx.GetInt(-1))
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := watchedString(t, w, "a.js", "v"); got != "2" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -32,8 +33,14 @@ type Options struct {
 	Data          interface{}
 	Headers       map[string]string
 	RedirectCount int
+	Client        *xhttp.Client
+	MaxBodySize   int64
 }
 
+// ErrBodyTooLarge is returned by Do when a response body is larger than
+// MaxBodySize.
+var ErrBodyTooLarge = errors.New("http: response body too large")
+
 var ca *x509.CertPool
 var client *xhttp.Client
 
@@ -67,44 +74,20 @@ func Send(options *Options) (interface{}, error) {
 	var resp *xhttp.Response
 	var req *xhttp.Request
 	var err error
+	var client = client
+
+	if options.Client != nil {
+		client = options.Client
+	}
 
 	if options.Method == "POST" {
 
 		var body []byte = nil
 
-		if strings.Contains(options.Type, "json") {
-
-			body, err = json.Marshal(options.Data)
-
-			if err != nil {
-				return nil, err
-			}
-
-		} else if strings.Contains(options.Type, "text") {
-
-			body = []byte(dynamic.StringValue(options.Data, ""))
-
-		} else {
-
-			idx := 0
-			b := bytes.NewBuffer(nil)
-
-			dynamic.Each(options.Data, func(key interface{}, value interface{}) bool {
-
-				if idx != 0 {
-					b.WriteString("&")
-				}
-
-				b.WriteString(dynamic.StringValue(key, ""))
-				b.WriteString("=")
-				b.WriteString(xurl.QueryEscape(dynamic.StringValue(value, "")))
-
-				idx = idx + 1
-
-				return true
-			})
+		body, err = encodeBody(options)
 
-			body = b.Bytes()
+		if err != nil {
+			return nil, err
 		}
 
 		req, err = xhttp.NewRequest("POST", url, bytes.NewReader(body))
@@ -219,3 +202,125 @@ func Send(options *Options) (interface{}, error) {
 		return nil, errors.New(fmt.Sprintf("[%d] %s", resp.StatusCode, string(b.Bytes())))
 	}
 }
+
+func encodeBody(options *Options) ([]byte, error) {
+
+	if strings.Contains(options.Type, "json") {
+		return json.Marshal(options.Data)
+	}
+
+	if strings.Contains(options.Type, "text") {
+		return []byte(dynamic.StringValue(options.Data, "")), nil
+	}
+
+	idx := 0
+	b := bytes.NewBuffer(nil)
+
+	dynamic.Each(options.Data, func(key interface{}, value interface{}) bool {
+
+		if idx != 0 {
+			b.WriteString("&")
+		}
+
+		b.WriteString(dynamic.StringValue(key, ""))
+		b.WriteString("=")
+		b.WriteString(xurl.QueryEscape(dynamic.StringValue(value, "")))
+
+		idx = idx + 1
+
+		return true
+	})
+
+	return b.Bytes(), nil
+}
+
+// Response is a response received by Do.
+type Response struct {
+	Url        string
+	StatusCode int
+	Status     string
+	Headers    xhttp.Header
+	Body       []byte
+}
+
+// Do sends a request with any method (GET when empty) and returns the
+// response whatever its status. Data is sent as is when it is a string or
+// []byte and encoded according to Type otherwise; Type sets the
+// Content-Type of requests with a body unless Headers already does. Redirects
+// are followed by the client. ResponseType and RedirectCount are ignored.
+// The body is read whole, up to MaxBodySize bytes when it is positive.
+func Do(ctx context.Context, options *Options) (*Response, error) {
+
+	var c = client
+	var body io.Reader = nil
+
+	if options.Client != nil {
+		c = options.Client
+	}
+
+	method := strings.ToUpper(options.Method)
+
+	if method == "" {
+		method = "GET"
+	}
+
+	switch data := options.Data.(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(data)
+	case []byte:
+		body = bytes.NewReader(data)
+	default:
+		b, err := encodeBody(options)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := xhttp.NewRequestWithContext(ctx, method, options.Url, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil && options.Type != "" {
+		req.Header.Set("Content-Type", options.Type)
+	}
+
+	for key, value := range options.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := c.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var r io.Reader = resp.Body
+
+	if options.MaxBodySize > 0 {
+		r = io.LimitReader(resp.Body, options.MaxBodySize+1)
+	}
+
+	b, err := io.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if options.MaxBodySize > 0 && int64(len(b)) > options.MaxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+
+	return &Response{
+		Url:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+		Headers:    resp.Header,
+		Body:       b,
+	}, nil
+}